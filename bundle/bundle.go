@@ -0,0 +1,165 @@
+// Package bundle exports images into self-contained tar archives and
+// imports them into any backend, e.g. to carry images into air-gapped sites.
+//
+// An archive holds, in this order:
+//   - metadata.json: the types.Image, without its local path
+//   - disk.img: the image file
+//   - disk.img.sha256: the hex sha256 of disk.img
+package bundle
+
+import (
+	"archive/tar"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/yuyang0/vmimage"
+	"github.com/yuyang0/vmimage/types"
+	"github.com/yuyang0/vmimage/utils"
+)
+
+const (
+	metadataEntry = "metadata.json"
+	diskEntry     = "disk.img"
+	digestEntry   = "disk.img.sha256"
+)
+
+// Export writes the archive of img to w, img must have a local file, e.g.
+// the image returned by LoadImage.
+func Export(ctx context.Context, img *types.Image, w io.Writer) error {
+	if img.LocalPath == "" {
+		return errors.Errorf("image %s has no local file", img.Fullname())
+	}
+	f, err := os.Open(img.LocalPath)
+	if err != nil {
+		return types.NewError(types.ErrImageNotFound, err)
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	meta := *img
+	meta.LocalPath = ""
+	metaBytes, err := json.MarshalIndent(&meta, "", "  ")
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	tw := tar.NewWriter(w)
+	if err := writeEntry(tw, metadataEntry, metaBytes, now); err != nil {
+		return err
+	}
+	if err := tw.WriteHeader(&tar.Header{Name: diskEntry, Mode: 0644, Size: fi.Size(), ModTime: now}); err != nil {
+		return err
+	}
+	h := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(tw, h), utils.NewContextReader(ctx, f)); err != nil {
+		return errors.Wrapf(err, "failed to export %s", img.Fullname())
+	}
+	if err := writeEntry(tw, digestEntry, []byte(hex.EncodeToString(h.Sum(nil))+"\n"), now); err != nil {
+		return err
+	}
+	return tw.Close()
+}
+
+// Import reads an archive written by Export, checks the disk against its
+// digest and prepares the image with mgr. The archive's image name is kept.
+func Import(ctx context.Context, mgr vmimage.Manager, r io.Reader) (*types.Image, error) {
+	tmpDir, err := os.MkdirTemp("", "vmimage-import-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(tmpDir)
+	diskPath := filepath.Join(tmpDir, diskEntry)
+
+	img, err := extract(ctx, r, diskPath)
+	if err != nil {
+		return nil, err
+	}
+	rc, err := mgr.PrepareContext(ctx, diskPath, img)
+	if err != nil {
+		return nil, err
+	}
+	utils.EnsureReaderClosed(rc)
+	return img, nil
+}
+
+// extract writes the disk of the archive to diskPath and returns its
+// metadata, with the digest set to the verified one.
+func extract(ctx context.Context, r io.Reader, diskPath string) (img *types.Image, err error) {
+	var actual, expected string
+	tr := tar.NewReader(utils.NewContextReader(ctx, r))
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, errors.Wrap(err, "invalid image archive")
+		}
+		switch hdr.Name {
+		case metadataEntry:
+			img = &types.Image{}
+			if err := json.NewDecoder(tr).Decode(img); err != nil {
+				return nil, errors.Wrapf(err, "invalid %s", metadataEntry)
+			}
+		case diskEntry:
+			if actual, err = copyDisk(tr, diskPath); err != nil {
+				return nil, err
+			}
+		case digestEntry:
+			bs, err := io.ReadAll(io.LimitReader(tr, 1024))
+			if err != nil {
+				return nil, err
+			}
+			expected = strings.TrimSpace(string(bs))
+		}
+	}
+	switch {
+	case img == nil:
+		return nil, errors.Errorf("invalid image archive, %s is missing", metadataEntry)
+	case actual == "":
+		return nil, errors.Errorf("invalid image archive, %s is missing", diskEntry)
+	case expected == "":
+		return nil, errors.Errorf("invalid image archive, %s is missing", digestEntry)
+	case actual != expected:
+		return nil, types.NewError(types.ErrDigestMismatch, fmt.Errorf("disk of %s has digest %s, expected %s", img.Fullname(), actual, expected))
+	}
+	if err := img.MatchPinnedDigest(actual); err != nil {
+		return nil, err
+	}
+	img.Digest = actual
+	img.LocalPath = ""
+	return img, nil
+}
+
+func copyDisk(r io.Reader, fname string) (string, error) {
+	f, err := os.OpenFile(fname, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(f, h), r); err != nil {
+		return "", errors.Wrap(err, "failed to extract disk")
+	}
+	return hex.EncodeToString(h.Sum(nil)), f.Close()
+}
+
+func writeEntry(tw *tar.Writer, name string, content []byte, modTime time.Time) error {
+	if err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(content)), ModTime: modTime}); err != nil {
+		return err
+	}
+	_, err := tw.Write(content)
+	return err
+}
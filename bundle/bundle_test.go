@@ -0,0 +1,80 @@
+package bundle
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/yuyang0/vmimage/mocks"
+	"github.com/yuyang0/vmimage/types"
+)
+
+const diskSHA256 = "b94d27b9934d3e08a52e52d7da7dabfac484efe37a5380ee9088f7ace2efcde9" // sha256 of "hello world"
+
+func exportTestImage(t *testing.T) *bytes.Buffer {
+	fname := filepath.Join(t.TempDir(), "vm.img")
+	assert.Nil(t, os.WriteFile(fname, []byte("hello world"), 0600))
+	img := &types.Image{Username: "user1", Name: "ubuntu", Tag: "22.04", OS: types.OSInfo{Type: "linux", Arch: "amd64"}, LocalPath: fname}
+	buf := &bytes.Buffer{}
+	assert.Nil(t, Export(context.Background(), img, buf))
+	return buf
+}
+
+func TestExportImport(t *testing.T) {
+	buf := exportTestImage(t)
+	mgr := &mocks.Manager{}
+	var prepared string
+	mgr.On("PrepareContext", mock.Anything, mock.Anything, mock.Anything).Return(
+		func(_ context.Context, fname string, _ *types.Image) io.ReadCloser {
+			bs, _ := os.ReadFile(fname)
+			prepared = string(bs)
+			return io.NopCloser(strings.NewReader(""))
+		}, nil)
+
+	img, err := Import(context.Background(), mgr, buf)
+	assert.Nil(t, err)
+	assert.Equal(t, "hello world", prepared)
+	assert.Equal(t, "user1/ubuntu:22.04", img.Fullname())
+	assert.Equal(t, "amd64", img.OS.Arch)
+	assert.Equal(t, diskSHA256, img.Digest)
+	assert.Empty(t, img.LocalPath)
+}
+
+func TestImportCorrupted(t *testing.T) {
+	// rewrite the archive with a different disk but the original digest
+	tr := tar.NewReader(exportTestImage(t))
+	corrupted := &bytes.Buffer{}
+	tw := tar.NewWriter(corrupted)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		assert.Nil(t, err)
+		content, _ := io.ReadAll(tr)
+		if hdr.Name == diskEntry {
+			content = []byte("hello wOrld")
+		}
+		assert.Nil(t, tw.WriteHeader(hdr))
+		_, _ = tw.Write(content)
+	}
+	assert.Nil(t, tw.Close())
+
+	_, err := Import(context.Background(), &mocks.Manager{}, corrupted)
+	assert.ErrorIs(t, err, types.ErrDigestMismatch)
+
+	_, err = Import(context.Background(), &mocks.Manager{}, strings.NewReader("not a tar"))
+	assert.Error(t, err)
+}
+
+func TestExportWithoutLocalFile(t *testing.T) {
+	err := Export(context.Background(), &types.Image{Name: "ubuntu", Tag: "latest"}, io.Discard)
+	assert.ErrorContains(t, err, "has no local file")
+}
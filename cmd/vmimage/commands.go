@@ -0,0 +1,379 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/docker/docker/pkg/jsonmessage"
+	"github.com/docker/go-units"
+	"github.com/moby/term"
+	"github.com/yuyang0/vmimage/lease"
+	"github.com/yuyang0/vmimage/server"
+	"github.com/yuyang0/vmimage/types"
+)
+
+func runPrepare(ctx context.Context, c *cli, args []string) error {
+	fs := c.newFlagSet("prepare")
+	arch := fs.String("arch", "", "architecture of the image's OS")
+	distrib := fs.String("distrib", "", "distribution of the image's OS")
+	version := fs.String("version", "", "version of the image's OS")
+	args, err := parseArgs(fs, args, 2)
+	if err != nil {
+		return err
+	}
+	img, err := types.NewImage(args[1])
+	if err != nil {
+		return err
+	}
+	img.OS.Distrib, img.OS.Version, img.OS.Arch = *distrib, *version, *arch
+	rc, err := c.mgr.PrepareContext(ctx, args[0], img)
+	if err != nil {
+		return err
+	}
+	if err := c.showProgress(rc); err != nil {
+		return err
+	}
+	return c.printImage(img)
+}
+
+func runPush(ctx context.Context, c *cli, args []string) error {
+	fs := c.newFlagSet("push")
+	force := fs.Bool("force", false, "overwrite the image in the hub")
+	args, err := parseArgs(fs, args, 1)
+	if err != nil {
+		return err
+	}
+	img, err := types.NewImage(args[0])
+	if err != nil {
+		return err
+	}
+	rc, err := c.mgr.Push(ctx, img, *force)
+	if err != nil {
+		return err
+	}
+	return c.showProgress(rc)
+}
+
+func runPull(ctx context.Context, c *cli, args []string) error {
+	fs := c.newFlagSet("pull")
+	policy := fs.String("policy", types.PullPolicyAlways, "pull policy: Always, IfNotPresent or Never")
+	platform := fs.String("platform", "", "platform of the variant to pull, the host's by default")
+	args, err := parseArgs(fs, args, 1)
+	if err != nil {
+		return err
+	}
+	pullPolicy, err := parsePolicy(*policy)
+	if err != nil {
+		return err
+	}
+	img, err := types.NewImage(args[0])
+	if err != nil {
+		return err
+	}
+	img.Platform = *platform
+	rc, err := c.mgr.Pull(ctx, img, pullPolicy)
+	if err != nil {
+		return err
+	}
+	if err := c.showProgress(rc); err != nil {
+		return err
+	}
+	return c.printImage(img)
+}
+
+func runLoad(ctx context.Context, c *cli, args []string) error {
+	args, err := parseArgs(c.newFlagSet("load"), args, 1)
+	if err != nil {
+		return err
+	}
+	img, err := c.mgr.LoadImage(ctx, args[0])
+	if err != nil {
+		return err
+	}
+	return c.printImage(img)
+}
+
+func runList(ctx context.Context, c *cli, args []string) error {
+	fs := c.newFlagSet("ls")
+	user := fs.String("user", "", "only list the images of this user")
+	if _, err := parseArgs(fs, args, 0); err != nil {
+		return err
+	}
+	images, err := c.mgr.ListLocalImages(ctx, *user)
+	if err != nil {
+		return err
+	}
+	if c.json {
+		return c.printJSON(images)
+	}
+	return c.printImages(images)
+}
+
+func runRemove(ctx context.Context, c *cli, args []string) error {
+	fs := c.newFlagSet("rm")
+	force := fs.Bool("force", false, "remove leased images, the leases are kept")
+	args, err := parseArgs(fs, args, -1)
+	if err != nil {
+		return err
+	}
+	remove := c.mgr.RemoveLocal
+	// without leases there is nothing to force
+	if *force && c.leases != nil {
+		remove = c.leases.ForceRemoveLocal
+	}
+	var errs []error
+	for _, name := range args {
+		img, err := types.NewImage(name)
+		if err == nil {
+			err = remove(ctx, img)
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", name, err))
+			continue
+		}
+		fmt.Fprintln(c.out, img.Fullname())
+	}
+	return errors.Join(errs...)
+}
+
+// runPrune removes the files of the images which are gone, except the files
+// of the leases.
+func runPrune(ctx context.Context, c *cli, args []string) error {
+	if _, err := parseArgs(c.newFlagSet("prune"), args, 0); err != nil {
+		return err
+	}
+	return c.prune(ctx)
+}
+
+// runLease manages the leases of the lease file of the config or, with the
+// remote type, of the server.
+func runLease(ctx context.Context, c *cli, args []string) error {
+	args, err := parseArgs(c.newFlagSet("lease"), args, -1)
+	if err != nil {
+		return err
+	}
+	if c.leases == nil {
+		return errors.New("leases are not enabled, lease_file isn't set")
+	}
+	switch {
+	case (args[0] == "acquire" || args[0] == "release") && len(args) == 3:
+		img, err := types.NewImage(args[2])
+		if err != nil {
+			return err
+		}
+		if args[0] == "acquire" {
+			return c.leases.AcquireLease(ctx, img, args[1])
+		}
+		return c.leases.ReleaseLease(ctx, img, args[1])
+	case args[0] == "ls" && len(args) <= 2:
+		var img *types.Image
+		if len(args) == 2 {
+			if img, err = types.NewImage(args[1]); err != nil {
+				return err
+			}
+		}
+		leases, err := c.leases.Leases(ctx, img)
+		if err != nil {
+			return err
+		}
+		if c.json {
+			if leases == nil {
+				leases = []lease.Lease{}
+			}
+			return c.printJSON(leases)
+		}
+		w := tabwriter.NewWriter(c.out, 0, 0, 3, ' ', 0)
+		fmt.Fprintln(w, "IMAGE\tOWNER\tCREATED")
+		for _, l := range leases {
+			fmt.Fprintf(w, "%s\t%s\t%s\n", l.Image, l.Owner, l.Created.Format(time.RFC3339))
+		}
+		return w.Flush()
+	default:
+		fmt.Fprintf(c.errOut, "Usage: vmimage %s\n", commands["lease"].usage)
+		return errors.New("lease: invalid arguments")
+	}
+}
+
+// runInspect shows a local image, unlike load it never talks to the hub.
+func runInspect(ctx context.Context, c *cli, args []string) error {
+	args, err := parseArgs(c.newFlagSet("inspect"), args, 1)
+	if err != nil {
+		return err
+	}
+	target, err := types.NewImage(args[0])
+	if err != nil {
+		return err
+	}
+	images, err := c.mgr.ListLocalImages(ctx, target.Username)
+	if err != nil {
+		return err
+	}
+	for _, img := range images {
+		if img.Fullname() == target.Fullname() {
+			return c.printJSON(img)
+		}
+	}
+	return types.NewError(types.ErrImageNotFound, fmt.Errorf("no local image %s", target.Fullname()))
+}
+
+func runHealth(ctx context.Context, c *cli, args []string) error {
+	if _, err := parseArgs(c.newFlagSet("health"), args, 0); err != nil {
+		return err
+	}
+	report, err := c.mgr.CheckHealth(ctx)
+	if report == nil {
+		return err
+	}
+	if c.json {
+		if jsonErr := c.printJSON(report); jsonErr != nil {
+			return jsonErr
+		}
+		return err
+	}
+	w := tabwriter.NewWriter(c.out, 0, 0, 3, ' ', 0)
+	fmt.Fprintln(w, "CHECK\tSTATUS\tLATENCY\tERROR")
+	for _, check := range report.Checks {
+		status := "ok"
+		if !check.OK {
+			status = "failed"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", check.Name, status, check.Latency.Round(time.Millisecond), check.Error)
+	}
+	if report.StorageFree > 0 {
+		fmt.Fprintf(w, "\nstorage free: %s\n", units.BytesSize(float64(report.StorageFree)))
+	}
+	if flushErr := w.Flush(); flushErr != nil {
+		return flushErr
+	}
+	return err
+}
+
+// runServe serves the manager over HTTP until interrupted.
+func runServe(ctx context.Context, c *cli, args []string) error {
+	fs := c.newFlagSet("serve")
+	addr := fs.String("addr", "127.0.0.1:8080", "address to listen on")
+	certFile := fs.String("cert", "", "TLS certificate, the server uses plain HTTP without it")
+	keyFile := fs.String("key", "", "TLS key")
+	tokenFile := fs.String("token-file", "", "file holding the bearer token of the clients")
+	clientCA := fs.String("client-ca", "", "CA bundle verifying client certificates, requires -cert")
+	fileDirs := fs.String("file-dirs", "", "comma separated directories prepare may read local files from")
+	if _, err := parseArgs(fs, args, 0); err != nil {
+		return err
+	}
+	opts := server.Options{}
+	if *tokenFile != "" {
+		bs, err := os.ReadFile(*tokenFile)
+		if err != nil {
+			return err
+		}
+		if opts.Token = strings.TrimSpace(string(bs)); opts.Token == "" {
+			return fmt.Errorf("empty token in %s", *tokenFile)
+		}
+	}
+	if *fileDirs != "" {
+		opts.FileDirs = strings.Split(*fileDirs, ",")
+	}
+	srv := &http.Server{
+		Addr:              *addr,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	if *clientCA != "" {
+		if *certFile == "" {
+			return errors.New("-client-ca requires -cert and -key")
+		}
+		pem, err := os.ReadFile(*clientCA)
+		if err != nil {
+			return err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("no certificate found in %s", *clientCA)
+		}
+		srv.TLSConfig = &tls.Config{
+			MinVersion: tls.VersionTLS12,
+			ClientCAs:  pool,
+			ClientAuth: tls.RequireAndVerifyClientCert,
+		}
+		opts.ClientCert = true
+	}
+	handler, err := server.New(c.mgr, opts)
+	if err != nil {
+		return err
+	}
+	srv.Handler = handler
+	errCh := make(chan error, 1)
+	go func() {
+		if *certFile != "" {
+			errCh <- srv.ListenAndServeTLS(*certFile, *keyFile)
+		} else {
+			errCh <- srv.ListenAndServe()
+		}
+	}()
+	select {
+	case err := <-errCh:
+		return err
+	case <-ctx.Done():
+	}
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	return srv.Shutdown(shutdownCtx)
+}
+
+// showProgress renders the stream returned by Prepare, Pull and Push. Docker
+// streams are JSON messages drawn as progress bars, other backends return
+// empty streams.
+func (c *cli) showProgress(rc io.ReadCloser) error {
+	defer rc.Close()
+	fd, isTerminal := term.GetFdInfo(c.errOut)
+	if c.json {
+		isTerminal = false
+	}
+	err := jsonmessage.DisplayJSONMessagesStream(rc, c.errOut, fd, isTerminal, nil)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return err
+	}
+	return nil
+}
+
+func (c *cli) printImage(img *types.Image) error {
+	if c.json {
+		return c.printJSON(img)
+	}
+	return c.printImages([]*types.Image{img})
+}
+
+func (c *cli) printImages(images []*types.Image) error {
+	w := tabwriter.NewWriter(c.out, 0, 0, 3, ' ', 0)
+	fmt.Fprintln(w, "NAME\tTAG\tARCH\tDIGEST\tSIZE")
+	for _, img := range images {
+		name := img.Name
+		if img.Username != "" {
+			name = img.Username + "/" + img.Name
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", name, img.Tag, img.OS.Arch, shortDigest(img.Digest), units.HumanSize(float64(img.Size)))
+	}
+	return w.Flush()
+}
+
+func (c *cli) printJSON(v any) error {
+	enc := json.NewEncoder(c.out)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
+
+func shortDigest(digest string) string {
+	if len(digest) > 12 {
+		return digest[:12]
+	}
+	return digest
+}
@@ -0,0 +1,183 @@
+// Command vmimage manages VM images with the backend configured in a
+// vmimage TOML file, see types.LoadConfig.
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"syscall"
+
+	"github.com/yuyang0/vmimage"
+	"github.com/yuyang0/vmimage/factory"
+	"github.com/yuyang0/vmimage/lease"
+	"github.com/yuyang0/vmimage/remote"
+	"github.com/yuyang0/vmimage/types"
+)
+
+type command struct {
+	usage string
+	run   func(ctx context.Context, c *cli, args []string) error
+}
+
+// commands is filled by init, the commands refer to it to print their usage.
+var commands map[string]command
+
+func init() {
+	commands = map[string]command{
+		"prepare": {"prepare [-arch arch] [-distrib name] [-version ver] FILE|URL IMAGE", runPrepare},
+		"push":    {"push [-force] IMAGE", runPush},
+		"pull":    {"pull [-policy Always|IfNotPresent|Never] [-platform os/arch] IMAGE", runPull},
+		"load":    {"load IMAGE", runLoad},
+		"ls":      {"ls [-user USER]", runList},
+		"rm":      {"rm [-force] IMAGE...", runRemove},
+		"prune":   {"prune", runPrune},
+		"lease":   {"lease acquire|release OWNER IMAGE | lease ls [IMAGE]", runLease},
+		"inspect": {"inspect IMAGE", runInspect},
+		"health":  {"health", runHealth},
+		"serve":   {"serve [-addr host:port] [-cert FILE -key FILE] [-token-file FILE] [-client-ca FILE] [-file-dirs DIR,...]", runServe},
+	}
+}
+
+// cli holds what the commands share, it is built once by main.
+type cli struct {
+	mgr vmimage.Manager
+	// leases is nil when neither the config nor the server enable leases
+	leases lease.Leaser
+	prune  func(ctx context.Context) error
+	// out receives the results, progress goes to errOut so that out stays parseable
+	out    io.Writer
+	errOut io.Writer
+	json   bool
+}
+
+func main() {
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	err := run(ctx, os.Args[1:], os.Stdout, os.Stderr)
+	cancel()
+	if errors.Is(err, flag.ErrHelp) {
+		os.Exit(2)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "vmimage:", err)
+		os.Exit(1)
+	}
+}
+
+func run(ctx context.Context, args []string, stdout, stderr io.Writer) error {
+	fs := flag.NewFlagSet("vmimage", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	configFile := fs.String("config", os.Getenv("VMIMAGE_CONFIG"), "config file, $VMIMAGE_CONFIG by default")
+	ty := fs.String("type", "", "manager type, overrides the config")
+	jsonOutput := fs.Bool("json", false, "print results as JSON")
+	fs.Usage = func() { usage(fs) }
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return flag.ErrHelp
+	}
+	cmd, ok := commands[fs.Arg(0)]
+	if !ok {
+		fs.Usage()
+		return fmt.Errorf("unknown command %s", fs.Arg(0))
+	}
+
+	cfg, err := loadConfig(*configFile, *ty)
+	if err != nil {
+		return err
+	}
+	if err := factory.Setup(cfg); err != nil {
+		return err
+	}
+	mgr, err := factory.GetManager()
+	if err != nil {
+		return err
+	}
+	c := &cli{
+		mgr:    mgr,
+		prune:  factory.Prune,
+		out:    stdout,
+		errOut: stderr,
+		json:   *jsonOutput,
+	}
+	if leaser, ok := mgr.(lease.Leaser); ok {
+		c.leases = leaser
+	} else if cfg.Type == "remote" {
+		// the leases are held by the server, the manager of the factory is
+		// wrapped so the remote manager is built again to reach them
+		if c.leases, err = remote.NewManager(cfg); err != nil {
+			return err
+		}
+	}
+	return cmd.run(ctx, c, fs.Args()[1:])
+}
+
+// loadConfig loads the config file, ty overrides its type when not empty
+// and the config is checked for that type.
+func loadConfig(fname, ty string) (*types.Config, error) {
+	cfg, err := types.ReadConfig(fname)
+	if err != nil {
+		return nil, err
+	}
+	if ty != "" {
+		cfg.Type = ty
+	}
+	if err := cfg.CheckAndRefine(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+func usage(fs *flag.FlagSet) {
+	out := fs.Output()
+	fmt.Fprintf(out, "Usage: vmimage [flags] COMMAND [ARGS]\n\nCommands:\n")
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(out, "  %s\n", commands[name].usage)
+	}
+	fmt.Fprintf(out, "\nFlags:\n")
+	fs.PrintDefaults()
+}
+
+// newFlagSet returns the flag set of a subcommand, errors are reported by run.
+func (c *cli) newFlagSet(name string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.SetOutput(c.errOut)
+	fs.Usage = func() {
+		fmt.Fprintf(c.errOut, "Usage: vmimage %s\n", commands[name].usage)
+		fs.PrintDefaults()
+	}
+	return fs
+}
+
+func parseArgs(fs *flag.FlagSet, args []string, n int) ([]string, error) {
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+	if (n >= 0 && fs.NArg() != n) || (n < 0 && fs.NArg() == 0) {
+		fs.Usage()
+		return nil, fmt.Errorf("%s: wrong number of arguments", fs.Name())
+	}
+	return fs.Args(), nil
+}
+
+func parsePolicy(policy string) (types.PullPolicy, error) {
+	for _, p := range []types.PullPolicy{types.PullPolicyAlways, types.PullPolicyIfNotPresent, types.PullPolicyNever} {
+		if strings.EqualFold(policy, string(p)) {
+			return p, nil
+		}
+	}
+	return "", fmt.Errorf("invalid pull policy %s", policy)
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/yuyang0/vmimage"
+	"github.com/yuyang0/vmimage/lease"
+	"github.com/yuyang0/vmimage/mocks"
+	"github.com/yuyang0/vmimage/types"
+)
+
+func newTestCLI(jsonOutput bool) (*cli, *mocks.Manager, *bytes.Buffer) {
+	mgr := &mocks.Manager{}
+	out := &bytes.Buffer{}
+	return &cli{mgr: mgr, out: out, errOut: io.Discard, json: jsonOutput}, mgr, out
+}
+
+func TestList(t *testing.T) {
+	c, mgr, out := newTestCLI(false)
+	mgr.On("ListLocalImages", mock.Anything, "").Return([]*types.Image{
+		{Username: "user1", Name: "ubuntu", Tag: "22.04", Digest: "0123456789abcdef", Size: 2048, OS: types.OSInfo{Arch: "amd64"}},
+	}, nil)
+
+	assert.Nil(t, runList(context.Background(), c, nil))
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	assert.Len(t, lines, 2)
+	assert.Equal(t, []string{"NAME", "TAG", "ARCH", "DIGEST", "SIZE"}, strings.Fields(lines[0]))
+	assert.Equal(t, []string{"user1/ubuntu", "22.04", "amd64", "0123456789ab", "2.048kB"}, strings.Fields(lines[1]))
+}
+
+func TestPullJSON(t *testing.T) {
+	c, mgr, out := newTestCLI(true)
+	mgr.On("Pull", mock.Anything, mock.Anything, types.PullPolicy(types.PullPolicyNever)).Return(io.NopCloser(strings.NewReader("")), nil)
+
+	assert.Nil(t, runPull(context.Background(), c, []string{"-policy", "never", "user1/ubuntu:22.04"}))
+	img := &types.Image{}
+	assert.Nil(t, json.Unmarshal(out.Bytes(), img))
+	assert.Equal(t, "user1/ubuntu:22.04", img.Fullname())
+
+	assert.ErrorContains(t, runPull(context.Background(), c, []string{"-policy", "sometimes", "ubuntu"}), "invalid pull policy")
+	assert.ErrorContains(t, runPull(context.Background(), c, nil), "wrong number of arguments")
+}
+
+func TestInspect(t *testing.T) {
+	c, mgr, out := newTestCLI(false)
+	mgr.On("ListLocalImages", mock.Anything, "user1").Return([]*types.Image{
+		{Username: "user1", Name: "ubuntu", Tag: "latest", Digest: "abc"},
+	}, nil)
+
+	assert.Nil(t, runInspect(context.Background(), c, []string{"user1/ubuntu"}))
+	assert.Contains(t, out.String(), `"digest": "abc"`)
+	assert.ErrorIs(t, runInspect(context.Background(), c, []string{"user1/centos"}), types.ErrImageNotFound)
+}
+
+func TestRemove(t *testing.T) {
+	c, mgr, out := newTestCLI(false)
+	mgr.On("RemoveLocal", mock.Anything, mock.MatchedBy(func(img *types.Image) bool { return img.Name == "ubuntu" })).Return(nil)
+	mgr.On("RemoveLocal", mock.Anything, mock.Anything).Return(types.ErrImageNotFound)
+
+	err := runRemove(context.Background(), c, []string{"ubuntu", "centos"})
+	assert.ErrorIs(t, err, types.ErrImageNotFound)
+	assert.ErrorContains(t, err, "centos:")
+	assert.Equal(t, "ubuntu:latest\n", out.String())
+}
+
+func TestLease(t *testing.T) {
+	c, mgr, out := newTestCLI(false)
+	assert.ErrorContains(t, runLease(context.Background(), c, []string{"ls"}), "leases are not enabled")
+	c.leases = lease.NewManager(mgr, lease.NewStore(filepath.Join(t.TempDir(), "leases.json")))
+	c.mgr = c.leases.(vmimage.Manager)
+	mgr.On("RemoveLocal", mock.Anything, mock.Anything).Return(nil)
+
+	assert.Nil(t, runLease(context.Background(), c, []string{"acquire", "vm1", "user1/ubuntu"}))
+	assert.Nil(t, runLease(context.Background(), c, []string{"ls", "user1/ubuntu"}))
+	assert.Equal(t, []string{"user1/ubuntu:latest", "vm1"}, strings.Fields(strings.Split(out.String(), "\n")[1])[:2])
+	assert.ErrorContains(t, runLease(context.Background(), c, []string{"acquire", "vm1"}), "invalid arguments")
+
+	assert.ErrorIs(t, runRemove(context.Background(), c, []string{"user1/ubuntu"}), types.ErrConflict)
+	assert.Nil(t, runRemove(context.Background(), c, []string{"-force", "user1/ubuntu"}))
+
+	assert.Nil(t, runLease(context.Background(), c, []string{"release", "vm1", "user1/ubuntu"}))
+	out.Reset()
+	c.json = true
+	assert.Nil(t, runLease(context.Background(), c, []string{"ls"}))
+	assert.Equal(t, "[]\n", out.String())
+}
+
+func TestHealth(t *testing.T) {
+	c, mgr, out := newTestCLI(false)
+	report := &types.HealthReport{Backend: "docker", Checks: []types.HealthCheck{
+		{Name: types.HealthCheckDaemon, OK: true},
+		{Name: types.HealthCheckRegistry, Error: "connection refused"},
+	}}
+	mgr.On("CheckHealth", mock.Anything).Return(report, report.Err())
+
+	err := runHealth(context.Background(), c, nil)
+	assert.True(t, errors.Is(err, types.ErrUnavailable))
+	assert.Contains(t, out.String(), "daemon")
+	assert.Contains(t, out.String(), "connection refused")
+}
+
+func TestLoadConfigType(t *testing.T) {
+	// no docker credential anywhere
+	t.Setenv("DOCKER_CONFIG", t.TempDir())
+	fname := filepath.Join(t.TempDir(), "vmimage.toml")
+	assert.Nil(t, os.WriteFile(fname, []byte("type = \"docker\"\n"), 0600))
+
+	_, err := loadConfig(fname, "")
+	assert.NotNil(t, err)
+	// the config is checked for the type given on the command line
+	cfg, err := loadConfig(fname, "fake")
+	assert.Nil(t, err)
+	assert.Equal(t, "fake", cfg.Type)
+	assert.Empty(t, os.Getenv(types.EnvPrefix+"_TYPE"))
+	_, err = loadConfig(fname, "ftp")
+	assert.ErrorContains(t, err, "unknown image hub type")
+}
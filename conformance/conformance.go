@@ -0,0 +1,285 @@
+// Package conformance is a test suite pinning down the behavior shared by
+// every vmimage.Manager implementation. Backends run it from their tests:
+//
+//	func TestConformance(t *testing.T) {
+//		conformance.Run(t, conformance.Config{
+//			NewManager: func(t *testing.T) vmimage.Manager { ... },
+//		})
+//	}
+//
+// The backends talking to real services run it only when asked to, see
+// LoadConfig.
+package conformance
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/pkg/jsonmessage"
+	"github.com/yuyang0/vmimage"
+	"github.com/yuyang0/vmimage/types"
+)
+
+type Config struct {
+	// NewManager returns the manager under test, it is called once per test
+	NewManager func(t *testing.T) vmimage.Manager
+	// User owns the images created by the suite, "conformance" by default
+	User string
+	// Concurrency is the number of images prepared in parallel, 4 by default
+	Concurrency int
+}
+
+// Run runs the suite as subtests of t. Image tags are unique to the run so
+// that the suite can share a real hub with other runs.
+func Run(t *testing.T, cfg Config) {
+	if cfg.User == "" {
+		cfg.User = "conformance"
+	}
+	if cfg.Concurrency == 0 {
+		cfg.Concurrency = 4
+	}
+	s := &suite{cfg: cfg, run: fmt.Sprintf("t%d", time.Now().UnixNano())}
+	t.Run("PrepareListRemove", s.testPrepareListRemove)
+	t.Run("PushPullRoundTrip", s.testPushPullRoundTrip)
+	t.Run("PullPolicies", s.testPullPolicies)
+	t.Run("Errors", s.testErrors)
+	t.Run("Concurrency", s.testConcurrency)
+	t.Run("CheckHealth", s.testCheckHealth)
+}
+
+// LoadConfig returns the checked config of a run against a real backend of
+// type ty, it skips t unless VMIMAGE_CONFORMANCE_<TY> is set. Its value is
+// the config file, which may be empty, the environment overrides it like it
+// does for the vmimage command.
+func LoadConfig(t *testing.T, ty string) *types.Config {
+	env := types.EnvPrefix + "_CONFORMANCE_" + strings.ToUpper(ty)
+	fname, ok := os.LookupEnv(env)
+	if !ok {
+		t.Skipf("%s is not set", env)
+	}
+	cfg, err := types.ReadConfig(fname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.Type = ty
+	if err := cfg.CheckAndRefine(); err != nil {
+		t.Fatal(err)
+	}
+	return cfg
+}
+
+type suite struct {
+	cfg Config
+	run string
+}
+
+func (s *suite) testPrepareListRemove(t *testing.T) {
+	ctx, mgr := context.Background(), s.cfg.NewManager(t)
+	img := s.prepare(t, mgr, "prepare", "prepare-list-remove")
+
+	if local := findLocal(t, mgr, s.cfg.User, img); local == nil {
+		t.Fatalf("prepared image %s is not listed", img.Fullname())
+	}
+	if err := mgr.RemoveLocal(ctx, img); err != nil {
+		t.Fatalf("RemoveLocal: %v", err)
+	}
+	if local := findLocal(t, mgr, s.cfg.User, img); local != nil {
+		t.Fatalf("removed image %s is still listed", img.Fullname())
+	}
+}
+
+func (s *suite) testPushPullRoundTrip(t *testing.T) {
+	ctx, mgr := context.Background(), s.cfg.NewManager(t)
+	content := "round-trip-" + s.run
+	img := s.prepare(t, mgr, "roundtrip", content)
+	if err := drain(mgr.Push(ctx, img, false)); err != nil {
+		t.Fatalf("Push: %v", err)
+	}
+	if err := mgr.RemoveLocal(ctx, img); err != nil {
+		t.Fatalf("RemoveLocal: %v", err)
+	}
+
+	pulled := s.newImage(t, "roundtrip")
+	if err := drain(mgr.Pull(ctx, pulled, types.PullPolicyAlways)); err != nil {
+		t.Fatalf("Pull: %v", err)
+	}
+	checkContent(t, pulled, content)
+
+	loaded, err := mgr.LoadImage(ctx, pulled.Fullname())
+	if err != nil {
+		t.Fatalf("LoadImage: %v", err)
+	}
+	if loaded.Fullname() != pulled.Fullname() || loaded.Digest != pulled.Digest {
+		t.Fatalf("LoadImage returned %s with digest %s, want %s with digest %s",
+			loaded.Fullname(), loaded.Digest, pulled.Fullname(), pulled.Digest)
+	}
+}
+
+func (s *suite) testPullPolicies(t *testing.T) {
+	ctx, mgr := context.Background(), s.cfg.NewManager(t)
+	missing := s.newImage(t, "never-pushed")
+	if err := drain(mgr.Pull(ctx, missing, types.PullPolicyNever)); !errors.Is(err, types.ErrImageNotFound) {
+		t.Fatalf("Pull(Never) of a missing image: got %v, want ErrImageNotFound", err)
+	}
+
+	// only in the local store
+	content := "policies-" + s.run
+	s.prepare(t, mgr, "policies", content)
+	for _, policy := range []types.PullPolicy{types.PullPolicyNever, types.PullPolicyIfNotPresent} {
+		img := s.newImage(t, "policies")
+		if err := drain(mgr.Pull(ctx, img, policy)); err != nil {
+			t.Fatalf("Pull(%s) of a local image: %v", policy, err)
+		}
+		checkContent(t, img, content)
+	}
+	img := s.newImage(t, "policies")
+	if err := drain(mgr.Pull(ctx, img, types.PullPolicyAlways)); !errors.Is(err, types.ErrImageNotFound) {
+		t.Fatalf("Pull(Always) of an image which was never pushed: got %v, want ErrImageNotFound", err)
+	}
+}
+
+func (s *suite) testErrors(t *testing.T) {
+	ctx, mgr := context.Background(), s.cfg.NewManager(t)
+	if _, err := mgr.LoadImage(ctx, "invalid//name"); !errors.Is(err, types.ErrInvalidImageName) {
+		t.Errorf("LoadImage of an invalid name: got %v, want ErrInvalidImageName", err)
+	}
+	missing := s.newImage(t, "missing")
+	if _, err := mgr.LoadImage(ctx, missing.Fullname()); !errors.Is(err, types.ErrImageNotFound) {
+		t.Errorf("LoadImage of a missing image: got %v, want ErrImageNotFound", err)
+	}
+	if err := mgr.RemoveLocal(ctx, missing); !errors.Is(err, types.ErrImageNotFound) {
+		t.Errorf("RemoveLocal of a missing image: got %v, want ErrImageNotFound", err)
+	}
+
+	img := s.prepare(t, mgr, "pinned", "pinned-"+s.run)
+	if err := drain(mgr.Push(ctx, img, false)); err != nil {
+		t.Fatalf("Push: %v", err)
+	}
+	wrong := sha256.Sum256([]byte("something else"))
+	pinned, err := types.NewImage(fmt.Sprintf("%s@sha256:%s", img.Fullname(), hex.EncodeToString(wrong[:])))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := drain(mgr.Pull(ctx, pinned, types.PullPolicyAlways)); !errors.Is(err, types.ErrDigestMismatch) {
+		t.Errorf("Pull pinned to another digest: got %v, want ErrDigestMismatch", err)
+	}
+}
+
+func (s *suite) testConcurrency(t *testing.T) {
+	ctx, mgr := context.Background(), s.cfg.NewManager(t)
+	dir := t.TempDir()
+	images := make([]*types.Image, s.cfg.Concurrency)
+	errs := make([]error, s.cfg.Concurrency)
+	var wg sync.WaitGroup
+	for idx := range images {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			name := fmt.Sprintf("concurrent%d", idx)
+			fname := filepath.Join(dir, name+".img")
+			if errs[idx] = os.WriteFile(fname, []byte(name+s.run), 0600); errs[idx] != nil {
+				return
+			}
+			images[idx], errs[idx] = types.NewImage(fmt.Sprintf("%s/%s:%s", s.cfg.User, name, s.run))
+			if errs[idx] == nil {
+				errs[idx] = drain(mgr.PrepareContext(ctx, fname, images[idx]))
+			}
+		}()
+	}
+	wg.Wait()
+	if err := errors.Join(errs...); err != nil {
+		t.Fatalf("concurrent Prepare: %v", err)
+	}
+	for _, img := range images {
+		if findLocal(t, mgr, s.cfg.User, img) == nil {
+			t.Errorf("concurrently prepared image %s is not listed", img.Fullname())
+		}
+	}
+}
+
+func (s *suite) testCheckHealth(t *testing.T) {
+	report, err := s.cfg.NewManager(t).CheckHealth(context.Background())
+	if report == nil {
+		t.Fatalf("CheckHealth returned no report, error: %v", err)
+	}
+	if (err == nil) != report.Healthy() {
+		t.Fatalf("CheckHealth returned error %v for a report with healthy=%v", err, report.Healthy())
+	}
+}
+
+func (s *suite) newImage(t *testing.T, name string) *types.Image {
+	img, err := types.NewImage(fmt.Sprintf("%s/%s:%s", s.cfg.User, name, s.run))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return img
+}
+
+// prepare prepares an image holding content from a local file.
+func (s *suite) prepare(t *testing.T, mgr vmimage.Manager, name, content string) *types.Image {
+	fname := filepath.Join(t.TempDir(), name+".img")
+	if err := os.WriteFile(fname, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	img := s.newImage(t, name)
+	if err := drain(mgr.PrepareContext(context.Background(), fname, img)); err != nil {
+		t.Fatalf("Prepare: %v", err)
+	}
+	return img
+}
+
+// checkContent checks the fields a pull must fill.
+func checkContent(t *testing.T, img *types.Image, content string) {
+	t.Helper()
+	sum := sha256.Sum256([]byte(content))
+	if digest := strings.TrimPrefix(img.Digest, "sha256:"); digest != hex.EncodeToString(sum[:]) {
+		t.Errorf("pulled image %s has digest %q, want the sha256 of its content", img.Fullname(), img.Digest)
+	}
+	if img.Size != int64(len(content)) {
+		t.Errorf("pulled image %s has size %d, want %d", img.Fullname(), img.Size, len(content))
+	}
+	if img.LocalPath == "" {
+		return
+	}
+	bs, err := os.ReadFile(img.LocalPath)
+	if err != nil || string(bs) != content {
+		t.Errorf("local file %s of %s doesn't hold the image: %v", img.LocalPath, img.Fullname(), err)
+	}
+}
+
+func findLocal(t *testing.T, mgr vmimage.Manager, user string, img *types.Image) *types.Image {
+	t.Helper()
+	images, err := mgr.ListLocalImages(context.Background(), user)
+	if err != nil {
+		t.Fatalf("ListLocalImages: %v", err)
+	}
+	for _, local := range images {
+		if local.Fullname() == img.Fullname() {
+			return local
+		}
+	}
+	return nil
+}
+
+// drain reads the stream of Prepare, Pull or Push, which must be made of
+// docker JSON messages, and returns the first error reported.
+func drain(rc io.ReadCloser, err error) error {
+	if err != nil {
+		return err
+	}
+	if rc == nil {
+		return errors.New("nil stream returned without error")
+	}
+	defer rc.Close()
+	return jsonmessage.DisplayJSONMessagesStream(rc, io.Discard, 0, false, nil)
+}
@@ -0,0 +1,56 @@
+package docker
+
+import (
+	"archive/tar"
+	"io"
+	"os"
+	"time"
+)
+
+// newBuildContext returns a tar stream holding the Dockerfile and, unless
+// fname is empty, the file fname as destImgName. The tar is written by a
+// goroutine as it is read, closing the stream stops it.
+func newBuildContext(dockerfile, fname string) (io.ReadCloser, error) {
+	var (
+		f  *os.File
+		fi os.FileInfo
+	)
+	if fname != "" {
+		var err error
+		if f, err = os.Open(fname); err != nil {
+			return nil, err
+		}
+		if fi, err = f.Stat(); err != nil {
+			f.Close()
+			return nil, err
+		}
+	}
+	pr, pw := io.Pipe()
+	go func() {
+		if f != nil {
+			defer f.Close()
+		}
+		pw.CloseWithError(writeBuildContext(pw, dockerfile, f, fi))
+	}()
+	return pr, nil
+}
+
+func writeBuildContext(w io.Writer, dockerfile string, f *os.File, fi os.FileInfo) error {
+	now := time.Now()
+	tw := tar.NewWriter(w)
+	if err := tw.WriteHeader(&tar.Header{Name: dockerfileName, Mode: 0644, Size: int64(len(dockerfile)), ModTime: now}); err != nil {
+		return err
+	}
+	if _, err := io.WriteString(tw, dockerfile); err != nil {
+		return err
+	}
+	if f != nil {
+		if err := tw.WriteHeader(&tar.Header{Name: destImgName, Mode: 0644, Size: fi.Size(), ModTime: fi.ModTime()}); err != nil {
+			return err
+		}
+		if _, err := io.Copy(tw, f); err != nil {
+			return err
+		}
+	}
+	return tw.Close()
+}
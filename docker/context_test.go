@@ -0,0 +1,73 @@
+package docker
+
+import (
+	"archive/tar"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func readTar(t *testing.T, r io.Reader) map[string]string {
+	entries := map[string]string{}
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return entries
+		}
+		assert.Nil(t, err)
+		bs, err := io.ReadAll(tr)
+		assert.Nil(t, err)
+		entries[hdr.Name] = string(bs)
+	}
+}
+
+func TestNewBuildContext(t *testing.T) {
+	dir := t.TempDir()
+	fname := filepath.Join(dir, "my disk.qcow2")
+	assert.Nil(t, os.WriteFile(fname, []byte("disk"), 0400))
+	// a read-only dir doesn't stop root, the listing below still catches a write
+	if os.Geteuid() != 0 {
+		assert.Nil(t, os.Chmod(dir, 0500))
+		defer os.Chmod(dir, 0700) //nolint:errcheck
+	}
+
+	rc, err := newBuildContext("FROM scratch", fname)
+	assert.Nil(t, err)
+	entries := readTar(t, rc)
+	assert.Nil(t, rc.Close())
+	assert.Equal(t, map[string]string{dockerfileName: "FROM scratch", destImgName: "disk"}, entries)
+	// nothing is written next to the file
+	files, _ := os.ReadDir(dir)
+	assert.Len(t, files, 1)
+
+	rc, err = newBuildContext("FROM scratch\nADD https://example.com/a.img /vm.img", "")
+	assert.Nil(t, err)
+	entries = readTar(t, rc)
+	assert.Equal(t, []string{dockerfileName}, keys(entries))
+
+	_, err = newBuildContext("FROM scratch", filepath.Join(dir, "missing"))
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestBuildContextClosedEarly(t *testing.T) {
+	fname := filepath.Join(t.TempDir(), "disk.img")
+	assert.Nil(t, os.WriteFile(fname, make([]byte, 1<<20), 0600))
+	rc, err := newBuildContext("FROM scratch", fname)
+	assert.Nil(t, err)
+	// the writer goroutine stops instead of blocking forever
+	assert.Nil(t, rc.Close())
+	_, err = rc.Read(make([]byte, 1))
+	assert.ErrorIs(t, err, io.ErrClosedPipe)
+}
+
+func keys(m map[string]string) []string {
+	ans := make([]string, 0, len(m))
+	for k := range m {
+		ans = append(ans, k)
+	}
+	return ans
+}
@@ -6,59 +6,108 @@ import (
 	"io"
 	"net/http"
 	"net/url"
-	"os"
 	"path"
-	"path/filepath"
 	"strings"
-	"time"
 
 	"github.com/docker/docker/api/types"
 	engineapi "github.com/docker/docker/client"
-	"github.com/docker/docker/pkg/archive"
+	"github.com/docker/docker/errdefs"
 	"github.com/pkg/errors"
+	"github.com/yuyang0/vmimage/tracing"
 	pkgtypes "github.com/yuyang0/vmimage/types"
 	"github.com/yuyang0/vmimage/utils"
 )
 
 const (
 	destImgName      = "vm.img"
+	dockerfileName   = "Dockerfile.yavirt"
 	dockerCliVersion = "1.35"
 )
 
 type Manager struct {
 	cfg *pkgtypes.Config
 	cli *engineapi.Client
+	// httpClient is used for requests which don't go through the daemon
+	httpClient *http.Client
+	// the transports under the tracing wrappers, which hide them from
+	// engineapi.Client.Close
+	transports []*http.Transport
 }
 
+// NewManager fails when the store dir is empty, the files would land in
+// the working directory, Config.CheckAndRefine sets its default.
 func NewManager(config *pkgtypes.Config) (m *Manager, err error) {
-	cli, err := makeDockerClient(config.Docker.Endpoint)
+	if config.Docker.StoreDir == "" {
+		return nil, errors.New("docker's store dir should not be empty")
+	}
+	cli, cliTransport, err := makeDockerClient(&config.Docker)
 	if err != nil {
 		return nil, err
 	}
+	httpClient, err := config.Docker.TLS.HTTPClient()
+	if err != nil {
+		return nil, err
+	}
+	httpTransport := httpClient.Transport.(*http.Transport)
+	httpClient.Transport = tracing.Transport(httpTransport)
 	m = &Manager{
-		cfg: config,
-		cli: cli,
+		cfg:        config,
+		cli:        cli,
+		httpClient: httpClient,
+		transports: []*http.Transport{cliTransport, httpTransport},
 	}
 	return m, nil
 }
 
+// Close releases the connections to the docker daemon and the registries.
+func (m *Manager) Close() error {
+	for _, transport := range m.transports {
+		transport.CloseIdleConnections()
+	}
+	return m.cli.Close()
+}
+
+// ListLocalImages returns the images under the configured prefix, of user
+// only when it isn't empty. LocalPath and the sizes of the file are only set
+// for images whose file is available without copying it, see LoadImage for
+// the others.
 func (m *Manager) ListLocalImages(ctx context.Context, user string) ([]*pkgtypes.Image, error) {
 	images, err := m.cli.ImageList(ctx, types.ImageListOptions{})
 	if err != nil {
-		return nil, err
+		return nil, convertError(err)
 	}
 	var ans []*pkgtypes.Image
-	prefix := path.Join(m.cfg.Docker.Prefix, user)
 	for _, dockerImg := range images {
+		var matched []*pkgtypes.Image
 		for _, repoTag := range dockerImg.RepoTags {
-			if strings.HasPrefix(repoTag, prefix) {
-				fullname := strings.TrimPrefix(repoTag, prefix)
-				fullname = strings.TrimPrefix(fullname, "/")
-				fullname = strings.TrimPrefix(fullname, "library/")
-				img, _ := pkgtypes.NewImage(fullname)
-				ans = append(ans, img)
+			fullname, ok := localName(m.cfg.Docker.Prefix, user, repoTag)
+			if !ok {
+				continue
+			}
+			img, err := pkgtypes.NewImage(fullname)
+			if err != nil {
+				continue
 			}
+			applyLabels(img, dockerImg.Labels)
+			img.Size = dockerImg.Size
+			matched = append(matched, img)
 		}
+		// the other images aren't inspected, the tags of an image share
+		// its file
+		if len(matched) == 0 {
+			continue
+		}
+		var localPath string
+		var actualSize, virtualSize int64
+		if resp, _, err := m.cli.ImageInspectWithRaw(ctx, dockerImg.ID); err == nil {
+			if localPath = m.availableFile(&resp); localPath != "" {
+				actualSize, virtualSize, _ = utils.ImageSize(ctx, localPath)
+			}
+		}
+		for _, img := range matched {
+			img.LocalPath, img.ActualSize, img.VirtualSize = localPath, actualSize, virtualSize
+		}
+		ans = append(ans, matched...)
 	}
 	return ans, nil
 }
@@ -73,145 +122,245 @@ func (m *Manager) LoadImage(ctx context.Context, imgName string) (img *pkgtypes.
 	}
 	utils.EnsureReaderClosed(rc)
 	if err := m.loadMetadata(ctx, img); err != nil {
+		return nil, convertError(err)
+	}
+	if err := img.MatchPinnedDigest(img.Digest); err != nil {
 		return nil, err
 	}
 	return img, nil
 }
 
+// Prepare is PrepareContext without cancellation.
+func (mgr *Manager) Prepare(fname string, img *pkgtypes.Image) (io.ReadCloser, error) {
+	return mgr.PrepareContext(context.Background(), fname, img)
+}
+
 // Prepare prepares the image for use by creating a Dockerfile and building a Docker image.
 //
 // Parameters:
+//   - ctx: cancelling it aborts the sha256sum download and the image build
 //   - fname: a local filename or an url
 //
 // Returns:
 //   - io.ReadCloser: a ReadCloser to read the prepared image.
 //   - error: an error if any occurred during the preparation process.
-func (mgr *Manager) Prepare(fname string, img *pkgtypes.Image) (io.ReadCloser, error) {
+func (mgr *Manager) PrepareContext(ctx context.Context, fname string, img *pkgtypes.Image) (io.ReadCloser, error) {
 	cli := mgr.cli
-	baseDir := filepath.Dir(fname)
-	baseName := filepath.Base(fname)
-	digest := ""
-	tarOpts := &archive.TarOptions{
-		IncludeFiles: []string{baseName, "Dockerfile.yavirt"},
-		Compression:  archive.Uncompressed,
-		NoLchown:     true,
+	if err := img.RejectPlatform(); err != nil {
+		return nil, err
 	}
+	var digest, src, file string
 	if u, err := url.Parse(fname); err == nil && u.Scheme != "" && u.Host != "" {
-		tmpDir, err := os.MkdirTemp(os.TempDir(), "image-prepare-")
-		if err != nil {
-			return nil, err
-		}
-		defer os.RemoveAll(tmpDir)
-		baseDir = tmpDir
-		baseName = fname
-		tarOpts.IncludeFiles = []string{"Dockerfile.yavirt"}
-		if digest, err = httpGetSHA256(fname); err != nil {
+		// the daemon downloads the file itself
+		src = fname
+		if digest, err = httpGetSHA256(ctx, mgr.httpClient, fname); err != nil {
 			return nil, err
 		}
 	} else {
+		src, file = destImgName, fname
 		if digest, err = utils.CalcDigestOfFile(fname); err != nil {
 			return nil, err
 		}
 	}
-	dockerfile := fmt.Sprintf("FROM scratch\nLABEL SHA256=%s\nADD %s /%s", digest, baseName, destImgName)
-	if err := os.WriteFile(filepath.Join(baseDir, "Dockerfile.yavirt"), []byte(dockerfile), 0600); err != nil {
-		return nil, err
-	}
-	defer os.Remove(filepath.Join(baseDir, "Dockerfile.yavirt"))
+	dockerfile := fmt.Sprintf("FROM scratch\n%s\nADD %s /%s", labelInstruction(digest, img), src, destImgName)
 
-	// Create a build context from the specified directory
-	buildContext, err := archive.TarWithOptions(baseDir, tarOpts)
+	// The build context is streamed from memory, so nothing is written next
+	// to the user's file and concurrent calls don't interfere.
+	buildContext, err := newBuildContext(dockerfile, file)
 	if err != nil {
 		return nil, err
 	}
+	defer buildContext.Close()
 
-	// Build the Docker image using the build context
 	buildOptions := types.ImageBuildOptions{
 		Context:    buildContext,
-		Dockerfile: "Dockerfile.yavirt", // Use the default Dockerfile name
-		Tags:       []string{mgr.dockerImageName(img)},
+		Dockerfile: dockerfileName,
+		Tags:       []string{mgr.dockerRepoTag(img)},
 	}
-
-	resp, err := cli.ImageBuild(context.Background(), buildContext, buildOptions)
+	resp, err := cli.ImageBuild(ctx, buildContext, buildOptions)
 	if err != nil {
-		return nil, err
+		return nil, convertError(err)
 	}
 	return resp.Body, nil
 }
 
-func (mgr *Manager) Pull(ctx context.Context, img *pkgtypes.Image, _ pkgtypes.PullPolicy) (io.ReadCloser, error) {
-	cli, cfg := mgr.cli, mgr.cfg
-	return cli.ImagePull(ctx, mgr.dockerImageName(img), types.ImagePullOptions{
-		RegistryAuth: cfg.Docker.Auth,
+// Pull pulls img, the daemon picks the variant of a manifest list matching
+// img's platform, or the host's when it is empty. With PullPolicyNever and
+// PullPolicyIfNotPresent a local image matching img's platform and pinned
+// digest is used as is. Once the stream ends img is filled from the pulled
+// image, its LocalPath only when the file is available without copying it.
+func (mgr *Manager) Pull(ctx context.Context, img *pkgtypes.Image, policy pkgtypes.PullPolicy) (io.ReadCloser, error) {
+	if policy == pkgtypes.PullPolicyNever || policy == pkgtypes.PullPolicyIfNotPresent {
+		err := mgr.applyLocal(ctx, img)
+		if err == nil {
+			return io.NopCloser(strings.NewReader("")), nil
+		}
+		if policy == pkgtypes.PullPolicyNever ||
+			!errors.Is(err, pkgtypes.ErrImageNotFound) && !errors.Is(err, pkgtypes.ErrDigestMismatch) {
+			return nil, err
+		}
+	}
+	auth, err := mgr.cfg.Docker.RegistryAuth(img.Registry)
+	if err != nil {
+		return nil, err
+	}
+	rc, err := mgr.cli.ImagePull(ctx, mgr.dockerRepoTag(img), types.ImagePullOptions{
+		RegistryAuth: auth,
+		Platform:     img.Platform,
 	})
+	if err != nil {
+		return nil, convertError(err)
+	}
+	return utils.NewCheckedReadCloser(rc, func() error {
+		return mgr.applyLocal(ctx, img)
+	}), nil
+}
+
+// applyLocal fills img from the local docker image of its tag, it fails
+// when the image doesn't match img's platform or pinned digest.
+func (mgr *Manager) applyLocal(ctx context.Context, img *pkgtypes.Image) error {
+	resp, _, err := mgr.cli.ImageInspectWithRaw(ctx, mgr.dockerRepoTag(img))
+	if err != nil {
+		return convertError(err)
+	}
+	if err := img.CheckPlatform(resp.Architecture); err != nil {
+		return err
+	}
+	if resp.Config != nil {
+		applyLabels(img, resp.Config.Labels)
+	}
+	img.Size = resp.Size
+	img.LocalPath = mgr.availableFile(&resp)
+	return img.MatchPinnedDigest(img.Digest)
 }
 
 func (mgr *Manager) Push(ctx context.Context, img *pkgtypes.Image, force bool) (io.ReadCloser, error) {
-	cli, cfg := mgr.cli, mgr.cfg
-	return cli.ImagePush(ctx, mgr.dockerImageName(img), types.ImagePushOptions{
-		RegistryAuth: cfg.Docker.Auth,
+	auth, err := mgr.cfg.Docker.RegistryAuth(img.Registry)
+	if err != nil {
+		return nil, err
+	}
+	rc, err := mgr.cli.ImagePush(ctx, mgr.dockerRepoTag(img), types.ImagePushOptions{
+		RegistryAuth: auth,
 		All:          force,
 	})
+	return rc, convertError(err)
 }
 
+// RemoveLocal removes the tag of img. The file copied out of the image is
+// only removed with the image itself, other tags may share it, and never
+// when ctx comes from types.WithKeepFiles. See PruneLocal for the files of
+// images removed otherwise.
 func (mgr *Manager) RemoveLocal(ctx context.Context, img *pkgtypes.Image) error {
 	cli := mgr.cli
-	_, err := cli.ImageRemove(ctx, mgr.dockerImageName(img), types.ImageRemoveOptions{
+	name := mgr.dockerRepoTag(img)
+	resp, _, inspectErr := cli.ImageInspectWithRaw(ctx, name)
+	_, err := cli.ImageRemove(ctx, name, types.ImageRemoveOptions{
 		Force:         true, // Remove even if the image is in use
 		PruneChildren: true, // Prune dependent child images
 	})
-	return err
-}
-
-func (mgr *Manager) CheckHealth(ctx context.Context) error {
-	parts := strings.SplitN(mgr.cfg.Docker.Prefix, "/", 2)
-	if len(parts) >= 2 && strings.Contains(parts[0], ".") {
-		if err := utils.IPReachable(parts[0], time.Second); err != nil {
-			return errors.Wrapf(err, "failed to ping image hub %s", parts[0])
-		}
+	if err != nil {
+		return convertError(err)
+	}
+	if inspectErr != nil || pkgtypes.KeepFiles(ctx) {
+		return nil
+	}
+	_, _, err = cli.ImageInspectWithRaw(ctx, resp.ID)
+	switch {
+	case errdefs.IsNotFound(err):
+		return mgr.removeExtracted(resp.ID)
+	case err != nil:
+		return convertError(err)
 	}
 	return nil
 }
+
 func (mgr *Manager) loadMetadata(ctx context.Context, img *pkgtypes.Image) (err error) {
 	cli := mgr.cli
-	resp, _, err := cli.ImageInspectWithRaw(ctx, mgr.dockerImageName(img))
+	resp, _, err := cli.ImageInspectWithRaw(ctx, mgr.dockerRepoTag(img))
 	if err != nil {
 		return err
 	}
-	upperDir := resp.GraphDriver.Data["UpperDir"]
-	img.LocalPath = filepath.Join(upperDir, destImgName)
+	if img.LocalPath, err = mgr.imageFile(ctx, &resp); err != nil {
+		return err
+	}
 	img.ActualSize, img.VirtualSize, err = utils.ImageSize(ctx, img.LocalPath)
 
-	img.Digest = resp.Config.Labels["SHA256"]
+	applyLabels(img, resp.Config.Labels)
+	img.Size = resp.Size
 	return err
 }
 
-func (m *Manager) dockerImageName(img *pkgtypes.Image) string {
-	cfg := m.cfg
+// dockerRepoTag returns the name of img in docker. Images pinned to a
+// digest are referenced by their tag as well, the pinned digest is the
+// digest of the image file and not of the registry manifest, it is checked
+// against the SHA256 label set by Prepare.
+func (m *Manager) dockerRepoTag(img *pkgtypes.Image) string {
+	return fmt.Sprintf("%s:%s", m.dockerRepo(img), img.Tag)
+}
+
+// dockerRepo lowercases the path, docker rejects repositories with capitals.
+func (m *Manager) dockerRepo(img *pkgtypes.Image) string {
+	prefix := m.cfg.Docker.Prefix
+	if img.Registry != "" {
+		prefix = img.Registry
+	}
 	if img.Username == "" {
-		return path.Join(cfg.Docker.Prefix, "library", img.Fullname())
+		return path.Join(prefix, "library", strings.ToLower(img.Name))
 	} else { //nolint
-		return path.Join(cfg.Docker.Prefix, img.Fullname())
+		return path.Join(prefix, strings.ToLower(img.Username), strings.ToLower(img.Name))
 	}
 }
 
-func makeDockerClient(endpoint string) (*engineapi.Client, error) {
+// makeDockerClient returns the client and the transport it sends its
+// requests with.
+func makeDockerClient(cfg *pkgtypes.DockerConfig) (*engineapi.Client, *http.Transport, error) {
 	defaultHeaders := map[string]string{"User-Agent": "eru-yavirt"}
-	return engineapi.NewClient(endpoint, dockerCliVersion, nil, defaultHeaders)
+	transport := &http.Transport{}
+	if cfg.TLS.Enabled() {
+		httpClient, err := cfg.TLS.HTTPClient()
+		if err != nil {
+			return nil, nil, err
+		}
+		transport = httpClient.Transport.(*http.Transport)
+	}
+	opts := []engineapi.Opt{
+		engineapi.WithVersion(dockerCliVersion),
+		engineapi.WithHTTPHeaders(defaultHeaders),
+		// WithHost configures the transport for the endpoint's protocol
+		engineapi.WithHTTPClient(&http.Client{Transport: transport}),
+		engineapi.WithHost(cfg.Endpoint),
+	}
+	if cfg.TLS.Enabled() {
+		// the scheme can't be guessed from the traced transport below
+		opts = append(opts, engineapi.WithScheme("https"))
+	}
+	opts = append(opts, engineapi.WithHTTPClient(&http.Client{
+		Transport:     tracing.Transport(transport),
+		CheckRedirect: engineapi.CheckRedirect,
+	}))
+	cli, err := engineapi.NewClientWithOpts(opts...)
+	return cli, transport, err
 }
 
-func httpGetSHA256(u string) (string, error) {
+func httpGetSHA256(ctx context.Context, client *http.Client, u string) (string, error) {
 	if !strings.HasSuffix(u, ".img") {
 		return "", fmt.Errorf("invalid url: %s", u)
 	}
 	url := strings.TrimSuffix(u, ".img")
 	url += ".sha256sum"
 	// Perform GET request
-	response, err := http.Get(url)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
 	if err != nil {
 		return "", err
 	}
+	response, err := client.Do(req)
+	if err != nil {
+		return "", convertError(err)
+	}
 	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("failed to get %s: %s", url, response.Status)
+	}
 
 	// Read the response body
 	body, err := io.ReadAll(response.Body)
@@ -0,0 +1,289 @@
+package docker
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	registrytypes "github.com/docker/docker/api/types/registry"
+	"github.com/stretchr/testify/assert"
+	"github.com/yuyang0/vmimage"
+	"github.com/yuyang0/vmimage/conformance"
+	pkgtypes "github.com/yuyang0/vmimage/types"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// newTestManager returns a manager talking to a fake daemon served by handler.
+func newTestManager(t *testing.T, handler http.Handler) *Manager {
+	srv := httptest.NewServer(handler)
+	t.Cleanup(srv.Close)
+	mgr, err := NewManager(&pkgtypes.Config{Docker: pkgtypes.DockerConfig{
+		Endpoint: "tcp://" + srv.Listener.Addr().String(),
+		StoreDir: t.TempDir(),
+	}})
+	assert.Nil(t, err)
+	return mgr
+}
+
+func TestEmptyStoreDir(t *testing.T) {
+	// the files would be written to the working directory
+	_, err := NewManager(&pkgtypes.Config{Docker: pkgtypes.DockerConfig{Endpoint: "unix:///var/run/docker.sock"}})
+	assert.ErrorContains(t, err, "store dir should not be empty")
+}
+
+func TestCloseIdleConnections(t *testing.T) {
+	closed := make(chan struct{}, 1)
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewEncoder(w).Encode([]types.ImageSummary{})
+	}))
+	srv.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+		if state == http.StateClosed {
+			closed <- struct{}{}
+		}
+	}
+	srv.Start()
+	defer srv.Close()
+	mgr, err := NewManager(&pkgtypes.Config{Docker: pkgtypes.DockerConfig{
+		Endpoint: "tcp://" + srv.Listener.Addr().String(),
+		StoreDir: t.TempDir(),
+	}})
+	assert.Nil(t, err)
+	_, err = mgr.ListLocalImages(context.Background(), "")
+	assert.Nil(t, err)
+
+	// the idle keep-alive connection to the daemon is closed
+	assert.Nil(t, mgr.Close())
+	select {
+	case <-closed:
+	case <-time.After(time.Second):
+		t.Fatal("the connection to the daemon is still open")
+	}
+}
+
+func TestPrepareCancelled(t *testing.T) {
+	started, done := make(chan struct{}, 1), make(chan struct{})
+	defer close(done)
+	// the requests hang until the test is over
+	hang := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		started <- struct{}{}
+		<-done
+	})
+	cancelOnStart := func() context.Context {
+		ctx, cancel := context.WithCancel(context.Background())
+		go func() {
+			<-started
+			cancel()
+		}()
+		return ctx
+	}
+	mgr := newTestManager(t, hang)
+	fname := filepath.Join(t.TempDir(), "disk.img")
+	assert.Nil(t, os.WriteFile(fname, []byte("disk"), 0600))
+
+	_, err := mgr.PrepareContext(cancelOnStart(), fname, &pkgtypes.Image{Name: "ubuntu", Tag: "latest"})
+	assert.ErrorIs(t, err, context.Canceled)
+
+	// the sha256sum download of an url is cancelled as well
+	srv := httptest.NewServer(hang)
+	t.Cleanup(srv.Close)
+	_, err = mgr.PrepareContext(cancelOnStart(), srv.URL+"/disk.img", &pkgtypes.Image{Name: "ubuntu", Tag: "latest"})
+	assert.ErrorIs(t, err, context.Canceled)
+}
+
+func TestTracePropagation(t *testing.T) {
+	prev := otel.GetTextMapPropagator()
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	defer otel.SetTextMapPropagator(prev)
+
+	traceparent := make(chan string, 1)
+	mgr := newTestManager(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		traceparent <- r.Header.Get("Traceparent")
+	}))
+	traceID := trace.TraceID{1, 2, 3}
+	ctx := trace.ContextWithSpanContext(context.Background(), trace.NewSpanContext(trace.SpanContextConfig{
+		TraceID:    traceID,
+		SpanID:     trace.SpanID{4, 5, 6},
+		TraceFlags: trace.FlagsSampled,
+	}))
+	_, err := mgr.cli.Ping(ctx)
+	assert.Nil(t, err)
+	assert.Contains(t, <-traceparent, traceID.String())
+}
+
+func TestPullPinnedDigest(t *testing.T) {
+	label := strings.Repeat("ab", 32)
+	mgr := newTestManager(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case strings.HasSuffix(r.URL.Path, "/images/create"):
+			// pinned images are pulled by tag
+			assert.Equal(t, "harbor.example.com/yavirt/library/ubuntu", r.URL.Query().Get("fromImage"))
+			assert.Equal(t, "22.04", r.URL.Query().Get("tag"))
+			// the daemon selects the variant, no tag is made up for it
+			assert.Equal(t, "linux/arm64", r.URL.Query().Get("platform"))
+			_, _ = io.WriteString(w, `{"status":"Digest: sha256:1234"}`+"\n")
+		case strings.HasSuffix(r.URL.Path, "/json"):
+			_ = json.NewEncoder(w).Encode(types.ImageInspect{ID: "sha256:abc", Config: &container.Config{
+				Labels: map[string]string{labelDigest: label},
+			}})
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	mgr.cfg.Docker.Prefix = "harbor.example.com/yavirt"
+	pull := func(ref string) error {
+		img, err := pkgtypes.NewImage(ref)
+		assert.Nil(t, err)
+		img.Platform = "linux/arm64"
+		rc, err := mgr.Pull(context.Background(), img, pkgtypes.PullPolicyAlways)
+		assert.Nil(t, err)
+		defer rc.Close()
+		_, err = io.ReadAll(rc)
+		assert.Equal(t, "22.04", img.Tag)
+		return err
+	}
+	assert.Nil(t, pull("ubuntu:22.04@sha256:"+label))
+	assert.ErrorIs(t, pull("ubuntu:22.04@sha256:"+strings.Repeat("cd", 32)), pkgtypes.ErrDigestMismatch)
+}
+
+func TestPullPolicies(t *testing.T) {
+	pulled := 0
+	mgr := newTestManager(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case strings.HasSuffix(r.URL.Path, "/images/create"):
+			pulled++
+			_, _ = io.WriteString(w, `{"status":"Downloaded"}`+"\n")
+		case strings.HasSuffix(r.URL.Path, "/images/user1/local:latest/json"):
+			_ = json.NewEncoder(w).Encode(types.ImageInspect{ID: "sha256:abc", Size: 4, Architecture: "amd64", Config: &container.Config{
+				Labels: map[string]string{labelDigest: "abc"},
+			}})
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			_, _ = io.WriteString(w, `{"message":"No such image"}`)
+		}
+	}))
+	pull := func(name string, policy pkgtypes.PullPolicy) (*pkgtypes.Image, error) {
+		img, err := pkgtypes.NewImage(name)
+		assert.Nil(t, err)
+		rc, err := mgr.Pull(context.Background(), img, policy)
+		if err != nil {
+			return img, err
+		}
+		defer rc.Close()
+		_, err = io.ReadAll(rc)
+		return img, err
+	}
+
+	_, err := pull("user1/missing", pkgtypes.PullPolicyNever)
+	assert.ErrorIs(t, err, pkgtypes.ErrImageNotFound)
+	for _, policy := range []pkgtypes.PullPolicy{pkgtypes.PullPolicyNever, pkgtypes.PullPolicyIfNotPresent} {
+		img, err := pull("user1/local", policy)
+		assert.Nil(t, err)
+		assert.Equal(t, "abc", img.Digest)
+		assert.Equal(t, int64(4), img.Size)
+	}
+	assert.Equal(t, 0, pulled)
+
+	// a local image of another platform is pulled again
+	img, _ := pkgtypes.NewImage("user1/local")
+	img.Platform = "linux/arm64"
+	_, err = mgr.Pull(context.Background(), img, pkgtypes.PullPolicyNever)
+	assert.ErrorIs(t, err, pkgtypes.ErrImageNotFound)
+	rc, err := mgr.Pull(context.Background(), img, pkgtypes.PullPolicyIfNotPresent)
+	assert.Nil(t, err)
+	rc.Close()
+	assert.Equal(t, 1, pulled)
+
+	_, err = pull("user1/local", pkgtypes.PullPolicyAlways)
+	assert.Nil(t, err)
+	_, err = pull("user1/missing", pkgtypes.PullPolicyIfNotPresent)
+	assert.ErrorIs(t, err, pkgtypes.ErrImageNotFound)
+	assert.Equal(t, 3, pulled)
+}
+
+func TestListLocalImages(t *testing.T) {
+	var inspected []string
+	mgr := newTestManager(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, ref, _ := strings.Cut(r.URL.Path, "/images/")
+		if ref == "json" {
+			_ = json.NewEncoder(w).Encode([]types.ImageSummary{
+				{ID: "sha256:abc", Size: 4, RepoTags: []string{"harbor.io/yavirt/user1/ubuntu:22.04", "harbor.io/yavirt/user1/ubuntu:latest"},
+					Labels: map[string]string{labelDigest: "abc"}},
+				{ID: "sha256:def", RepoTags: []string{"nginx:latest"}},
+			})
+			return
+		}
+		id := strings.TrimSuffix(ref, "/json")
+		inspected = append(inspected, id)
+		_ = json.NewEncoder(w).Encode(types.ImageInspect{ID: id})
+	}))
+	mgr.cfg.Docker.Prefix = "harbor.io/yavirt"
+	fname := mgr.extractedPath("sha256:abc")
+	assert.Nil(t, os.WriteFile(fname, []byte("disk"), 0600))
+
+	images, err := mgr.ListLocalImages(context.Background(), "user1")
+	assert.Nil(t, err)
+	// the images outside of the prefix aren't inspected
+	assert.Equal(t, []string{"sha256:abc"}, inspected)
+	assert.Len(t, images, 2)
+	for _, img := range images {
+		assert.Equal(t, "abc", img.Digest)
+		assert.Equal(t, int64(4), img.Size)
+		assert.Equal(t, fname, img.LocalPath)
+		if _, err := exec.LookPath("qemu-img"); err == nil {
+			assert.Equal(t, int64(4), img.VirtualSize)
+		}
+	}
+}
+
+func TestProbeInsecureRegistry(t *testing.T) {
+	registry := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/v2/", r.URL.Path)
+	}))
+	defer registry.Close()
+	host := registry.Listener.Addr().String()
+
+	secure := true
+	mgr := newTestManager(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasSuffix(r.URL.Path, "/info") {
+			http.NotFound(w, r)
+			return
+		}
+		_ = json.NewEncoder(w).Encode(types.Info{RegistryConfig: &registrytypes.ServiceConfig{
+			IndexConfigs: map[string]*registrytypes.IndexInfo{host: {Name: host, Secure: secure}},
+		}})
+	}))
+	mgr.cfg.Docker.Prefix = host + "/yavirt"
+	// a registry served over plain http is only reachable when insecure
+	assert.NotNil(t, mgr.probeRegistry(context.Background()))
+	secure = false
+	assert.Nil(t, mgr.probeRegistry(context.Background()))
+}
+
+// TestConformance runs against the daemon and the registry of the config
+// given by VMIMAGE_CONFORMANCE_DOCKER.
+func TestConformance(t *testing.T) {
+	cfg := conformance.LoadConfig(t, "docker")
+	conformance.Run(t, conformance.Config{
+		NewManager: func(t *testing.T) vmimage.Manager {
+			mgr, err := NewManager(cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			t.Cleanup(func() { mgr.Close() })
+			return mgr
+		},
+	})
+}
@@ -0,0 +1,30 @@
+package docker
+
+import (
+	"context"
+	"errors"
+
+	engineapi "github.com/docker/docker/client"
+	"github.com/docker/docker/errdefs"
+	pkgtypes "github.com/yuyang0/vmimage/types"
+	"github.com/yuyang0/vmimage/utils"
+)
+
+// convertError maps errors of the docker client onto the errors defined in
+// the types package.
+func convertError(err error) error {
+	if err == nil || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return err
+	}
+	switch {
+	case errdefs.IsNotFound(err):
+		return pkgtypes.NewError(pkgtypes.ErrImageNotFound, err)
+	case errdefs.IsUnauthorized(err), errdefs.IsForbidden(err):
+		return pkgtypes.NewError(pkgtypes.ErrUnauthorized, err)
+	case errdefs.IsConflict(err):
+		return pkgtypes.NewError(pkgtypes.ErrConflict, err)
+	case engineapi.IsErrConnectionFailed(err), errdefs.IsUnavailable(err), utils.IsTransientNetError(err):
+		return pkgtypes.NewError(pkgtypes.ErrUnavailable, err)
+	}
+	return err
+}
@@ -0,0 +1,179 @@
+package docker
+
+import (
+	"archive/tar"
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/pkg/errors"
+	"github.com/yuyang0/vmimage/utils"
+)
+
+const overlay2Driver = "overlay2"
+
+// imageFile returns the path of the image file of the inspected image. With
+// overlay2 on the local host the file is used in place, in the layer's
+// upper dir, or cloned into the store dir when materializing. Otherwise it
+// is copied out of a container into the store dir.
+func (mgr *Manager) imageFile(ctx context.Context, resp *types.ImageInspect) (string, error) {
+	if fname := mgr.availableFile(resp); fname != "" {
+		return fname, nil
+	}
+	if fname := overlayFile(resp); fname != "" {
+		return mgr.materialize(fname, resp.ID)
+	}
+	return mgr.extract(ctx, resp.ID)
+}
+
+// availableFile returns the image file if it can be used without copying
+// anything, or "".
+func (mgr *Manager) availableFile(resp *types.ImageInspect) string {
+	if !mgr.cfg.Docker.Materialize {
+		if fname := overlayFile(resp); fname != "" {
+			return fname
+		}
+	}
+	if fname := mgr.extractedPath(resp.ID); fileExists(fname) {
+		return fname
+	}
+	return ""
+}
+
+// overlayFile returns the image file in the upper dir of an overlay2 image
+// when it is reachable from this host, or "".
+func overlayFile(resp *types.ImageInspect) string {
+	if resp.GraphDriver.Name != overlay2Driver {
+		return ""
+	}
+	upperDir := resp.GraphDriver.Data["UpperDir"]
+	if upperDir == "" {
+		return ""
+	}
+	if fname := filepath.Join(upperDir, destImgName); fileExists(fname) {
+		return fname
+	}
+	return ""
+}
+
+// materialize clones the file of an overlay2 layer into the store dir.
+func (mgr *Manager) materialize(fname, imageID string) (string, error) {
+	dest := mgr.extractedPath(imageID)
+	if _, err := utils.CloneFile(fname, dest); err != nil {
+		return "", errors.Wrapf(err, "failed to materialize image %s", imageID)
+	}
+	return dest, nil
+}
+
+// extract copies the image file of imageID out of a container created from
+// it, the container is never started. The file is named after the image ID
+// so it is only copied once.
+func (mgr *Manager) extract(ctx context.Context, imageID string) (string, error) {
+	dest := mgr.extractedPath(imageID)
+	cli := mgr.cli
+	// scratch images have no command but create requires one
+	created, err := cli.ContainerCreate(ctx, &container.Config{Image: imageID, Cmd: []string{"/" + destImgName}}, nil, nil, nil, "")
+	if err != nil {
+		return "", errors.Wrapf(err, "failed to create container of image %s", imageID)
+	}
+	defer cli.ContainerRemove(context.WithoutCancel(ctx), created.ID, types.ContainerRemoveOptions{Force: true}) //nolint:errcheck
+
+	rc, _, err := cli.CopyFromContainer(ctx, created.ID, "/"+destImgName)
+	if err != nil {
+		return "", errors.Wrapf(err, "failed to copy %s out of image %s", destImgName, imageID)
+	}
+	defer rc.Close()
+	if err := extractFile(utils.NewContextReader(ctx, rc), dest); err != nil {
+		return "", errors.Wrapf(err, "failed to extract image %s", imageID)
+	}
+	return dest, nil
+}
+
+func (mgr *Manager) extractedPath(imageID string) string {
+	return filepath.Join(mgr.cfg.Docker.StoreDir, strings.TrimPrefix(imageID, "sha256:")+".img")
+}
+
+func (mgr *Manager) removeExtracted(imageID string) error {
+	if err := os.Remove(mgr.extractedPath(imageID)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// PruneLocal removes the files of the store dir whose image is gone, e.g.
+// removed with the docker cli or by force while leased, except keep.
+func (mgr *Manager) PruneLocal(ctx context.Context, keep []string) error {
+	// the files are listed first, the image of a file extracted meanwhile
+	// is then listed below
+	entries, err := os.ReadDir(mgr.cfg.Docker.StoreDir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	images, err := mgr.cli.ImageList(ctx, types.ImageListOptions{All: true})
+	if err != nil {
+		return convertError(err)
+	}
+	ids := map[string]bool{}
+	for _, image := range images {
+		ids[strings.TrimPrefix(image.ID, "sha256:")] = true
+	}
+	kept := map[string]bool{}
+	for _, fname := range keep {
+		kept[filepath.Clean(fname)] = true
+	}
+	for _, entry := range entries {
+		id, ok := strings.CutSuffix(entry.Name(), ".img")
+		if !ok || entry.IsDir() || strings.HasPrefix(id, ".") || ids[id] || kept[mgr.extractedPath(id)] {
+			continue
+		}
+		if err := mgr.removeExtracted(id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func fileExists(fname string) bool {
+	_, err := os.Stat(fname)
+	return err == nil
+}
+
+// extractFile writes the single regular file of the tar stream r to dest,
+// through a temporary file so that dest is either complete or missing.
+func extractFile(r io.Reader, dest string) error {
+	tr := tar.NewReader(r)
+	hdr, err := tr.Next()
+	if err != nil {
+		return err
+	}
+	if hdr.Typeflag != tar.TypeReg {
+		return errors.Errorf("%s is not a regular file", hdr.Name)
+	}
+	if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(dest), ".extract-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if err := tmp.Chmod(0644); err != nil {
+		tmp.Close()
+		return err
+	}
+	if _, err := io.Copy(tmp, tr); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), dest)
+}
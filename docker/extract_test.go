@@ -0,0 +1,138 @@
+package docker
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/docker/docker/api/types"
+	"github.com/stretchr/testify/assert"
+	pkgtypes "github.com/yuyang0/vmimage/types"
+)
+
+func tarOf(t *testing.T, hdr *tar.Header, content string) *bytes.Buffer {
+	buf := &bytes.Buffer{}
+	tw := tar.NewWriter(buf)
+	hdr.Size = int64(len(content))
+	assert.Nil(t, tw.WriteHeader(hdr))
+	_, err := tw.Write([]byte(content))
+	assert.Nil(t, err)
+	assert.Nil(t, tw.Close())
+	return buf
+}
+
+func TestExtractFile(t *testing.T) {
+	dest := filepath.Join(t.TempDir(), "store", "abc.img")
+	r := tarOf(t, &tar.Header{Name: destImgName, Typeflag: tar.TypeReg, Mode: 0600}, "disk")
+	assert.Nil(t, extractFile(r, dest))
+	bs, err := os.ReadFile(dest)
+	assert.Nil(t, err)
+	assert.Equal(t, "disk", string(bs))
+	entries, _ := os.ReadDir(filepath.Dir(dest))
+	assert.Len(t, entries, 1)
+
+	dest = filepath.Join(t.TempDir(), "link.img")
+	r = tarOf(t, &tar.Header{Name: destImgName, Typeflag: tar.TypeSymlink, Linkname: "/etc/passwd"}, "")
+	assert.ErrorContains(t, extractFile(r, dest), "not a regular file")
+	assert.NoFileExists(t, dest)
+}
+
+func TestImageFileOverlayFastPath(t *testing.T) {
+	upperDir := t.TempDir()
+	assert.Nil(t, os.WriteFile(filepath.Join(upperDir, destImgName), []byte("disk"), 0600))
+	mgr := &Manager{cfg: &pkgtypes.Config{}}
+	resp := &types.ImageInspect{ID: "sha256:abc"}
+	resp.GraphDriver.Name = overlay2Driver
+	resp.GraphDriver.Data = map[string]string{"UpperDir": upperDir}
+
+	fname, err := mgr.imageFile(context.Background(), resp)
+	assert.Nil(t, err)
+	assert.Equal(t, filepath.Join(upperDir, destImgName), fname)
+}
+
+func TestImageFileMaterialize(t *testing.T) {
+	upperDir := t.TempDir()
+	assert.Nil(t, os.WriteFile(filepath.Join(upperDir, destImgName), []byte("disk"), 0600))
+	storeDir := t.TempDir()
+	mgr := &Manager{cfg: &pkgtypes.Config{Docker: pkgtypes.DockerConfig{StoreDir: storeDir, Materialize: true}}}
+	resp := &types.ImageInspect{ID: "sha256:abc"}
+	resp.GraphDriver.Name = overlay2Driver
+	resp.GraphDriver.Data = map[string]string{"UpperDir": upperDir}
+
+	fname, err := mgr.imageFile(context.Background(), resp)
+	assert.Nil(t, err)
+	assert.Equal(t, filepath.Join(storeDir, "abc.img"), fname)
+	bs, err := os.ReadFile(fname)
+	assert.Nil(t, err)
+	assert.Equal(t, "disk", string(bs))
+
+	// pruning the docker image leaves the materialized file alone
+	assert.Nil(t, os.RemoveAll(upperDir))
+	assert.FileExists(t, fname)
+	assert.Nil(t, mgr.removeExtracted(resp.ID))
+	assert.NoFileExists(t, fname)
+}
+
+func TestRemoveLocalSharedImage(t *testing.T) {
+	// both tags share the image abc
+	tags := map[string]bool{"user1/a:latest": true, "user1/b:latest": true}
+	mgr := newTestManager(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, ref, _ := strings.Cut(r.URL.Path, "/images/")
+		switch {
+		case r.Method == http.MethodDelete:
+			delete(tags, ref)
+			_, _ = io.WriteString(w, "[]")
+		case ref == "json":
+			images := []types.ImageSummary{{ID: "sha256:ghi"}}
+			if len(tags) > 0 {
+				images = append(images, types.ImageSummary{ID: "sha256:abc"})
+			}
+			_ = json.NewEncoder(w).Encode(images)
+		case tags[strings.TrimSuffix(ref, "/json")], ref == "sha256:abc/json" && len(tags) > 0:
+			_ = json.NewEncoder(w).Encode(types.ImageInspect{ID: "sha256:abc"})
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			_, _ = io.WriteString(w, `{"message":"No such image"}`)
+		}
+	}))
+	storeDir := mgr.cfg.Docker.StoreDir
+	for _, id := range []string{"abc", "def", "ghi"} {
+		assert.Nil(t, os.WriteFile(filepath.Join(storeDir, id+".img"), []byte(id), 0600))
+	}
+
+	ctx := context.Background()
+	abc := filepath.Join(storeDir, "abc.img")
+	// the file of abc is kept for the other tag, the one of the image
+	// removed outside of vmimage is left to PruneLocal
+	img, _ := pkgtypes.NewImage("user1/a")
+	assert.Nil(t, mgr.RemoveLocal(ctx, img))
+	assert.FileExists(t, abc)
+	assert.FileExists(t, filepath.Join(storeDir, "def.img"))
+
+	img, _ = pkgtypes.NewImage("user1/b")
+	assert.Nil(t, mgr.RemoveLocal(ctx, img))
+	assert.NoFileExists(t, abc)
+
+	// a leased image removed by force keeps its file until it is pruned
+	// without the lease
+	tags["user1/a:latest"] = true
+	assert.Nil(t, os.WriteFile(abc, []byte("abc"), 0600))
+	img, _ = pkgtypes.NewImage("user1/a")
+	assert.Nil(t, mgr.RemoveLocal(pkgtypes.WithKeepFiles(ctx), img))
+	assert.FileExists(t, abc)
+
+	assert.Nil(t, mgr.PruneLocal(ctx, []string{abc}))
+	assert.FileExists(t, abc)
+	assert.NoFileExists(t, filepath.Join(storeDir, "def.img"))
+	assert.FileExists(t, filepath.Join(storeDir, "ghi.img"))
+	assert.Nil(t, mgr.PruneLocal(ctx, nil))
+	assert.NoFileExists(t, abc)
+	assert.FileExists(t, filepath.Join(storeDir, "ghi.img"))
+}
@@ -0,0 +1,146 @@
+package docker
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/docker/docker/api/types"
+	"github.com/pkg/errors"
+	"github.com/yuyang0/vmimage/tracing"
+	pkgtypes "github.com/yuyang0/vmimage/types"
+	"github.com/yuyang0/vmimage/utils"
+)
+
+// the docker hub registry API isn't served by docker.io itself
+const dockerHubAPIHost = "registry-1.docker.io"
+
+// CheckHealth probes the daemon, the registry API, the configured
+// credential and the free space of the daemon's root dir. The checks which
+// need the daemon are skipped when it isn't reachable.
+func (mgr *Manager) CheckHealth(ctx context.Context) (*pkgtypes.HealthReport, error) {
+	report := &pkgtypes.HealthReport{Backend: "docker"}
+	daemonErr := report.Probe(ctx, pkgtypes.HealthCheckDaemon, func(ctx context.Context) error {
+		_, err := mgr.cli.Ping(ctx)
+		return err
+	})
+	_ = report.Probe(ctx, pkgtypes.HealthCheckRegistry, mgr.probeRegistry)
+	if daemonErr == nil {
+		if mgr.cfg.Docker.Auth != "" {
+			_ = report.Probe(ctx, pkgtypes.HealthCheckAuth, mgr.probeAuth)
+		}
+		if strings.HasPrefix(mgr.cli.DaemonHost(), "unix://") {
+			_ = report.Probe(ctx, pkgtypes.HealthCheckStorage, func(ctx context.Context) (err error) {
+				report.StorageFree, err = mgr.storageFree(ctx)
+				return err
+			})
+		}
+	}
+	return report, report.Err()
+}
+
+// probeRegistry checks that the registry serves the v2 API, an
+// unauthenticated request is answered with 401 by registries requiring auth.
+// Registries the daemon treats as insecure are probed like the daemon pulls
+// from them: https without verifying the certificate, then plain http.
+func (mgr *Manager) probeRegistry(ctx context.Context) error {
+	host := pkgtypes.RegistryHost(mgr.cfg.Docker.Prefix)
+	if host == "docker.io" {
+		host = dockerHubAPIHost
+	}
+	err := mgr.getRegistryV2(ctx, mgr.httpClient, "https", host)
+	if err == nil || !mgr.insecureRegistry(ctx, host) {
+		return err
+	}
+	insecureClient, cerr := (&pkgtypes.TLSConfig{InsecureSkipVerify: true}).HTTPClient()
+	if cerr != nil {
+		return cerr
+	}
+	insecureClient.Transport = tracing.Transport(insecureClient.Transport)
+	if err = mgr.getRegistryV2(ctx, insecureClient, "https", host); err == nil {
+		return nil
+	}
+	return mgr.getRegistryV2(ctx, mgr.httpClient, "http", host)
+}
+
+func (mgr *Manager) getRegistryV2(ctx context.Context, client *http.Client, scheme, host string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, fmt.Sprintf("%s://%s/v2/", scheme, host), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusUnauthorized {
+		return errors.Errorf("unexpected status of registry %s: %s", host, resp.Status)
+	}
+	return nil
+}
+
+// insecureRegistry reports whether the daemon treats host as an insecure
+// registry, i.e. it is listed in insecure-registries or resolves to one of
+// the insecure CIDRs, which include the loopback network by default.
+func (mgr *Manager) insecureRegistry(ctx context.Context, host string) bool {
+	info, err := mgr.cli.Info(ctx)
+	if err != nil || info.RegistryConfig == nil {
+		return false
+	}
+	if index, ok := info.RegistryConfig.IndexConfigs[host]; ok {
+		return !index.Secure
+	}
+	hostname := host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		hostname = h
+	}
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, hostname)
+	if err != nil {
+		return false
+	}
+	for _, addr := range addrs {
+		for _, cidr := range info.RegistryConfig.InsecureRegistryCIDRs {
+			if (*net.IPNet)(cidr).Contains(addr.IP) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// probeAuth asks the daemon to log in with the configured credential.
+func (mgr *Manager) probeAuth(ctx context.Context) error {
+	authConfig, err := decodeDockerAuth(mgr.cfg.Docker.Auth)
+	if err != nil {
+		return err
+	}
+	_, err = mgr.cli.RegistryLogin(ctx, *authConfig)
+	return err
+}
+
+func (mgr *Manager) storageFree(ctx context.Context) (uint64, error) {
+	info, err := mgr.cli.Info(ctx)
+	if err != nil {
+		return 0, err
+	}
+	return utils.DiskFree(info.DockerRootDir)
+}
+
+func decodeDockerAuth(auth string) (*types.AuthConfig, error) {
+	bs, err := base64.StdEncoding.DecodeString(auth)
+	if err != nil {
+		bs, err = base64.URLEncoding.DecodeString(auth)
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid docker auth")
+	}
+	authConfig := &types.AuthConfig{}
+	if err := json.Unmarshal(bs, authConfig); err != nil {
+		return nil, errors.Wrap(err, "invalid docker auth")
+	}
+	return authConfig, nil
+}
@@ -0,0 +1,61 @@
+package docker
+
+import (
+	"fmt"
+	"strings"
+
+	pkgtypes "github.com/yuyang0/vmimage/types"
+)
+
+// Labels set by Prepare on the images it builds.
+const (
+	labelDigest    = "SHA256"
+	labelOSType    = "OS_TYPE"
+	labelOSDistrib = "OS_DISTRIB"
+	labelOSVersion = "OS_VERSION"
+	labelOSArch    = "OS_ARCH"
+)
+
+// labelInstruction returns the Dockerfile LABEL instruction recording the
+// digest and the OS of img.
+func labelInstruction(digest string, img *pkgtypes.Image) string {
+	return fmt.Sprintf("LABEL %s=%q %s=%q %s=%q %s=%q %s=%q",
+		labelDigest, digest,
+		labelOSType, img.OS.Type,
+		labelOSDistrib, img.OS.Distrib,
+		labelOSVersion, img.OS.Version,
+		labelOSArch, img.OS.Arch,
+	)
+}
+
+// applyLabels fills the digest and the OS of img from the labels of its
+// docker image, images built before the OS labels existed keep their OS.
+func applyLabels(img *pkgtypes.Image, labels map[string]string) {
+	img.Digest = labels[labelDigest]
+	for label, field := range map[string]*string{
+		labelOSType:    &img.OS.Type,
+		labelOSDistrib: &img.OS.Distrib,
+		labelOSVersion: &img.OS.Version,
+		labelOSArch:    &img.OS.Arch,
+	} {
+		if val, ok := labels[label]; ok {
+			*field = val
+		}
+	}
+}
+
+// localName maps a docker repo tag to the image name, ok is false when the
+// repo tag is outside of prefix or, if user isn't empty, not owned by user.
+func localName(prefix, user, repoTag string) (name string, ok bool) {
+	name = repoTag
+	if prefix = strings.TrimSuffix(prefix, "/"); prefix != "" {
+		if name, ok = strings.CutPrefix(repoTag, prefix+"/"); !ok {
+			return "", false
+		}
+	}
+	name = strings.TrimPrefix(name, "library/")
+	if user != "" && !strings.HasPrefix(name, user+"/") {
+		return "", false
+	}
+	return name, true
+}
@@ -0,0 +1,49 @@
+package docker
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	pkgtypes "github.com/yuyang0/vmimage/types"
+)
+
+func TestLocalName(t *testing.T) {
+	prefix := "harbor.example.com/yavirt"
+	cases := []struct {
+		prefix, user, repoTag string
+		name                  string
+		ok                    bool
+	}{
+		{prefix, "", "harbor.example.com/yavirt/library/ubuntu:latest", "ubuntu:latest", true},
+		{prefix, "", "harbor.example.com/yavirt/bob/ubuntu:latest", "bob/ubuntu:latest", true},
+		{prefix, "bob", "harbor.example.com/yavirt/bob/ubuntu:latest", "bob/ubuntu:latest", true},
+		{prefix, "bob", "harbor.example.com/yavirt/bobby/ubuntu:latest", "", false},
+		{prefix, "bob", "harbor.example.com/yavirt/library/ubuntu:latest", "", false},
+		{prefix, "", "harbor.example.com/yavirtual/ubuntu:latest", "", false},
+		{prefix + "/", "", "harbor.example.com/yavirt/library/ubuntu:latest", "ubuntu:latest", true},
+		{"", "", "ubuntu:latest", "ubuntu:latest", true},
+		{"", "bob", "bob/ubuntu:latest", "bob/ubuntu:latest", true},
+		{"", "bob", "bobby/ubuntu:latest", "", false},
+	}
+	for _, c := range cases {
+		name, ok := localName(c.prefix, c.user, c.repoTag)
+		assert.Equal(t, c.ok, ok, c.repoTag)
+		assert.Equal(t, c.name, name, c.repoTag)
+	}
+}
+
+func TestApplyLabels(t *testing.T) {
+	img := &pkgtypes.Image{OS: pkgtypes.OSInfo{Type: "linux", Arch: "amd64"}}
+	applyLabels(img, map[string]string{
+		labelDigest:    "abc",
+		labelOSDistrib: "ubuntu",
+		labelOSVersion: "22.04",
+		labelOSArch:    "arm64",
+	})
+	assert.Equal(t, "abc", img.Digest)
+	assert.Equal(t, pkgtypes.OSInfo{Type: "linux", Distrib: "ubuntu", Version: "22.04", Arch: "arm64"}, img.OS)
+
+	img.OS.Version = "a b"
+	assert.Equal(t, `LABEL SHA256="abc" OS_TYPE="linux" OS_DISTRIB="ubuntu" OS_VERSION="a b" OS_ARCH="arm64"`,
+		labelInstruction("abc", img))
+}
@@ -0,0 +1,342 @@
+package docker
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+	pkgtypes "github.com/yuyang0/vmimage/types"
+)
+
+const (
+	mediaTypeManifest     = "application/vnd.docker.distribution.manifest.v2+json"
+	mediaTypeManifestList = "application/vnd.docker.distribution.manifest.list.v2+json"
+	mediaTypeOCIManifest  = "application/vnd.oci.image.manifest.v1+json"
+	mediaTypeOCIIndex     = "application/vnd.oci.image.index.v1+json"
+)
+
+// ListRemoteImages lists the images under the configured prefix in its
+// registry, of user only when it isn't empty. Their digest and OS come from
+// the labels of the image configs, nothing is pulled. The registry has to
+// serve the catalog endpoint, which docker hub doesn't.
+func (mgr *Manager) ListRemoteImages(ctx context.Context, user string) ([]*pkgtypes.Image, error) {
+	prefix := strings.TrimSuffix(mgr.cfg.Docker.Prefix, "/")
+	host := pkgtypes.RegistryHost(prefix)
+	if host == "docker.io" {
+		return nil, errors.New("docker hub doesn't support listing images")
+	}
+	reg, err := mgr.newRegistryClient(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	repos, err := reg.list(ctx, "/v2/_catalog", "registry:catalog:*", "repositories")
+	if err != nil {
+		return nil, err
+	}
+	var ans []*pkgtypes.Image
+	for _, repo := range repos {
+		// the repos outside of prefix or not owned by user are skipped
+		// before listing their tags
+		if _, ok := localName(prefix, user, host+"/"+repo); !ok {
+			continue
+		}
+		scope := fmt.Sprintf("repository:%s:pull", repo)
+		tags, err := reg.list(ctx, "/v2/"+repo+"/tags/list", scope, "tags")
+		if err != nil {
+			return nil, err
+		}
+		for _, tag := range tags {
+			name, ok := localName(prefix, user, host+"/"+repo+":"+tag)
+			if !ok {
+				continue
+			}
+			img, err := pkgtypes.NewImage(name)
+			if err != nil {
+				continue
+			}
+			labels, size, err := reg.imageLabels(ctx, repo, tag)
+			if err != nil {
+				return nil, errors.Wrapf(err, "failed to inspect %s:%s", repo, tag)
+			}
+			applyLabels(img, labels)
+			img.Size = size
+			ans = append(ans, img)
+		}
+	}
+	return ans, nil
+}
+
+// registryClient talks to the registry API, it answers the auth challenges
+// of the registry with the configured credential.
+type registryClient struct {
+	client  *http.Client
+	baseURL string
+	auth    *registryCredential
+
+	mu sync.Mutex
+	// tokens holds the Authorization header of every scope
+	tokens map[string]string
+}
+
+type registryCredential struct {
+	username, password string
+}
+
+func (mgr *Manager) newRegistryClient(ctx context.Context, host string) (*registryClient, error) {
+	reg := &registryClient{
+		client:  mgr.httpClient,
+		baseURL: "https://" + host,
+		tokens:  map[string]string{},
+	}
+	if mgr.cfg.Docker.Auth != "" {
+		authConfig, err := decodeDockerAuth(mgr.cfg.Docker.Auth)
+		if err != nil {
+			return nil, err
+		}
+		if authConfig.Username != "" {
+			reg.auth = &registryCredential{authConfig.Username, authConfig.Password}
+		}
+	}
+	// registries the daemon treats as insecure may only serve plain http
+	if err := mgr.getRegistryV2(ctx, mgr.httpClient, "https", host); err != nil && mgr.insecureRegistry(ctx, host) {
+		reg.baseURL = "http://" + host
+	}
+	return reg, nil
+}
+
+// list collects the field of the paginated responses of path.
+func (reg *registryClient) list(ctx context.Context, path, scope, field string) ([]string, error) {
+	var ans []string
+	next := reg.baseURL + path
+	for next != "" {
+		resp, err := reg.get(ctx, next, scope, "")
+		if err != nil {
+			return nil, err
+		}
+		page := map[string]json.RawMessage{}
+		err = json.NewDecoder(resp.Body).Decode(&page)
+		resp.Body.Close()
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid response of %s", path)
+		}
+		var items []string
+		if raw, ok := page[field]; ok && string(raw) != "null" {
+			if err := json.Unmarshal(raw, &items); err != nil {
+				return nil, errors.Wrapf(err, "invalid response of %s", path)
+			}
+		}
+		ans = append(ans, items...)
+		next = nextLink(resp, reg.baseURL)
+	}
+	return ans, nil
+}
+
+type manifest struct {
+	MediaType string `json:"mediaType"`
+	Config    struct {
+		Digest string `json:"digest"`
+	} `json:"config"`
+	Layers []struct {
+		Size int64 `json:"size"`
+	} `json:"layers"`
+	// Manifests is set for manifest lists, the labels of every variant
+	// are the same
+	Manifests []struct {
+		Digest string `json:"digest"`
+	} `json:"manifests"`
+}
+
+// imageLabels returns the labels and the size of the image repo:tag.
+func (reg *registryClient) imageLabels(ctx context.Context, repo, tag string) (map[string]string, int64, error) {
+	scope := fmt.Sprintf("repository:%s:pull", repo)
+	var m manifest
+	if err := reg.getJSON(ctx, "/v2/"+repo+"/manifests/"+tag, scope, &m); err != nil {
+		return nil, 0, err
+	}
+	if len(m.Manifests) > 0 {
+		ref := m.Manifests[0].Digest
+		m = manifest{}
+		if err := reg.getJSON(ctx, "/v2/"+repo+"/manifests/"+ref, scope, &m); err != nil {
+			return nil, 0, err
+		}
+	}
+	if m.Config.Digest == "" {
+		return nil, 0, errors.Errorf("unsupported manifest %s", m.MediaType)
+	}
+	var config struct {
+		Config struct {
+			Labels map[string]string `json:"Labels"`
+		} `json:"config"`
+	}
+	if err := reg.getJSON(ctx, "/v2/"+repo+"/blobs/"+m.Config.Digest, scope, &config); err != nil {
+		return nil, 0, err
+	}
+	var size int64
+	for _, layer := range m.Layers {
+		size += layer.Size
+	}
+	return config.Config.Labels, size, nil
+}
+
+func (reg *registryClient) getJSON(ctx context.Context, path, scope string, v any) error {
+	accept := strings.Join([]string{mediaTypeManifest, mediaTypeManifestList, mediaTypeOCIManifest, mediaTypeOCIIndex}, ", ")
+	resp, err := reg.get(ctx, reg.baseURL+path, scope, accept)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return errors.Wrapf(json.NewDecoder(resp.Body).Decode(v), "invalid response of %s", path)
+}
+
+// get sends a GET request, authenticating it when the registry asks to.
+func (reg *registryClient) get(ctx context.Context, u, scope, accept string) (*http.Response, error) {
+	send := func(authorization string) (*http.Response, error) {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+		if err != nil {
+			return nil, err
+		}
+		if accept != "" {
+			req.Header.Set("Accept", accept)
+		}
+		if authorization != "" {
+			req.Header.Set("Authorization", authorization)
+		}
+		resp, err := reg.client.Do(req)
+		return resp, convertError(err)
+	}
+	resp, err := send(reg.cachedToken(scope))
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusUnauthorized {
+		challenge := resp.Header.Get("WWW-Authenticate")
+		resp.Body.Close()
+		authorization, err := reg.authorize(ctx, challenge, scope)
+		if err != nil {
+			return nil, err
+		}
+		reg.mu.Lock()
+		reg.tokens[scope] = authorization
+		reg.mu.Unlock()
+		if resp, err = send(authorization); err != nil {
+			return nil, err
+		}
+	}
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		bs, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return nil, registryError(resp.StatusCode, fmt.Errorf("%s: %s %s", u, resp.Status, strings.TrimSpace(string(bs))))
+	}
+	return resp, nil
+}
+
+func (reg *registryClient) cachedToken(scope string) string {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	return reg.tokens[scope]
+}
+
+// authorize answers a WWW-Authenticate challenge, it returns the value of
+// the Authorization header.
+func (reg *registryClient) authorize(ctx context.Context, challenge, scope string) (string, error) {
+	scheme, params := parseChallenge(challenge)
+	switch scheme {
+	case "basic":
+		if reg.auth == nil {
+			return "", pkgtypes.NewError(pkgtypes.ErrUnauthorized, errors.New("the registry requires a credential"))
+		}
+		return "Basic " + base64.StdEncoding.EncodeToString([]byte(reg.auth.username+":"+reg.auth.password)), nil
+	case "bearer":
+	default:
+		return "", pkgtypes.NewError(pkgtypes.ErrUnauthorized, errors.Errorf("unsupported auth challenge %q", challenge))
+	}
+	realm, err := url.Parse(params["realm"])
+	if err != nil || realm.Host == "" {
+		return "", errors.Errorf("invalid auth realm in %q", challenge)
+	}
+	query := realm.Query()
+	if params["service"] != "" {
+		query.Set("service", params["service"])
+	}
+	query.Set("scope", scope)
+	realm.RawQuery = query.Encode()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, realm.String(), nil)
+	if err != nil {
+		return "", err
+	}
+	if reg.auth != nil {
+		req.SetBasicAuth(reg.auth.username, reg.auth.password)
+	}
+	resp, err := reg.client.Do(req)
+	if err != nil {
+		return "", convertError(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", registryError(resp.StatusCode, errors.Errorf("failed to get a registry token: %s", resp.Status))
+	}
+	var token struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&token); err != nil {
+		return "", errors.Wrap(err, "invalid registry token")
+	}
+	if token.Token == "" {
+		token.Token = token.AccessToken
+	}
+	return "Bearer " + token.Token, nil
+}
+
+// parseChallenge splits a WWW-Authenticate header such as
+// `Bearer realm="https://auth.example.com/token",service="registry"`.
+func parseChallenge(challenge string) (scheme string, params map[string]string) {
+	scheme, rest, _ := strings.Cut(strings.TrimSpace(challenge), " ")
+	params = map[string]string{}
+	for rest != "" {
+		var key, val string
+		key, rest, _ = strings.Cut(strings.TrimLeft(rest, ", "), "=")
+		if strings.HasPrefix(rest, `"`) {
+			val, rest, _ = strings.Cut(rest[1:], `"`)
+		} else {
+			val, rest, _ = strings.Cut(rest, ",")
+		}
+		params[strings.ToLower(strings.TrimSpace(key))] = val
+	}
+	return strings.ToLower(scheme), params
+}
+
+// nextLink returns the url of the next page given by the Link header, ""
+// on the last page.
+func nextLink(resp *http.Response, baseURL string) string {
+	link := resp.Header.Get("Link")
+	target, rest, ok := strings.Cut(link, ";")
+	if !ok || !strings.Contains(rest, `rel="next"`) {
+		return ""
+	}
+	target = strings.Trim(strings.TrimSpace(target), "<>")
+	if strings.HasPrefix(target, "/") {
+		return baseURL + target
+	}
+	return target
+}
+
+func registryError(status int, err error) error {
+	switch status {
+	case http.StatusUnauthorized, http.StatusForbidden:
+		return pkgtypes.NewError(pkgtypes.ErrUnauthorized, err)
+	case http.StatusNotFound:
+		return pkgtypes.NewError(pkgtypes.ErrImageNotFound, err)
+	case http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return pkgtypes.NewError(pkgtypes.ErrUnavailable, err)
+	default:
+		return err
+	}
+}
@@ -0,0 +1,106 @@
+package docker
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	pkgtypes "github.com/yuyang0/vmimage/types"
+)
+
+func newTestRegistry(t *testing.T) *httptest.Server {
+	var srv *httptest.Server
+	blobs := map[string]any{
+		"/v2/_catalog": map[string]any{"repositories": []string{"yavirt/library/ubuntu"}},
+		"/v2/_catalog?last=yavirt%2Flibrary%2Fubuntu": map[string]any{
+			"repositories": []string{"yavirt/user1/centos", "other/debian"},
+		},
+		"/v2/yavirt/library/ubuntu/tags/list":       map[string]any{"tags": []string{"22.04"}},
+		"/v2/yavirt/user1/centos/tags/list":         map[string]any{"tags": []string{"7"}},
+		"/v2/yavirt/library/ubuntu/manifests/22.04": map[string]any{"mediaType": mediaTypeOCIIndex, "manifests": []any{map[string]string{"digest": "sha256:m1"}}},
+		"/v2/yavirt/library/ubuntu/manifests/sha256:m1": map[string]any{
+			"config": map[string]string{"digest": "sha256:c1"},
+			"layers": []any{map[string]int{"size": 10}},
+		},
+		"/v2/yavirt/user1/centos/manifests/7": map[string]any{
+			"config": map[string]string{"digest": "sha256:c2"},
+			"layers": []any{map[string]int{"size": 5}, map[string]int{"size": 6}},
+		},
+		"/v2/yavirt/library/ubuntu/blobs/sha256:c1": map[string]any{"config": map[string]any{"Labels": map[string]string{labelDigest: "aaa", labelOSArch: "amd64"}}},
+		"/v2/yavirt/user1/centos/blobs/sha256:c2":   map[string]any{"config": map[string]any{"Labels": map[string]string{labelDigest: "bbb"}}},
+	}
+	srv = httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/token" {
+			if user, password, _ := r.BasicAuth(); user != "admin" || password != "pw" {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			assert.Equal(t, "registry", r.URL.Query().Get("service"))
+			_ = json.NewEncoder(w).Encode(map[string]string{"token": "tkn-" + r.URL.Query().Get("scope")})
+			return
+		}
+		scope := "registry:catalog:*"
+		if repo, _, ok := strings.Cut(strings.TrimPrefix(r.URL.Path, "/v2/"), "/tags/"); ok {
+			scope = "repository:" + repo + ":pull"
+		} else if repo, _, ok := strings.Cut(strings.TrimPrefix(r.URL.Path, "/v2/"), "/manifests/"); ok {
+			scope = "repository:" + repo + ":pull"
+		} else if repo, _, ok := strings.Cut(strings.TrimPrefix(r.URL.Path, "/v2/"), "/blobs/"); ok {
+			scope = "repository:" + repo + ":pull"
+		}
+		if r.Header.Get("Authorization") != "Bearer tkn-"+scope {
+			w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer realm="%s/token",service="registry"`, srv.URL))
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if r.URL.Path == "/v2/_catalog" && r.URL.RawQuery == "" {
+			w.Header().Set("Link", `</v2/_catalog?last=yavirt%2Flibrary%2Fubuntu>; rel="next"`)
+		}
+		key := r.URL.Path
+		if r.URL.RawQuery != "" {
+			key += "?" + r.URL.RawQuery
+		}
+		blob, ok := blobs[key]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		_ = json.NewEncoder(w).Encode(blob)
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestListRemoteImages(t *testing.T) {
+	registry := newTestRegistry(t)
+	mgr := newTestManager(t, http.NotFoundHandler())
+	mgr.httpClient = registry.Client()
+	mgr.cfg.Docker.Prefix = registry.Listener.Addr().String() + "/yavirt"
+	mgr.cfg.Docker.Auth = base64.StdEncoding.EncodeToString([]byte(`{"username":"admin","password":"pw"}`))
+
+	images, err := mgr.ListRemoteImages(context.Background(), "")
+	assert.Nil(t, err)
+	assert.Len(t, images, 2)
+	assert.Equal(t, "ubuntu:22.04", images[0].Fullname())
+	assert.Equal(t, "aaa", images[0].Digest)
+	assert.Equal(t, "amd64", images[0].OS.Arch)
+	assert.Equal(t, int64(10), images[0].Size)
+	assert.Equal(t, "user1/centos:7", images[1].Fullname())
+	assert.Equal(t, "bbb", images[1].Digest)
+	assert.Equal(t, int64(11), images[1].Size)
+
+	images, err = mgr.ListRemoteImages(context.Background(), "user1")
+	assert.Nil(t, err)
+	assert.Len(t, images, 1)
+	assert.Equal(t, "user1/centos:7", images[0].Fullname())
+
+	// no credential
+	mgr.cfg.Docker.Auth = ""
+	_, err = mgr.ListRemoteImages(context.Background(), "")
+	assert.ErrorIs(t, err, pkgtypes.ErrUnauthorized)
+}
@@ -4,11 +4,21 @@ import (
 	"context"
 	"fmt"
 	"io"
+	"sync"
+	"sync/atomic"
 
 	"github.com/alphadose/haxmap"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/yuyang0/vmimage"
 	"github.com/yuyang0/vmimage/docker"
+	"github.com/yuyang0/vmimage/fake"
+	"github.com/yuyang0/vmimage/lease"
+	"github.com/yuyang0/vmimage/metrics"
 	"github.com/yuyang0/vmimage/mocks"
+	"github.com/yuyang0/vmimage/remote"
+	"github.com/yuyang0/vmimage/replication"
+	"github.com/yuyang0/vmimage/retry"
+	"github.com/yuyang0/vmimage/tracing"
 	"github.com/yuyang0/vmimage/types"
 	"github.com/yuyang0/vmimage/vmihub"
 )
@@ -16,6 +26,8 @@ import (
 const (
 	dockerType = "docker"
 	vmihubType = "vmihub"
+	remoteType = "remote"
+	fakeType   = "fake"
 	mockType   = "mock"
 )
 
@@ -29,51 +41,181 @@ func Setup(config *types.Config) (err error) {
 }
 
 type Factory struct {
-	cfg    *types.Config
+	// mu serializes Reload and the lazy creation of managers
+	mu    sync.Mutex
+	state atomic.Pointer[state]
+}
+
+// state is swapped as a whole by Reload, so a caller sees either the old
+// config and managers or the new ones, never a mix.
+type state struct {
+	cfg *types.Config
+	// bases holds the backend managers, mgrMap the same managers wrapped
+	bases  *haxmap.Map[string, vmimage.Manager]
 	mgrMap *haxmap.Map[string, vmimage.Manager]
 }
 
-func NewFactory(cfg *types.Config) (f *Factory, err error) {
-	f = &Factory{
+func newState(cfg *types.Config) *state {
+	return &state{
 		cfg:    cfg,
+		bases:  haxmap.New[string, vmimage.Manager](),
 		mgrMap: haxmap.New[string, vmimage.Manager](),
 	}
+}
 
-	var mgr vmimage.Manager
-	switch cfg.Type {
-	case dockerType:
-		mgr, err = docker.NewManager(cfg)
-	case vmihubType:
-		mgr, err = vmihub.NewManager(cfg)
-	case mockType:
-		mgr = &mocks.Manager{}
-	default:
-		err = fmt.Errorf("invalid type: %s", cfg.Type)
+// typeOf returns ty, the configured type when it is empty.
+func (st *state) typeOf(ty string) string {
+	if ty == "" {
+		return st.cfg.Type
+	}
+	return ty
+}
+
+func (st *state) set(ty string, base vmimage.Manager) {
+	st.bases.Set(ty, base)
+	st.mgrMap.Set(ty, wrap(st.cfg, ty, base))
+}
+
+func NewFactory(cfg *types.Config) (f *Factory, err error) {
+	if cfg.Metrics {
+		if err = metrics.Register(prometheus.DefaultRegisterer); err != nil {
+			return nil, err
+		}
 	}
+	mgr, err := newManager(cfg, cfg.Type)
 	if err != nil {
 		return nil, err
 	}
-	f.mgrMap.Set(cfg.Type, mgr)
+	st := newState(cfg)
+	st.set(cfg.Type, mgr)
+	f = &Factory{}
+	f.state.Store(st)
 	return f, nil
 }
 
+// Config returns the config currently in use.
+func (f *Factory) Config() *types.Config {
+	return f.state.Load().cfg
+}
+
 func (f *Factory) GetManager(ty string) (mgr vmimage.Manager, err error) {
+	st := f.state.Load()
 	if ty == "" {
-		ty = f.cfg.Type
+		ty = st.cfg.Type
 	}
-	if mgr, _ = f.mgrMap.Get(ty); mgr != nil {
+	if mgr, _ = st.mgrMap.Get(ty); mgr != nil {
+		return mgr, nil
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	// the state may have been replaced or filled while waiting for the lock
+	st = f.state.Load()
+	if mgr, _ = st.mgrMap.Get(ty); mgr != nil {
 		return mgr, nil
 	}
+	base, err := newManager(st.cfg, ty)
+	if err != nil {
+		return nil, err
+	}
+	st.set(ty, base)
+	mgr, _ = st.mgrMap.Get(ty)
+	return mgr, nil
+}
+
+func newManager(cfg *types.Config, ty string) (vmimage.Manager, error) {
 	switch ty {
 	case dockerType:
-		mgr, err = docker.NewManager(f.cfg)
+		return docker.NewManager(cfg)
+	case vmihubType:
+		return vmihub.NewManager(cfg)
+	case remoteType:
+		return remote.NewManager(cfg)
+	case fakeType:
+		return fake.NewManager(""), nil
 	case mockType:
-		mgr = &mocks.Manager{}
+		return &mocks.Manager{}, nil
 	default:
 		return nil, fmt.Errorf("invalid image manager type: %s", ty)
 	}
-	f.mgrMap.Set(ty, mgr)
-	return mgr, err
+}
+
+// wrap decorates a backend manager with the cross-cutting behaviours
+// configured in types.Config. The mock manager is returned untouched so
+// that GetMockManager keeps working.
+func wrap(cfg *types.Config, ty string, mgr vmimage.Manager) vmimage.Manager {
+	if ty == mockType {
+		return mgr
+	}
+	if cfg.Retry.MaxAttempts > 1 {
+		mgr = retry.NewManager(mgr, &cfg.Retry)
+	}
+	// metrics sit outside of retry so that a retried call is measured once
+	if cfg.Metrics {
+		mgr = metrics.NewManager(mgr, ty)
+	}
+	if cfg.Tracing {
+		mgr = tracing.NewManager(mgr, ty, nil)
+	}
+	// outermost so that ForceRemoveLocal can be reached
+	if cfg.LeaseFile != "" {
+		mgr = lease.NewManager(mgr, lease.NewStore(cfg.LeaseFile))
+	}
+	return mgr
+}
+
+// GetRemoteLister returns the backend manager of type ty, which lists the
+// images of its registry or hub. It isn't wrapped, listing isn't retried or
+// measured.
+func (f *Factory) GetRemoteLister(ty string) (vmimage.RemoteLister, error) {
+	base, st, err := f.getBase(ty)
+	if err != nil {
+		return nil, err
+	}
+	lister, ok := base.(vmimage.RemoteLister)
+	if !ok {
+		return nil, fmt.Errorf("the %s manager can't list its registry", st.typeOf(ty))
+	}
+	return lister, nil
+}
+
+// Prune removes the files the backend manager of type ty kept for images
+// which are gone. With leases enabled the files of the leases are kept and
+// no lease can be acquired meanwhile.
+func (f *Factory) Prune(ctx context.Context, ty string) error {
+	base, st, err := f.getBase(ty)
+	if err != nil {
+		return err
+	}
+	pruner, ok := base.(vmimage.Pruner)
+	if !ok {
+		return fmt.Errorf("the %s manager has no files to prune", st.typeOf(ty))
+	}
+	if st.cfg.LeaseFile == "" {
+		return pruner.PruneLocal(ctx, nil)
+	}
+	return lease.NewStore(st.cfg.LeaseFile).Prune(ctx, pruner)
+}
+
+// getBase returns the unwrapped manager of type ty and the state holding it.
+func (f *Factory) getBase(ty string) (vmimage.Manager, *state, error) {
+	for {
+		// GetManager creates the manager, the state may be replaced before
+		// it is looked up again
+		if _, err := f.GetManager(ty); err != nil {
+			return nil, nil, err
+		}
+		st := f.state.Load()
+		if base, _ := st.bases.Get(st.typeOf(ty)); base != nil {
+			return base, st, nil
+		}
+	}
+}
+
+// NewReplicator returns a replicator for the replication rules of the
+// current config, it uses the managers of the factory and follows reloads.
+func (f *Factory) NewReplicator() *replication.Replicator {
+	return replication.New(f)
 }
 
 func GetManager(tys ...string) (vmimage.Manager, error) {
@@ -117,11 +259,15 @@ func Push(ctx context.Context, img *types.Image, force bool) (io.ReadCloser, err
 }
 
 func Prepare(fname string, img *types.Image) (io.ReadCloser, error) {
+	return PrepareContext(context.Background(), fname, img)
+}
+
+func PrepareContext(ctx context.Context, fname string, img *types.Image) (io.ReadCloser, error) {
 	mgr, err := GetManager()
 	if err != nil {
 		return nil, err
 	}
-	return mgr.Prepare(fname, img)
+	return mgr.PrepareContext(ctx, fname, img)
 }
 
 func RemoveLocal(ctx context.Context, img *types.Image) error {
@@ -132,6 +278,46 @@ func RemoveLocal(ctx context.Context, img *types.Image) error {
 	return mgr.RemoveLocal(ctx, img)
 }
 
+// ForceRemoveLocal removes img even if it is leased.
+func ForceRemoveLocal(ctx context.Context, img *types.Image) error {
+	mgr, err := GetManager()
+	if err != nil {
+		return err
+	}
+	if lm, ok := mgr.(*lease.Manager); ok {
+		return lm.ForceRemoveLocal(ctx, img)
+	}
+	return mgr.RemoveLocal(ctx, img)
+}
+
+func Prune(ctx context.Context) error {
+	return gF.Prune(ctx, "")
+}
+
+func AcquireLease(img *types.Image, owner string) error {
+	store, err := leaseStore()
+	if err != nil {
+		return err
+	}
+	return store.Acquire(img, owner)
+}
+
+func ReleaseLease(img *types.Image, owner string) error {
+	store, err := leaseStore()
+	if err != nil {
+		return err
+	}
+	return store.Release(img, owner)
+}
+
+func leaseStore() (*lease.Store, error) {
+	fname := gF.Config().LeaseFile
+	if fname == "" {
+		return nil, fmt.Errorf("leases are not enabled, lease_file isn't set")
+	}
+	return lease.NewStore(fname), nil
+}
+
 func NewImage(imgName string) (*types.Image, error) {
 	return types.NewImage(imgName)
 }
@@ -149,10 +335,14 @@ func GetMockManager() *mocks.Manager {
 	return mgr.(*mocks.Manager)
 }
 
-func CheckHealth(ctx context.Context) error {
+func NewReplicator() *replication.Replicator {
+	return gF.NewReplicator()
+}
+
+func CheckHealth(ctx context.Context) (*types.HealthReport, error) {
 	mgr, err := GetManager()
 	if err != nil {
-		return err
+		return nil, err
 	}
 	return mgr.CheckHealth(ctx)
 }
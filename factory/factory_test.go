@@ -0,0 +1,70 @@
+package factory
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/yuyang0/vmimage/types"
+)
+
+func TestLeases(t *testing.T) {
+	ctx := context.Background()
+	cfg := &types.Config{
+		Type:      fakeType,
+		Retry:     types.RetryConfig{MaxAttempts: 1},
+		LeaseFile: filepath.Join(t.TempDir(), "leases.json"),
+	}
+	assert.Nil(t, Setup(cfg))
+	fname := filepath.Join(t.TempDir(), "disk.img")
+	assert.Nil(t, os.WriteFile(fname, []byte("disk"), 0600))
+	img, _ := NewImage("ubuntu")
+	rc, err := Prepare(fname, img)
+	assert.Nil(t, err)
+	rc.Close()
+
+	assert.Nil(t, AcquireLease(img, "vm1"))
+	assert.ErrorIs(t, RemoveLocal(ctx, img), types.ErrConflict)
+	assert.Nil(t, ForceRemoveLocal(ctx, img))
+	assert.Nil(t, ReleaseLease(img, "vm1"))
+
+	cfg.LeaseFile = ""
+	assert.Nil(t, Setup(cfg))
+	assert.ErrorContains(t, AcquireLease(img, "vm1"), "not enabled")
+}
+
+func TestGetRemoteLister(t *testing.T) {
+	f, err := NewFactory(&types.Config{Type: fakeType, Retry: types.RetryConfig{MaxAttempts: 1}})
+	assert.Nil(t, err)
+	fakeMgr, err := f.GetManager("")
+	assert.Nil(t, err)
+	fname := filepath.Join(t.TempDir(), "disk.img")
+	assert.Nil(t, os.WriteFile(fname, []byte("disk"), 0600))
+	img, _ := types.NewImage("ubuntu")
+	rc, err := fakeMgr.PrepareContext(context.Background(), fname, img)
+	assert.Nil(t, err)
+	rc.Close()
+	rc, err = fakeMgr.Push(context.Background(), img, false)
+	assert.Nil(t, err)
+	rc.Close()
+
+	lister, err := f.GetRemoteLister("")
+	assert.Nil(t, err)
+	images, err := lister.ListRemoteImages(context.Background(), "")
+	assert.Nil(t, err)
+	assert.Len(t, images, 1)
+	assert.Equal(t, "ubuntu:latest", images[0].Fullname())
+	assert.NotEmpty(t, images[0].Digest)
+
+	_, err = f.GetRemoteLister(mockType)
+	assert.NotNil(t, err)
+}
+
+func TestPrune(t *testing.T) {
+	f, err := NewFactory(&types.Config{Type: fakeType, Retry: types.RetryConfig{MaxAttempts: 1}})
+	assert.Nil(t, err)
+	// the fake manager keeps no files apart from its images
+	assert.ErrorContains(t, f.Prune(context.Background(), ""), "the fake manager has no files to prune")
+}
@@ -0,0 +1,146 @@
+package factory
+
+import (
+	"context"
+	"io"
+	"os"
+	"reflect"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/yuyang0/vmimage"
+	"github.com/yuyang0/vmimage/metrics"
+	"github.com/yuyang0/vmimage/types"
+	"github.com/yuyang0/vmimage/vmihub"
+)
+
+// Reload switches the factory to cfg. Managers whose settings changed are
+// rebuilt, the others are kept, and the new set of managers replaces the
+// old one atomically. When a manager can't be rebuilt the factory keeps
+// using the old config and the error is returned.
+func (f *Factory) Reload(cfg *types.Config) error {
+	if cfg.Metrics {
+		if err := metrics.Register(prometheus.DefaultRegisterer); err != nil {
+			return err
+		}
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	old := f.state.Load()
+	tys := map[string]struct{}{cfg.Type: {}}
+	old.bases.ForEach(func(ty string, _ vmimage.Manager) bool {
+		tys[ty] = struct{}{}
+		return true
+	})
+
+	st := newState(cfg)
+	var created, replaced []vmimage.Manager
+	for ty := range tys {
+		base, ok := old.bases.Get(ty)
+		if ok && !affected(ty, old.cfg, cfg) {
+			st.bases.Set(ty, base)
+			continue
+		}
+		mgr, err := rebuildManager(cfg, ty, base)
+		if err != nil {
+			closeManagers(created)
+			return err
+		}
+		created = append(created, mgr)
+		if ok {
+			replaced = append(replaced, base)
+		}
+		st.bases.Set(ty, mgr)
+	}
+	st.bases.ForEach(func(ty string, base vmimage.Manager) bool {
+		st.set(ty, base)
+		return true
+	})
+	f.state.Store(st)
+
+	closeManagers(replaced)
+	return nil
+}
+
+// WatchConfig polls fname every interval and reloads the factory whenever
+// the file changes, until ctx is done. onReload, if not nil, is called with
+// the result of every reload.
+func (f *Factory) WatchConfig(ctx context.Context, fname string, interval time.Duration, onReload func(*types.Config, error)) {
+	lastMod := modTime(fname)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		mod := modTime(fname)
+		if mod.Equal(lastMod) {
+			continue
+		}
+		lastMod = mod
+		cfg, err := types.LoadConfig(fname)
+		if err == nil {
+			err = f.Reload(cfg)
+		}
+		if onReload != nil {
+			onReload(cfg, err)
+		}
+	}
+}
+
+// affected reports whether the manager of type ty has to be rebuilt when
+// switching from config a to b.
+func affected(ty string, a, b *types.Config) bool {
+	if !reflect.DeepEqual(a.Retry, b.Retry) || a.Metrics != b.Metrics || a.Tracing != b.Tracing {
+		return true
+	}
+	switch ty {
+	case dockerType:
+		return !reflect.DeepEqual(a.Docker, b.Docker)
+	case vmihubType:
+		return !reflect.DeepEqual(a.VMIHub, b.VMIHub)
+	case remoteType:
+		return !reflect.DeepEqual(a.Remote, b.Remote)
+	default:
+		return false
+	}
+}
+
+// rebuildManager creates the manager of type ty for cfg, old is the manager
+// it replaces, if any. vmihub managers are derived from the old one, whose
+// metadata db can't be opened twice.
+func rebuildManager(cfg *types.Config, ty string, old vmimage.Manager) (vmimage.Manager, error) {
+	if hub, ok := old.(*vmihub.Manager); ok {
+		return hub.Reload(cfg)
+	}
+	return newManager(cfg, ty)
+}
+
+func closeManagers(mgrs []vmimage.Manager) {
+	for _, mgr := range mgrs {
+		if c, ok := mgr.(io.Closer); ok {
+			_ = c.Close()
+		}
+	}
+}
+
+func modTime(fname string) time.Time {
+	fi, err := os.Stat(fname)
+	if err != nil {
+		return time.Time{}
+	}
+	return fi.ModTime()
+}
+
+// Reload switches the global factory to cfg.
+func Reload(cfg *types.Config) error {
+	return gF.Reload(cfg)
+}
+
+// WatchConfig reloads the global factory whenever fname changes, see Factory.WatchConfig.
+func WatchConfig(ctx context.Context, fname string, interval time.Duration, onReload func(*types.Config, error)) {
+	gF.WatchConfig(ctx, fname, interval, onReload)
+}
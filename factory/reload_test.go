@@ -0,0 +1,115 @@
+package factory
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/yuyang0/vmimage/types"
+)
+
+func newTestConfig(password string) *types.Config {
+	return &types.Config{
+		Type: dockerType,
+		Docker: types.DockerConfig{
+			Endpoint: "unix:///tmp/vmimage-test-docker.sock",
+			StoreDir: "/tmp/vmimage-test-store",
+			Prefix:   "harbor.example.com/yavirt",
+			Username: "admin",
+			Password: password,
+		},
+		Retry: types.RetryConfig{MaxAttempts: 1},
+	}
+}
+
+func TestReload(t *testing.T) {
+	f, err := NewFactory(newTestConfig("pw1"))
+	assert.Nil(t, err)
+	dockerMgr, err := f.GetManager("")
+	assert.Nil(t, err)
+	mockMgr, err := f.GetManager(mockType)
+	assert.Nil(t, err)
+
+	// nothing changed for docker, so the manager is kept
+	assert.Nil(t, f.Reload(newTestConfig("pw1")))
+	mgr, _ := f.GetManager("")
+	assert.Same(t, dockerMgr, mgr)
+
+	assert.Nil(t, f.Reload(newTestConfig("pw2")))
+	mgr, _ = f.GetManager("")
+	assert.NotSame(t, dockerMgr, mgr)
+	assert.Equal(t, "pw2", f.Config().Docker.Password)
+	// the mock manager survives reloads so expectations set on it stay valid
+	mgr, _ = f.GetManager(mockType)
+	assert.Same(t, mockMgr, mgr)
+
+	bad := newTestConfig("pw3")
+	bad.Docker.Endpoint = "no-protocol"
+	assert.NotNil(t, f.Reload(bad))
+	assert.Equal(t, "pw2", f.Config().Docker.Password)
+}
+
+func TestWatchConfig(t *testing.T) {
+	fname := filepath.Join(t.TempDir(), "vmimage.toml")
+	write := func(password string) {
+		content := "type = \"docker\"\n[docker]\nendpoint = \"unix:///tmp/vmimage-test-docker.sock\"\n" +
+			"username = \"admin\"\npassword = \"" + password + "\"\n"
+		assert.Nil(t, os.WriteFile(fname, []byte(content), 0600))
+	}
+	write("pw1")
+	cfg, err := types.LoadConfig(fname)
+	assert.Nil(t, err)
+	f, err := NewFactory(cfg)
+	assert.Nil(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	reloaded := make(chan error, 1)
+	go f.WatchConfig(ctx, fname, 10*time.Millisecond, func(_ *types.Config, err error) {
+		reloaded <- err
+	})
+
+	// make sure the modification time changes on coarse grained filesystems
+	time.Sleep(20 * time.Millisecond)
+	write("pw2")
+	assert.Nil(t, os.Chtimes(fname, time.Now(), time.Now().Add(time.Second)))
+	select {
+	case err := <-reloaded:
+		assert.Nil(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("config was not reloaded")
+	}
+	assert.Equal(t, "pw2", f.Config().Docker.Password)
+}
+
+func TestReloadVMIHub(t *testing.T) {
+	baseDir := t.TempDir()
+	newCfg := func(addr string) *types.Config {
+		return &types.Config{
+			Type: vmihubType,
+			VMIHub: types.VMIHubConfig{
+				Addr:     addr,
+				BaseDir:  baseDir,
+				Username: "admin",
+				Password: "pw",
+			},
+			Retry: types.RetryConfig{MaxAttempts: 1},
+		}
+	}
+	f, err := NewFactory(newCfg("http://hub1.example.com"))
+	assert.Nil(t, err)
+	hubMgr, err := f.GetManager("")
+	assert.Nil(t, err)
+
+	// a new manager sharing the metadata db replaces the old one
+	assert.Nil(t, f.Reload(newCfg("http://hub2.example.com")))
+	mgr, _ := f.GetManager("")
+	assert.NotSame(t, hubMgr, mgr)
+	_, err = mgr.ListLocalImages(context.Background(), "")
+	assert.Nil(t, err)
+	_, err = hubMgr.ListLocalImages(context.Background(), "")
+	assert.Nil(t, err)
+}
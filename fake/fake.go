@@ -0,0 +1,310 @@
+// Package fake provides an in-memory vmimage.Manager for tests. Unlike
+// mocks.Manager it keeps state: prepared images land in a local store,
+// pushed ones in a hub, and pulls honor their policy.
+package fake
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/docker/docker/pkg/jsonmessage"
+	"github.com/yuyang0/vmimage/types"
+)
+
+type entry struct {
+	img  types.Image
+	data []byte
+}
+
+type Manager struct {
+	// dir receives the files of local images, they are only kept in memory
+	// when it is empty
+	dir string
+
+	mu          sync.Mutex
+	hub         map[string]*entry
+	local       map[string]*entry
+	unavailable error
+}
+
+// NewManager returns an empty fake, local images are also written under
+// dir when it isn't empty so that they have a LocalPath.
+func NewManager(dir string) *Manager {
+	return &Manager{
+		dir:   dir,
+		hub:   map[string]*entry{},
+		local: map[string]*entry{},
+	}
+}
+
+// SetUnavailable makes every operation fail with err wrapped as
+// types.ErrUnavailable, a nil err makes the fake available again.
+func (m *Manager) SetUnavailable(err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.unavailable = err
+}
+
+// AddToHub stores an image with content data in the hub, as if it had
+// been pushed by someone else.
+func (m *Manager) AddToHub(name string, data []byte) (*types.Image, error) {
+	img, err := types.NewImage(name)
+	if err != nil {
+		return nil, err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	ent := newEntry(img, data)
+	m.hub[img.Fullname()] = ent
+	ans := ent.img
+	return &ans, nil
+}
+
+func (m *Manager) ListLocalImages(_ context.Context, user string) ([]*types.Image, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.checkAvailable(); err != nil {
+		return nil, err
+	}
+	ans := []*types.Image{}
+	for _, ent := range m.local {
+		if user != "" && ent.img.Username != user {
+			continue
+		}
+		img := ent.img
+		ans = append(ans, &img)
+	}
+	sort.Slice(ans, func(i, j int) bool { return ans[i].Fullname() < ans[j].Fullname() })
+	return ans, nil
+}
+
+// ListRemoteImages returns the images of the hub, of user only when it
+// isn't empty.
+func (m *Manager) ListRemoteImages(_ context.Context, user string) ([]*types.Image, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.checkAvailable(); err != nil {
+		return nil, err
+	}
+	ans := []*types.Image{}
+	for _, ent := range m.hub {
+		if user != "" && ent.img.Username != user {
+			continue
+		}
+		img := ent.img
+		img.LocalPath = ""
+		ans = append(ans, &img)
+	}
+	sort.Slice(ans, func(i, j int) bool { return ans[i].Fullname() < ans[j].Fullname() })
+	return ans, nil
+}
+
+// LoadImage pulls the image and returns it, like the docker backend does.
+func (m *Manager) LoadImage(ctx context.Context, imgName string) (*types.Image, error) {
+	img, err := types.NewImage(imgName)
+	if err != nil {
+		return nil, err
+	}
+	rc, err := m.Pull(ctx, img, types.PullPolicyAlways)
+	if err != nil {
+		return nil, err
+	}
+	rc.Close()
+	return img, nil
+}
+
+// Prepare is PrepareContext without cancellation.
+func (m *Manager) Prepare(fname string, img *types.Image) (io.ReadCloser, error) {
+	return m.PrepareContext(context.Background(), fname, img)
+}
+
+func (m *Manager) PrepareContext(ctx context.Context, fname string, img *types.Image) (io.ReadCloser, error) {
+	if err := img.RejectPlatform(); err != nil {
+		return nil, err
+	}
+	if strings.Contains(fname, "://") {
+		return nil, fmt.Errorf("fake manager can't download %s", fname)
+	}
+	data, err := os.ReadFile(fname)
+	if err != nil {
+		return nil, err
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.checkAvailable(); err != nil {
+		return nil, err
+	}
+	ent := newEntry(img, data)
+	if err := m.storeLocal(ent); err != nil {
+		return nil, err
+	}
+	*img = ent.img
+	return progress("Prepared " + img.Fullname()), nil
+}
+
+// Pull pulls img like vmihub does, the hub keeps one architecture per tag
+// and an image built for another architecture than img's explicit platform
+// isn't found.
+func (m *Manager) Pull(ctx context.Context, img *types.Image, pullPolicy types.PullPolicy) (io.ReadCloser, error) {
+	if _, err := img.TargetArch(); err != nil {
+		return nil, err
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.checkAvailable(); err != nil {
+		return nil, err
+	}
+	name := img.Fullname()
+	if remote := m.hub[name]; remote != nil && pullPolicy != types.PullPolicyNever {
+		if err := img.CheckPlatform(remote.img.OS.Arch); err != nil {
+			return nil, err
+		}
+	}
+	ent, err := m.pull(name, pullPolicy)
+	if err != nil {
+		return nil, err
+	}
+	if ent == nil {
+		return nil, types.NewError(types.ErrImageNotFound, fmt.Errorf("image %s not found", name))
+	}
+	if err := img.CheckPlatform(ent.img.OS.Arch); err != nil {
+		return nil, err
+	}
+	if err := img.MatchPinnedDigest(ent.img.Digest); err != nil {
+		return nil, err
+	}
+	pinned, platform := img.PinnedDigest, img.Platform
+	*img = ent.img
+	img.PinnedDigest, img.Platform = pinned, platform
+	return progress("Pulled " + name), nil
+}
+
+// pull returns the entry called name according to the policy, or nil if
+// there is none.
+func (m *Manager) pull(name string, pullPolicy types.PullPolicy) (*entry, error) {
+	local := m.local[name]
+	switch pullPolicy {
+	case types.PullPolicyNever:
+		return local, nil
+	case types.PullPolicyIfNotPresent:
+		if local != nil {
+			return local, nil
+		}
+	case types.PullPolicyAlways, "":
+	default:
+		return nil, fmt.Errorf("invalid pull policy %s", pullPolicy)
+	}
+	remote := m.hub[name]
+	if remote == nil {
+		return nil, nil
+	}
+	ent := &entry{img: remote.img, data: remote.data}
+	if err := m.storeLocal(ent); err != nil {
+		return nil, err
+	}
+	return ent, nil
+}
+
+// Push fails with types.ErrConflict when the hub has different content
+// under the same name, unless force is set.
+func (m *Manager) Push(ctx context.Context, img *types.Image, force bool) (io.ReadCloser, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.checkAvailable(); err != nil {
+		return nil, err
+	}
+	name := img.Fullname()
+	local := m.local[name]
+	if local == nil {
+		return nil, types.NewError(types.ErrImageNotFound, fmt.Errorf("no local image %s", name))
+	}
+	if remote := m.hub[name]; remote != nil && remote.img.Digest != local.img.Digest && !force {
+		return nil, types.NewError(types.ErrConflict, fmt.Errorf("image %s already exists with digest %s", name, remote.img.Digest))
+	}
+	hubImg := local.img
+	hubImg.LocalPath = ""
+	m.hub[name] = &entry{img: hubImg, data: local.data}
+	return progress("Pushed " + name), nil
+}
+
+func (m *Manager) RemoveLocal(_ context.Context, img *types.Image) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.checkAvailable(); err != nil {
+		return err
+	}
+	name := img.Fullname()
+	ent := m.local[name]
+	if ent == nil {
+		return types.NewError(types.ErrImageNotFound, fmt.Errorf("no local image %s", name))
+	}
+	delete(m.local, name)
+	if ent.img.LocalPath != "" {
+		return os.Remove(ent.img.LocalPath)
+	}
+	return nil
+}
+
+func (m *Manager) CheckHealth(ctx context.Context) (*types.HealthReport, error) {
+	m.mu.Lock()
+	unavailable := m.unavailable
+	m.mu.Unlock()
+	report := &types.HealthReport{Backend: "fake"}
+	_ = report.Probe(ctx, types.HealthCheckRegistry, func(context.Context) error { return unavailable })
+	return report, report.Err()
+}
+
+func (m *Manager) checkAvailable() error {
+	if m.unavailable != nil {
+		return types.NewError(types.ErrUnavailable, m.unavailable)
+	}
+	return nil
+}
+
+// storeLocal adds ent to the local store and writes its file when the fake
+// has a dir.
+func (m *Manager) storeLocal(ent *entry) error {
+	ent.img.LocalPath = ""
+	if m.dir != "" {
+		ent.img.LocalPath = filepath.Join(m.dir, ent.img.RBDName()+".img")
+		if err := os.WriteFile(ent.img.LocalPath, ent.data, 0600); err != nil {
+			return err
+		}
+	}
+	m.local[ent.img.Fullname()] = ent
+	return nil
+}
+
+func newEntry(img *types.Image, data []byte) *entry {
+	sum := sha256.Sum256(data)
+	ent := &entry{img: *img, data: data}
+	ent.img.Registry, ent.img.PinnedDigest, ent.img.Platform = "", "", ""
+	ent.img.Digest = hex.EncodeToString(sum[:])
+	ent.img.Size = int64(len(data))
+	ent.img.ActualSize, ent.img.VirtualSize = ent.img.Size, ent.img.Size
+	return ent
+}
+
+// progress returns a stream made of a single docker JSON message.
+func progress(status string) io.ReadCloser {
+	bs, _ := json.Marshal(jsonmessage.JSONMessage{Status: status})
+	return io.NopCloser(strings.NewReader(string(bs) + "\n"))
+}
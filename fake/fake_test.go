@@ -0,0 +1,146 @@
+package fake
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/yuyang0/vmimage"
+	"github.com/yuyang0/vmimage/conformance"
+	"github.com/yuyang0/vmimage/types"
+)
+
+func drain(t *testing.T, rc io.ReadCloser, err error) {
+	assert.Nil(t, err)
+	_, err = io.ReadAll(rc)
+	assert.Nil(t, err)
+	assert.Nil(t, rc.Close())
+}
+
+func TestPrepareAndPush(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	m := NewManager(dir)
+	fname := filepath.Join(t.TempDir(), "disk.img")
+	assert.Nil(t, os.WriteFile(fname, []byte("disk"), 0600))
+
+	img, _ := types.NewImage("user1/ubuntu:22.04")
+	rc, err := m.PrepareContext(ctx, fname, img)
+	drain(t, rc, err)
+	assert.Equal(t, int64(4), img.Size)
+	assert.NotEmpty(t, img.Digest)
+	bs, err := os.ReadFile(img.LocalPath)
+	assert.Nil(t, err)
+	assert.Equal(t, "disk", string(bs))
+
+	images, err := m.ListLocalImages(ctx, "user1")
+	assert.Nil(t, err)
+	assert.Equal(t, []*types.Image{img}, images)
+
+	// not pushed yet
+	_, err = m.LoadImage(ctx, "user1/ubuntu:22.04")
+	assert.ErrorIs(t, err, types.ErrImageNotFound)
+
+	rc, err = m.Push(ctx, img, false)
+	drain(t, rc, err)
+	loaded, err := m.LoadImage(ctx, "user1/ubuntu:22.04")
+	assert.Nil(t, err)
+	assert.Equal(t, img.Digest, loaded.Digest)
+
+	_, err = m.AddToHub("user1/ubuntu:22.04", []byte("other"))
+	assert.Nil(t, err)
+	_, err = m.Push(ctx, img, false)
+	assert.ErrorIs(t, err, types.ErrConflict)
+	rc, err = m.Push(ctx, img, true)
+	drain(t, rc, err)
+
+	assert.Nil(t, m.RemoveLocal(ctx, img))
+	assert.NoFileExists(t, img.LocalPath)
+	assert.ErrorIs(t, m.RemoveLocal(ctx, img), types.ErrImageNotFound)
+}
+
+func TestPullPolicies(t *testing.T) {
+	ctx := context.Background()
+	m := NewManager("")
+	hubImg, err := m.AddToHub("ubuntu", []byte("v1"))
+	assert.Nil(t, err)
+
+	img, _ := types.NewImage("ubuntu")
+	_, err = m.Pull(ctx, img, types.PullPolicyNever)
+	assert.ErrorIs(t, err, types.ErrImageNotFound)
+
+	rc, err := m.Pull(ctx, img, types.PullPolicyIfNotPresent)
+	drain(t, rc, err)
+	assert.Equal(t, hubImg.Digest, img.Digest)
+
+	// the local copy is kept unless the policy is Always
+	updated, _ := m.AddToHub("ubuntu", []byte("v2"))
+	img, _ = types.NewImage("ubuntu")
+	rc, err = m.Pull(ctx, img, types.PullPolicyIfNotPresent)
+	drain(t, rc, err)
+	assert.Equal(t, hubImg.Digest, img.Digest)
+	rc, err = m.Pull(ctx, img, types.PullPolicyAlways)
+	drain(t, rc, err)
+	assert.Equal(t, updated.Digest, img.Digest)
+
+	pinned, _ := types.NewImage("ubuntu@sha256:" + hubImg.Digest)
+	_, err = m.Pull(ctx, pinned, types.PullPolicyAlways)
+	assert.ErrorIs(t, err, types.ErrDigestMismatch)
+}
+
+func TestPullPlatform(t *testing.T) {
+	ctx := context.Background()
+	m := NewManager("")
+	fname := filepath.Join(t.TempDir(), "disk.img")
+	assert.Nil(t, os.WriteFile(fname, []byte("arm"), 0600))
+	img, _ := types.NewImage("ubuntu:22.04")
+	img.Platform = "linux/arm64"
+	_, err := m.PrepareContext(ctx, fname, img)
+	assert.ErrorContains(t, err, "multi-arch images aren't supported")
+	img.Platform, img.OS.Arch = "", "arm64"
+	rc, err := m.PrepareContext(ctx, fname, img)
+	drain(t, rc, err)
+	assert.Equal(t, "22.04", img.Tag)
+	rc, err = m.Push(ctx, img, false)
+	drain(t, rc, err)
+	assert.Nil(t, m.RemoveLocal(ctx, img))
+
+	img, _ = types.NewImage("ubuntu:22.04")
+	img.Platform = "linux/riscv64"
+	_, err = m.Pull(ctx, img, types.PullPolicyAlways)
+	assert.ErrorIs(t, err, types.ErrImageNotFound)
+	images, _ := m.ListLocalImages(ctx, "")
+	assert.Empty(t, images)
+
+	img.Platform = "linux/aarch64"
+	rc, err = m.Pull(ctx, img, types.PullPolicyAlways)
+	drain(t, rc, err)
+	assert.Equal(t, "22.04", img.Tag)
+	assert.Equal(t, "arm64", img.OS.Arch)
+}
+
+func TestUnavailable(t *testing.T) {
+	m := NewManager("")
+	m.SetUnavailable(errors.New("network is down"))
+	_, err := m.ListLocalImages(context.Background(), "")
+	assert.ErrorIs(t, err, types.ErrUnavailable)
+	report, err := m.CheckHealth(context.Background())
+	assert.ErrorIs(t, err, types.ErrUnavailable)
+	assert.False(t, report.Healthy())
+
+	m.SetUnavailable(nil)
+	_, err = m.CheckHealth(context.Background())
+	assert.Nil(t, err)
+	_, err = m.LoadImage(context.Background(), "invalid//name")
+	assert.ErrorIs(t, err, types.ErrInvalidImageName)
+}
+
+func TestConformance(t *testing.T) {
+	conformance.Run(t, conformance.Config{
+		NewManager: func(t *testing.T) vmimage.Manager { return NewManager(t.TempDir()) },
+	})
+}
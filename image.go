@@ -7,13 +7,31 @@ import (
 	"github.com/yuyang0/vmimage/types"
 )
 
+// Manager is implemented by every image backend.
 type Manager interface {
 	ListLocalImages(ctx context.Context, user string) ([]*types.Image, error)
 	LoadImage(ctx context.Context, imgName string) (*types.Image, error) // create image object and pull the image to local
 
 	Prepare(fname string, img *types.Image) (io.ReadCloser, error)
+	// PrepareContext is Prepare, aborting downloads and builds once ctx is done
+	PrepareContext(ctx context.Context, fname string, img *types.Image) (io.ReadCloser, error)
 	Pull(ctx context.Context, img *types.Image, pullPolicy types.PullPolicy) (io.ReadCloser, error)
 	Push(ctx context.Context, img *types.Image, force bool) (io.ReadCloser, error)
 	RemoveLocal(ctx context.Context, img *types.Image) error
-	CheckHealth(ctx context.Context) error
+	CheckHealth(ctx context.Context) (*types.HealthReport, error)
+}
+
+// RemoteLister is implemented by the backends which can list the images of
+// their registry or hub, with their digests, without pulling them.
+type RemoteLister interface {
+	ListRemoteImages(ctx context.Context, user string) ([]*types.Image, error)
+}
+
+// Pruner is implemented by the backends which keep image files apart from
+// their images, the files may outlive the images removed by force or
+// outside of vmimage.
+type Pruner interface {
+	// PruneLocal removes the files whose image is gone, except the files
+	// listed in keep
+	PruneLocal(ctx context.Context, keep []string) error
 }
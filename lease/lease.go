@@ -0,0 +1,315 @@
+// Package lease records which owners, e.g. VMs, use an image so that it
+// isn't removed under them. Leases are kept in a JSON file shared by every
+// process using the same path.
+package lease
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/yuyang0/vmimage"
+	"github.com/yuyang0/vmimage/types"
+)
+
+type Lease struct {
+	Image string `json:"image"`
+	Owner string `json:"owner"`
+	// File is the LocalPath of the image when the lease was acquired, Prune
+	// keeps it even once the image is gone
+	File    string    `json:"file,omitempty"`
+	Created time.Time `json:"created"`
+}
+
+// Store keeps the leases in a file, it is read and replaced under an flock
+// of fname.lock so that processes sharing the file see each other's leases,
+// on platforms without flock only the stores of one process are serialized.
+// The file is replaced atomically, a crash never leaves it half written.
+type Store struct {
+	fname string
+}
+
+// NewStore returns a store backed by fname, the file, its lock and their
+// directory are created by the first Acquire.
+func NewStore(fname string) *Store {
+	return &Store{fname: fname}
+}
+
+// Acquire leases img to owner, acquiring a lease twice only records the
+// LocalPath of img if the lease has none.
+func (s *Store) Acquire(img *types.Image, owner string) error {
+	if owner == "" {
+		return errors.New("lease owner should not be empty")
+	}
+	return s.update(func(leases []Lease) []Lease {
+		name := img.Fullname()
+		for idx, l := range leases {
+			if l.Image == name && l.Owner == owner {
+				if l.File == "" {
+					leases[idx].File = img.LocalPath
+				}
+				return leases
+			}
+		}
+		return append(leases, Lease{Image: name, Owner: owner, File: img.LocalPath, Created: time.Now()})
+	})
+}
+
+// Release drops the lease of owner on img, if any.
+func (s *Store) Release(img *types.Image, owner string) error {
+	return s.update(func(leases []Lease) []Lease {
+		name := img.Fullname()
+		ans := leases[:0]
+		for _, l := range leases {
+			if l.Image != name || l.Owner != owner {
+				ans = append(ans, l)
+			}
+		}
+		return ans
+	})
+}
+
+// Leases returns the leases on img, all the leases when img is nil.
+func (s *Store) Leases(img *types.Image) ([]Lease, error) {
+	var ans []Lease
+	err := s.withLock(false, func() error {
+		leases, err := s.read()
+		for _, l := range leases {
+			if img == nil || l.Image == img.Fullname() {
+				ans = append(ans, l)
+			}
+		}
+		return err
+	})
+	return ans, err
+}
+
+// Prune runs the PruneLocal of p while no lease can be acquired, the files
+// of the leases are kept.
+func (s *Store) Prune(ctx context.Context, p vmimage.Pruner) error {
+	return s.withLock(true, func() error {
+		leases, err := s.read()
+		if err != nil {
+			return err
+		}
+		var keep []string
+		for _, l := range leases {
+			if l.File != "" {
+				keep = append(keep, l.File)
+			}
+		}
+		return p.PruneLocal(ctx, keep)
+	})
+}
+
+// withoutLease runs fn while no lease can be acquired, it fails with
+// types.ErrConflict when img is leased.
+func (s *Store) withoutLease(img *types.Image, fn func() error) error {
+	return s.withOwners(img, func(owners []string) error {
+		if len(owners) > 0 {
+			return types.NewError(types.ErrConflict, fmt.Errorf("image %s is leased by %s", img.Fullname(), strings.Join(owners, ", ")))
+		}
+		return fn()
+	})
+}
+
+// withOwners runs fn with the owners of the leases on img while no lease
+// can be acquired.
+func (s *Store) withOwners(img *types.Image, fn func(owners []string) error) error {
+	return s.withLock(true, func() error {
+		leases, err := s.read()
+		if err != nil {
+			return err
+		}
+		var owners []string
+		for _, l := range leases {
+			if l.Image == img.Fullname() {
+				owners = append(owners, l.Owner)
+			}
+		}
+		return fn(owners)
+	})
+}
+
+func (s *Store) update(fn func([]Lease) []Lease) error {
+	return s.withLock(true, func() error {
+		leases, err := s.read()
+		if err != nil {
+			return err
+		}
+		leases = fn(leases)
+		sort.Slice(leases, func(i, j int) bool {
+			if leases[i].Image != leases[j].Image {
+				return leases[i].Image < leases[j].Image
+			}
+			return leases[i].Owner < leases[j].Owner
+		})
+		bs, err := json.MarshalIndent(leases, "", "  ")
+		if err != nil {
+			return err
+		}
+		return s.write(bs)
+	})
+}
+
+// write replaces the lease file with bs through a synced temporary file.
+func (s *Store) write(bs []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(s.fname), "."+filepath.Base(s.fname)+"-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if err := tmp.Chmod(0644); err != nil {
+		tmp.Close()
+		return err
+	}
+	if _, err := tmp.Write(bs); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), s.fname)
+}
+
+// withLock runs fn under a lock of the lock file, see lockFile. Shared locks
+// are taken on an existing lock file only, there are no leases without it.
+func (s *Store) withLock(exclusive bool, fn func() error) error {
+	flag := os.O_RDONLY
+	if exclusive {
+		flag = os.O_RDWR | os.O_CREATE
+		if err := os.MkdirAll(filepath.Dir(s.fname), 0755); err != nil {
+			return err
+		}
+	}
+	f, err := os.OpenFile(s.fname+".lock", flag, 0644)
+	if os.IsNotExist(err) {
+		return fn()
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	unlock, err := lockFile(f, exclusive)
+	if err != nil {
+		return errors.Wrapf(err, "failed to lock %s", s.fname)
+	}
+	defer unlock()
+	return fn()
+}
+
+func (s *Store) read() ([]Lease, error) {
+	bs, err := os.ReadFile(s.fname)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil || len(bs) == 0 {
+		return nil, err
+	}
+	var leases []Lease
+	if err := json.Unmarshal(bs, &leases); err != nil {
+		return nil, errors.Wrapf(err, "invalid lease file %s", s.fname)
+	}
+	return leases, nil
+}
+
+// Leaser manages leases next to a manager's images, it is implemented by
+// Manager and by the remote manager of a server using one.
+type Leaser interface {
+	AcquireLease(ctx context.Context, img *types.Image, owner string) error
+	ReleaseLease(ctx context.Context, img *types.Image, owner string) error
+	// Leases returns the leases on img, all the leases when img is nil
+	Leases(ctx context.Context, img *types.Image) ([]Lease, error)
+	// ForceRemoveLocal removes img even if it is leased
+	ForceRemoveLocal(ctx context.Context, img *types.Image) error
+}
+
+// Manager wraps another Manager and refuses to remove leased images.
+type Manager struct {
+	mgr   vmimage.Manager
+	store *Store
+}
+
+func NewManager(mgr vmimage.Manager, store *Store) *Manager {
+	return &Manager{
+		mgr:   mgr,
+		store: store,
+	}
+}
+
+func (m *Manager) ListLocalImages(ctx context.Context, user string) ([]*types.Image, error) {
+	return m.mgr.ListLocalImages(ctx, user)
+}
+
+func (m *Manager) LoadImage(ctx context.Context, imgName string) (*types.Image, error) {
+	return m.mgr.LoadImage(ctx, imgName)
+}
+
+// Prepare is PrepareContext without cancellation.
+func (m *Manager) Prepare(fname string, img *types.Image) (io.ReadCloser, error) {
+	return m.PrepareContext(context.Background(), fname, img)
+}
+
+func (m *Manager) PrepareContext(ctx context.Context, fname string, img *types.Image) (io.ReadCloser, error) {
+	return m.mgr.PrepareContext(ctx, fname, img)
+}
+
+func (m *Manager) Pull(ctx context.Context, img *types.Image, policy types.PullPolicy) (io.ReadCloser, error) {
+	return m.mgr.Pull(ctx, img, policy)
+}
+
+func (m *Manager) Push(ctx context.Context, img *types.Image, force bool) (io.ReadCloser, error) {
+	return m.mgr.Push(ctx, img, force)
+}
+
+// RemoveLocal fails with types.ErrConflict when img is leased, no lease
+// can be acquired until the removal is over.
+func (m *Manager) RemoveLocal(ctx context.Context, img *types.Image) error {
+	return m.store.withoutLease(img, func() error {
+		return m.mgr.RemoveLocal(ctx, img)
+	})
+}
+
+// ForceRemoveLocal removes img even if it is leased, the leases are kept
+// and so is the file of a leased image, see types.WithKeepFiles.
+func (m *Manager) ForceRemoveLocal(ctx context.Context, img *types.Image) error {
+	return m.store.withOwners(img, func(owners []string) error {
+		if len(owners) > 0 {
+			ctx = types.WithKeepFiles(ctx)
+		}
+		return m.mgr.RemoveLocal(ctx, img)
+	})
+}
+
+func (m *Manager) AcquireLease(_ context.Context, img *types.Image, owner string) error {
+	return m.store.Acquire(img, owner)
+}
+
+func (m *Manager) ReleaseLease(_ context.Context, img *types.Image, owner string) error {
+	return m.store.Release(img, owner)
+}
+
+func (m *Manager) Leases(_ context.Context, img *types.Image) ([]Lease, error) {
+	return m.store.Leases(img)
+}
+
+func (m *Manager) CheckHealth(ctx context.Context) (*types.HealthReport, error) {
+	return m.mgr.CheckHealth(ctx)
+}
+
+// Store returns the store the manager checks.
+func (m *Manager) Store() *Store {
+	return m.store
+}
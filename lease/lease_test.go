@@ -0,0 +1,144 @@
+package lease
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/yuyang0/vmimage/fake"
+	"github.com/yuyang0/vmimage/mocks"
+	"github.com/yuyang0/vmimage/types"
+)
+
+func TestStore(t *testing.T) {
+	fname := filepath.Join(t.TempDir(), "leases", "leases.json")
+	store := NewStore(fname)
+	img, _ := types.NewImage("user1/ubuntu:22.04")
+	other, _ := types.NewImage("centos")
+
+	leases, err := store.Leases(img)
+	assert.Nil(t, err)
+	assert.Empty(t, leases)
+
+	assert.Nil(t, store.Acquire(img, "vm1"))
+	assert.Nil(t, store.Acquire(img, "vm1"))
+	assert.Nil(t, store.Acquire(img, "vm2"))
+	assert.Nil(t, store.Acquire(other, "vm1"))
+	assert.Error(t, store.Acquire(img, ""))
+
+	// another store on the same file sees the leases
+	leases, err = NewStore(fname).Leases(img)
+	assert.Nil(t, err)
+	assert.Len(t, leases, 2)
+	assert.Equal(t, "vm1", leases[0].Owner)
+	assert.Equal(t, "user1/ubuntu:22.04", leases[0].Image)
+
+	assert.Nil(t, store.Release(img, "vm1"))
+	assert.Nil(t, store.Release(img, "unknown"))
+	leases, err = store.Leases(nil)
+	assert.Nil(t, err)
+	assert.Len(t, leases, 2)
+
+	// the file is replaced, only it and its lock are left in the directory
+	entries, err := os.ReadDir(filepath.Dir(fname))
+	assert.Nil(t, err)
+	assert.Len(t, entries, 2)
+	assert.FileExists(t, fname+".lock")
+
+	assert.Nil(t, os.WriteFile(fname, []byte("garbage"), 0600))
+	_, err = store.Leases(img)
+	assert.ErrorContains(t, err, "invalid lease file")
+}
+
+func TestManagerRefusesLeased(t *testing.T) {
+	ctx := context.Background()
+	inner := fake.NewManager("")
+	fname := filepath.Join(t.TempDir(), "disk.img")
+	assert.Nil(t, os.WriteFile(fname, []byte("disk"), 0600))
+	store := NewStore(filepath.Join(t.TempDir(), "leases.json"))
+	m := NewManager(inner, store)
+
+	img, _ := types.NewImage("ubuntu")
+	rc, err := m.PrepareContext(ctx, fname, img)
+	assert.Nil(t, err)
+	rc.Close()
+	assert.Nil(t, store.Acquire(img, "vm1"))
+
+	err = m.RemoveLocal(ctx, img)
+	assert.ErrorIs(t, err, types.ErrConflict)
+	assert.ErrorContains(t, err, "leased by vm1")
+
+	assert.Nil(t, store.Release(img, "vm1"))
+	assert.Nil(t, m.RemoveLocal(ctx, img))
+
+	rc, _ = m.PrepareContext(ctx, fname, img)
+	rc.Close()
+	assert.Nil(t, store.Acquire(img, "vm2"))
+	assert.Nil(t, m.ForceRemoveLocal(ctx, img))
+	images, _ := m.ListLocalImages(ctx, "")
+	assert.Empty(t, images)
+}
+
+func TestAcquireWaitsForRemoval(t *testing.T) {
+	inner := &mocks.Manager{}
+	removing, done := make(chan struct{}), make(chan struct{})
+	inner.On("RemoveLocal", mock.Anything, mock.Anything).Run(func(mock.Arguments) {
+		close(removing)
+		<-done
+	}).Return(nil)
+	store := NewStore(filepath.Join(t.TempDir(), "leases.json"))
+	m := NewManager(inner, store)
+	img, _ := types.NewImage("ubuntu")
+
+	removed := make(chan error, 1)
+	go func() { removed <- m.RemoveLocal(context.Background(), img) }()
+	<-removing
+	acquired := make(chan error, 1)
+	go func() { acquired <- NewStore(store.fname).Acquire(img, "vm1") }()
+	select {
+	case <-acquired:
+		t.Fatal("lease acquired during the removal")
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(done)
+	assert.Nil(t, <-removed)
+	assert.Nil(t, <-acquired)
+	assert.ErrorIs(t, m.RemoveLocal(context.Background(), img), types.ErrConflict)
+}
+
+type pruner struct {
+	keep []string
+}
+
+func (p *pruner) PruneLocal(_ context.Context, keep []string) error {
+	p.keep = keep
+	return nil
+}
+
+func TestForceRemoveKeepsFiles(t *testing.T) {
+	inner := &mocks.Manager{}
+	var kept []bool
+	inner.On("RemoveLocal", mock.Anything, mock.Anything).Run(func(args mock.Arguments) {
+		kept = append(kept, types.KeepFiles(args.Get(0).(context.Context)))
+	}).Return(nil)
+	store := NewStore(filepath.Join(t.TempDir(), "leases.json"))
+	m := NewManager(inner, store)
+	img, _ := types.NewImage("ubuntu")
+	img.LocalPath = "/var/lib/vmimage/docker/abc.img"
+
+	assert.Nil(t, m.ForceRemoveLocal(context.Background(), img))
+	assert.Nil(t, store.Acquire(img, "vm1"))
+	assert.Nil(t, m.ForceRemoveLocal(context.Background(), img))
+	assert.Equal(t, []bool{false, true}, kept)
+
+	// the file of the lease is kept by Prune, even once the image is gone
+	other, _ := types.NewImage("centos")
+	assert.Nil(t, store.Acquire(other, "vm1"))
+	p := &pruner{}
+	assert.Nil(t, store.Prune(context.Background(), p))
+	assert.Equal(t, []string{img.LocalPath}, p.keep)
+}
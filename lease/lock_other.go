@@ -0,0 +1,37 @@
+//go:build !unix
+
+package lease
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+var (
+	locksMu sync.Mutex
+	locks   = map[string]*sync.RWMutex{}
+)
+
+// lockFile only locks f against the other stores of this process, files
+// aren't locked on this platform so processes sharing a lease file may
+// lose each other's updates.
+func lockFile(f *os.File, exclusive bool) (unlock func(), err error) {
+	name, err := filepath.Abs(f.Name())
+	if err != nil {
+		return nil, err
+	}
+	locksMu.Lock()
+	mu := locks[name]
+	if mu == nil {
+		mu = &sync.RWMutex{}
+		locks[name] = mu
+	}
+	locksMu.Unlock()
+	if exclusive {
+		mu.Lock()
+		return mu.Unlock, nil
+	}
+	mu.RLock()
+	return mu.RUnlock, nil
+}
@@ -0,0 +1,23 @@
+//go:build unix
+
+package lease
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// lockFile takes an flock of f, which is released by unlock.
+func lockFile(f *os.File, exclusive bool) (unlock func(), err error) {
+	how := unix.LOCK_SH
+	if exclusive {
+		how = unix.LOCK_EX
+	}
+	if err := unix.Flock(int(f.Fd()), how); err != nil {
+		return nil, err
+	}
+	return func() {
+		_ = unix.Flock(int(f.Fd()), unix.LOCK_UN)
+	}, nil
+}
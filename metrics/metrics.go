@@ -0,0 +1,178 @@
+package metrics
+
+import (
+	"context"
+	"errors"
+	"io"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/yuyang0/vmimage"
+	"github.com/yuyang0/vmimage/types"
+	"github.com/yuyang0/vmimage/utils"
+)
+
+const (
+	resultSuccess = "success"
+	resultError   = "error"
+)
+
+var (
+	operationsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "vmimage",
+		Name:      "operations_total",
+		Help:      "Number of image operations by backend, operation and result.",
+	}, []string{"backend", "operation", "result"})
+
+	operationDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "vmimage",
+		Name:      "operation_duration_seconds",
+		Help:      "Duration of image operations, including draining the returned stream.",
+		Buckets:   []float64{0.1, 0.5, 1, 5, 15, 30, 60, 120, 300, 600, 1800},
+	}, []string{"backend", "operation", "result"})
+
+	transferredBytes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "vmimage",
+		Name:      "transferred_bytes_total",
+		Help:      "Bytes transferred by successful pulls, pushes and prepares.",
+	}, []string{"backend", "operation"})
+
+	localStore = newStoreCollector()
+
+	replicationLastSync = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "vmimage",
+		Name:      "replication_last_sync_timestamp_seconds",
+		Help:      "Start time of the last replication run which left every image in sync, by rule.",
+	}, []string{"rule"})
+
+	replicationOutOfSync = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "vmimage",
+		Name:      "replication_out_of_sync_images",
+		Help:      "Number of images which failed to replicate in the last run, by rule.",
+	}, []string{"rule"})
+)
+
+// ObserveReplication records the outcome of a replication run of rule.
+func ObserveReplication(rule string, syncedAt time.Time, failed int) {
+	if !syncedAt.IsZero() {
+		replicationLastSync.WithLabelValues(rule).Set(float64(syncedAt.Unix()))
+	}
+	replicationOutOfSync.WithLabelValues(rule).Set(float64(failed))
+}
+
+// Register adds the vmimage collectors to reg, it is safe to call it more than once.
+func Register(reg prometheus.Registerer) error {
+	for _, c := range []prometheus.Collector{
+		operationsTotal, operationDuration, transferredBytes, localStore,
+		replicationLastSync, replicationOutOfSync,
+	} {
+		if err := reg.Register(c); err != nil {
+			var are prometheus.AlreadyRegisteredError
+			if !errors.As(err, &are) {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Manager wraps another Manager and records metrics for its operations.
+type Manager struct {
+	mgr     vmimage.Manager
+	backend string
+}
+
+// NewManager wraps mgr, the local store of mgr is reported when the metrics
+// are scraped, replacing the manager previously created for backend.
+func NewManager(mgr vmimage.Manager, backend string) *Manager {
+	localStore.add(backend, mgr)
+	return &Manager{
+		mgr:     mgr,
+		backend: backend,
+	}
+}
+
+func (m *Manager) ListLocalImages(ctx context.Context, user string) ([]*types.Image, error) {
+	images, err := m.mgr.ListLocalImages(ctx, user)
+	if err == nil && user == "" {
+		localStore.set(m.backend, images)
+	}
+	return images, err
+}
+
+func (m *Manager) LoadImage(ctx context.Context, imgName string) (*types.Image, error) {
+	start := time.Now()
+	img, err := m.mgr.LoadImage(ctx, imgName)
+	m.observe("load", start, -1, img, err)
+	return img, err
+}
+
+// Prepare is PrepareContext without cancellation.
+func (m *Manager) Prepare(fname string, img *types.Image) (io.ReadCloser, error) {
+	return m.PrepareContext(context.Background(), fname, img)
+}
+
+func (m *Manager) PrepareContext(ctx context.Context, fname string, img *types.Image) (io.ReadCloser, error) {
+	start := time.Now()
+	rc, err := m.mgr.PrepareContext(ctx, fname, img)
+	return m.instrumentStream("prepare", start, img, rc, err)
+}
+
+func (m *Manager) Pull(ctx context.Context, img *types.Image, policy types.PullPolicy) (io.ReadCloser, error) {
+	start := time.Now()
+	rc, err := m.mgr.Pull(ctx, img, policy)
+	return m.instrumentStream("pull", start, img, rc, err)
+}
+
+func (m *Manager) Push(ctx context.Context, img *types.Image, force bool) (io.ReadCloser, error) {
+	start := time.Now()
+	rc, err := m.mgr.Push(ctx, img, force)
+	return m.instrumentStream("push", start, img, rc, err)
+}
+
+func (m *Manager) RemoveLocal(ctx context.Context, img *types.Image) error {
+	start := time.Now()
+	err := m.mgr.RemoveLocal(ctx, img)
+	m.observe("remove", start, 0, nil, err)
+	return err
+}
+
+func (m *Manager) CheckHealth(ctx context.Context) (*types.HealthReport, error) {
+	return m.mgr.CheckHealth(ctx)
+}
+
+// instrumentStream defers the observation of streaming operations until the
+// caller has drained or closed the returned stream, because that's when the
+// backend actually finishes its work. A stream closed before its end or
+// carrying an errorDetail message is recorded as an error.
+func (m *Manager) instrumentStream(
+	op string, start time.Time, img *types.Image, rc io.ReadCloser, err error,
+) (io.ReadCloser, error) {
+	if err != nil {
+		m.observe(op, start, 0, nil, err)
+		return rc, err
+	}
+	return utils.NewNotifyReadCloser(rc, func(transferred int64, err error) {
+		m.observe(op, start, transferred, img, err)
+	}), nil
+}
+
+// observe records an operation, transferred is the number of bytes it
+// moved, -1 when the backend doesn't report it and the size of img is used.
+func (m *Manager) observe(op string, start time.Time, transferred int64, img *types.Image, err error) {
+	result := resultSuccess
+	if err != nil {
+		result = resultError
+	}
+	operationsTotal.WithLabelValues(m.backend, op, result).Inc()
+	operationDuration.WithLabelValues(m.backend, op, result).Observe(time.Since(start).Seconds())
+	if err != nil {
+		return
+	}
+	if transferred < 0 && img != nil {
+		transferred = img.Size
+	}
+	if transferred > 0 {
+		transferredBytes.WithLabelValues(m.backend, op).Add(float64(transferred))
+	}
+}
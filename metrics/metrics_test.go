@@ -0,0 +1,139 @@
+package metrics
+
+import (
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/yuyang0/vmimage/mocks"
+	"github.com/yuyang0/vmimage/types"
+)
+
+func TestRegisterTwice(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	assert.Nil(t, Register(reg))
+	assert.Nil(t, Register(reg))
+}
+
+func TestPullMetrics(t *testing.T) {
+	inner := &mocks.Manager{}
+	m := NewManager(inner, "test-pull")
+	img := &types.Image{Name: "ubuntu", Tag: "latest", Size: 1024}
+	inner.On("Pull", mock.Anything, img, types.PullPolicy(types.PullPolicyAlways)).
+		Return(io.NopCloser(strings.NewReader("progress")), nil)
+
+	rc, err := m.Pull(context.Background(), img, types.PullPolicyAlways)
+	assert.Nil(t, err)
+	// nothing is recorded until the stream is drained
+	assert.Equal(t, 0.0, testutil.ToFloat64(operationsTotal.WithLabelValues("test-pull", "pull", resultSuccess)))
+
+	_, err = io.ReadAll(rc)
+	assert.Nil(t, err)
+	assert.Nil(t, rc.Close())
+
+	assert.Equal(t, 1.0, testutil.ToFloat64(operationsTotal.WithLabelValues("test-pull", "pull", resultSuccess)))
+	// the stream has no progress, so the size of the image is used
+	assert.Equal(t, 1024.0, testutil.ToFloat64(transferredBytes.WithLabelValues("test-pull", "pull")))
+	inner.AssertNotCalled(t, "ListLocalImages", mock.Anything, mock.Anything)
+}
+
+func TestTransferredBytesFromProgress(t *testing.T) {
+	inner := &mocks.Manager{}
+	m := NewManager(inner, "test-progress")
+	// docker doesn't fill in the size when pushing
+	img := &types.Image{Name: "ubuntu", Tag: "latest"}
+	stream := `{"status":"Pushing","progressDetail":{"current":512,"total":2048},"id":"a"}
+{"status":"Pushing","progressDetail":{"current":2048,"total":2048},"id":"a"}
+{"status":"Layer already exists","id":"b"}
+`
+	inner.On("Push", mock.Anything, img, false).Return(io.NopCloser(strings.NewReader(stream)), nil)
+
+	rc, err := m.Push(context.Background(), img, false)
+	assert.Nil(t, err)
+	_, err = io.ReadAll(rc)
+	assert.Nil(t, err)
+	assert.Equal(t, 2048.0, testutil.ToFloat64(transferredBytes.WithLabelValues("test-progress", "push")))
+}
+
+func TestStoreCollector(t *testing.T) {
+	inner := &mocks.Manager{}
+	inner.On("ListLocalImages", mock.Anything, "").
+		Return([]*types.Image{{Name: "ubuntu", Size: 1024}, {Name: "centos", Size: 10, ActualSize: 20}}, nil).Once()
+	c := newStoreCollector()
+	c.add("test-store", inner)
+
+	expected := `
+# HELP vmimage_local_images Number of images in the local store.
+# TYPE vmimage_local_images gauge
+vmimage_local_images{backend="test-store"} 2
+# HELP vmimage_local_store_bytes Total size of images in the local store.
+# TYPE vmimage_local_store_bytes gauge
+vmimage_local_store_bytes{backend="test-store"} 1044
+`
+	// the first scrape starts listing the store in the background
+	assert.Eventually(t, func() bool {
+		return testutil.CollectAndCompare(c, strings.NewReader(expected)) == nil
+	}, time.Second, 5*time.Millisecond)
+	// scrapes in a row reuse the listing
+	assert.Nil(t, testutil.CollectAndCompare(c, strings.NewReader(expected)))
+	inner.AssertNumberOfCalls(t, "ListLocalImages", 1)
+
+	// a slow listing doesn't block scrapes
+	slow, done := &mocks.Manager{}, make(chan struct{})
+	defer close(done)
+	slow.On("ListLocalImages", mock.Anything, "").Run(func(mock.Arguments) { <-done }).Return(nil, nil)
+	c.add("test-store", slow)
+	assert.Nil(t, testutil.CollectAndCompare(c, strings.NewReader("")))
+	assert.Nil(t, testutil.CollectAndCompare(c, strings.NewReader("")))
+}
+
+func TestFailedOperationMetrics(t *testing.T) {
+	inner := &mocks.Manager{}
+	m := NewManager(inner, "test-fail")
+	img := &types.Image{Name: "ubuntu", Tag: "latest", Size: 1024}
+	inner.On("Push", mock.Anything, img, false).Return(nil, errors.New("unauthorized"))
+	inner.On("RemoveLocal", mock.Anything, img).Return(errors.New("in use"))
+
+	_, err := m.Push(context.Background(), img, false)
+	assert.NotNil(t, err)
+	err = m.RemoveLocal(context.Background(), img)
+	assert.NotNil(t, err)
+
+	assert.Equal(t, 1.0, testutil.ToFloat64(operationsTotal.WithLabelValues("test-fail", "push", resultError)))
+	assert.Equal(t, 1.0, testutil.ToFloat64(operationsTotal.WithLabelValues("test-fail", "remove", resultError)))
+	assert.Equal(t, 0.0, testutil.ToFloat64(transferredBytes.WithLabelValues("test-fail", "push")))
+	inner.AssertNotCalled(t, "ListLocalImages", mock.Anything, mock.Anything)
+}
+
+func TestFailedStreamMetrics(t *testing.T) {
+	inner := &mocks.Manager{}
+	m := NewManager(inner, "test-stream")
+	img := &types.Image{Name: "ubuntu", Tag: "latest", Size: 1024}
+	failed := `{"errorDetail":{"message":"manifest unknown"},"error":"manifest unknown"}` + "\n"
+	inner.On("Pull", mock.Anything, img, types.PullPolicy(types.PullPolicyAlways)).
+		Return(io.NopCloser(strings.NewReader(failed)), nil).Once()
+	inner.On("Pull", mock.Anything, img, types.PullPolicy(types.PullPolicyAlways)).
+		Return(io.NopCloser(strings.NewReader("{}\n")), nil).Once()
+
+	// the backend reported an error in the stream
+	rc, err := m.Pull(context.Background(), img, types.PullPolicyAlways)
+	assert.Nil(t, err)
+	_, err = io.ReadAll(rc)
+	assert.Nil(t, err)
+	assert.Nil(t, rc.Close())
+	// the caller gave up before the end
+	rc, err = m.Pull(context.Background(), img, types.PullPolicyAlways)
+	assert.Nil(t, err)
+	assert.Nil(t, rc.Close())
+
+	assert.Equal(t, 2.0, testutil.ToFloat64(operationsTotal.WithLabelValues("test-stream", "pull", resultError)))
+	assert.Equal(t, 0.0, testutil.ToFloat64(operationsTotal.WithLabelValues("test-stream", "pull", resultSuccess)))
+	inner.AssertNotCalled(t, "ListLocalImages", mock.Anything, mock.Anything)
+}
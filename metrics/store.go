@@ -0,0 +1,133 @@
+package metrics
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/yuyang0/vmimage"
+	"github.com/yuyang0/vmimage/types"
+)
+
+const (
+	// storeRefreshInterval is how often the local stores are listed
+	storeRefreshInterval = 30 * time.Second
+	storeListTimeout     = 10 * time.Second
+)
+
+var (
+	localImagesDesc = prometheus.NewDesc("vmimage_local_images",
+		"Number of images in the local store.", []string{"backend"}, nil)
+	localStoreBytesDesc = prometheus.NewDesc("vmimage_local_store_bytes",
+		"Total size of images in the local store.", []string{"backend"}, nil)
+)
+
+// storeCollector reports the local store of every instrumented backend.
+// Once scraped, each store is listed in the background every interval,
+// scrapes report the last listing and never wait for one. The last values
+// are kept when listing fails.
+type storeCollector struct {
+	interval time.Duration
+
+	mu     sync.Mutex
+	stores map[string]*store
+}
+
+type store struct {
+	mgr vmimage.Manager
+	// started is set once the refresh goroutine runs, stop ends it when
+	// the store is replaced
+	started   bool
+	stop      chan struct{}
+	refreshed time.Time
+	images    int
+	bytes     int64
+}
+
+func newStoreCollector() *storeCollector {
+	return &storeCollector{interval: storeRefreshInterval, stores: map[string]*store{}}
+}
+
+func (c *storeCollector) add(backend string, mgr vmimage.Manager) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if old := c.stores[backend]; old != nil {
+		close(old.stop)
+	}
+	c.stores[backend] = &store{mgr: mgr, stop: make(chan struct{})}
+}
+
+// set records a listing of the whole store made by a caller.
+func (c *storeCollector) set(backend string, images []*types.Image) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if st := c.stores[backend]; st != nil {
+		st.update(images)
+	}
+}
+
+func (c *storeCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- localImagesDesc
+	ch <- localStoreBytesDesc
+}
+
+func (c *storeCollector) Collect(ch chan<- prometheus.Metric) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for backend, st := range c.stores {
+		if !st.started {
+			st.started = true
+			go c.refreshLoop(st)
+		}
+		if st.refreshed.IsZero() {
+			continue
+		}
+		ch <- prometheus.MustNewConstMetric(localImagesDesc, prometheus.GaugeValue, float64(st.images), backend)
+		ch <- prometheus.MustNewConstMetric(localStoreBytesDesc, prometheus.GaugeValue, float64(st.bytes), backend)
+	}
+}
+
+// refreshLoop lists st every interval until it is replaced, listings made
+// by callers in the meantime postpone it.
+func (c *storeCollector) refreshLoop(st *store) {
+	ticker := time.NewTicker(c.interval)
+	defer ticker.Stop()
+	for {
+		c.mu.Lock()
+		due := time.Since(st.refreshed) >= c.interval
+		c.mu.Unlock()
+		if due {
+			c.refresh(st)
+		}
+		select {
+		case <-st.stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (c *storeCollector) refresh(st *store) {
+	ctx, cancel := context.WithTimeout(context.Background(), storeListTimeout)
+	defer cancel()
+	images, err := st.mgr.ListLocalImages(ctx, "")
+	if err != nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	st.update(images)
+}
+
+func (st *store) update(images []*types.Image) {
+	var total int64
+	for _, img := range images {
+		if img.ActualSize > 0 {
+			total += img.ActualSize
+		} else {
+			total += img.Size
+		}
+	}
+	st.refreshed, st.images, st.bytes = time.Now(), len(images), total
+}
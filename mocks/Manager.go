@@ -1,4 +1,4 @@
-// Code generated by mockery v2.42.0. DO NOT EDIT.
+// Code generated by mockery v2.53.7. DO NOT EDIT.
 
 package mocks
 
@@ -17,21 +17,33 @@ type Manager struct {
 }
 
 // CheckHealth provides a mock function with given fields: ctx
-func (_m *Manager) CheckHealth(ctx context.Context) error {
+func (_m *Manager) CheckHealth(ctx context.Context) (*types.HealthReport, error) {
 	ret := _m.Called(ctx)
 
 	if len(ret) == 0 {
 		panic("no return value specified for CheckHealth")
 	}
 
-	var r0 error
-	if rf, ok := ret.Get(0).(func(context.Context) error); ok {
+	var r0 *types.HealthReport
+	var r1 error
+	if rf, ok := ret.Get(0).(func(context.Context) (*types.HealthReport, error)); ok {
+		return rf(ctx)
+	}
+	if rf, ok := ret.Get(0).(func(context.Context) *types.HealthReport); ok {
 		r0 = rf(ctx)
 	} else {
-		r0 = ret.Error(0)
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).(*types.HealthReport)
+		}
 	}
 
-	return r0
+	if rf, ok := ret.Get(1).(func(context.Context) error); ok {
+		r1 = rf(ctx)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
 }
 
 // ListLocalImages provides a mock function with given fields: ctx, user
@@ -124,6 +136,36 @@ func (_m *Manager) Prepare(fname string, img *types.Image) (io.ReadCloser, error
 	return r0, r1
 }
 
+// PrepareContext provides a mock function with given fields: ctx, fname, img
+func (_m *Manager) PrepareContext(ctx context.Context, fname string, img *types.Image) (io.ReadCloser, error) {
+	ret := _m.Called(ctx, fname, img)
+
+	if len(ret) == 0 {
+		panic("no return value specified for PrepareContext")
+	}
+
+	var r0 io.ReadCloser
+	var r1 error
+	if rf, ok := ret.Get(0).(func(context.Context, string, *types.Image) (io.ReadCloser, error)); ok {
+		return rf(ctx, fname, img)
+	}
+	if rf, ok := ret.Get(0).(func(context.Context, string, *types.Image) io.ReadCloser); ok {
+		r0 = rf(ctx, fname, img)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).(io.ReadCloser)
+		}
+	}
+
+	if rf, ok := ret.Get(1).(func(context.Context, string, *types.Image) error); ok {
+		r1 = rf(ctx, fname, img)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
 // Pull provides a mock function with given fields: ctx, img, pullPolicy
 func (_m *Manager) Pull(ctx context.Context, img *types.Image, pullPolicy types.PullPolicy) (io.ReadCloser, error) {
 	ret := _m.Called(ctx, img, pullPolicy)
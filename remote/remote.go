@@ -0,0 +1,248 @@
+// Package remote implements vmimage.Manager by forwarding every call to a
+// vmimage server, see package server for the API.
+package remote
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/docker/docker/pkg/jsonmessage"
+	"github.com/pkg/errors"
+	"github.com/yuyang0/vmimage/lease"
+	"github.com/yuyang0/vmimage/server"
+	"github.com/yuyang0/vmimage/types"
+	"github.com/yuyang0/vmimage/utils"
+)
+
+type Manager struct {
+	cfg        *types.Config
+	baseURL    string
+	httpClient *http.Client
+}
+
+func NewManager(cfg *types.Config) (*Manager, error) {
+	httpClient, err := cfg.Remote.TLS.HTTPClient()
+	if err != nil {
+		return nil, err
+	}
+	baseURL, err := url.JoinPath(cfg.Remote.Addr, server.APIPrefix)
+	if err != nil {
+		return nil, err
+	}
+	return &Manager{
+		cfg:        cfg,
+		baseURL:    baseURL,
+		httpClient: httpClient,
+	}, nil
+}
+
+func (mgr *Manager) ListLocalImages(ctx context.Context, user string) ([]*types.Image, error) {
+	var images []*types.Image
+	err := mgr.call(ctx, http.MethodGet, "/images?user="+url.QueryEscape(user), nil, &images)
+	return images, err
+}
+
+func (mgr *Manager) LoadImage(ctx context.Context, imgName string) (*types.Image, error) {
+	img := &types.Image{}
+	if err := mgr.call(ctx, http.MethodPost, "/images/load", server.LoadRequest{Name: imgName}, img); err != nil {
+		return nil, err
+	}
+	return img, nil
+}
+
+// Prepare is PrepareContext without cancellation.
+func (mgr *Manager) Prepare(fname string, img *types.Image) (io.ReadCloser, error) {
+	return mgr.PrepareContext(context.Background(), fname, img)
+}
+
+// Prepare asks the server to prepare the image from fname, which is a path
+// on the server's host or an URL.
+func (mgr *Manager) PrepareContext(ctx context.Context, fname string, img *types.Image) (io.ReadCloser, error) {
+	return mgr.stream(ctx, "/images/prepare", server.PrepareRequest{File: fname, Image: img}, img)
+}
+
+func (mgr *Manager) Pull(ctx context.Context, img *types.Image, pullPolicy types.PullPolicy) (io.ReadCloser, error) {
+	return mgr.stream(ctx, "/images/pull", server.PullRequest{Image: img, Policy: pullPolicy}, img)
+}
+
+func (mgr *Manager) Push(ctx context.Context, img *types.Image, force bool) (io.ReadCloser, error) {
+	return mgr.stream(ctx, "/images/push", server.PushRequest{Image: img, Force: force}, img)
+}
+
+func (mgr *Manager) RemoveLocal(ctx context.Context, img *types.Image) error {
+	return mgr.call(ctx, http.MethodDelete, "/images/"+img.Reference(), nil, nil)
+}
+
+// ForceRemoveLocal removes img even if it is leased on the server.
+func (mgr *Manager) ForceRemoveLocal(ctx context.Context, img *types.Image) error {
+	return mgr.call(ctx, http.MethodDelete, "/images/"+img.Reference()+"?force=true", nil, nil)
+}
+
+// AcquireLease leases img to owner on the server, it fails when the
+// server's manager doesn't hold leases.
+func (mgr *Manager) AcquireLease(ctx context.Context, img *types.Image, owner string) error {
+	return mgr.call(ctx, http.MethodPost, "/leases", server.LeaseRequest{Name: img.Reference(), Owner: owner}, nil)
+}
+
+func (mgr *Manager) ReleaseLease(ctx context.Context, img *types.Image, owner string) error {
+	query := url.Values{"name": {img.Reference()}, "owner": {owner}}
+	return mgr.call(ctx, http.MethodDelete, "/leases?"+query.Encode(), nil, nil)
+}
+
+func (mgr *Manager) Leases(ctx context.Context, img *types.Image) ([]lease.Lease, error) {
+	path := "/leases"
+	if img != nil {
+		path += "?" + url.Values{"image": {img.Reference()}}.Encode()
+	}
+	var leases []lease.Lease
+	return leases, mgr.call(ctx, http.MethodGet, path, nil, &leases)
+}
+
+// CheckHealth returns the report of the server's backend.
+func (mgr *Manager) CheckHealth(ctx context.Context) (*types.HealthReport, error) {
+	resp, err := mgr.send(ctx, http.MethodGet, "/health", nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusServiceUnavailable {
+		return nil, responseError(resp)
+	}
+	report := &types.HealthReport{}
+	if err := json.NewDecoder(resp.Body).Decode(report); err != nil {
+		return nil, errors.Wrap(err, "invalid health report")
+	}
+	return report, report.Err()
+}
+
+// call sends a request and decodes the JSON response into out, if not nil.
+func (mgr *Manager) call(ctx context.Context, method, path string, body, out any) error {
+	resp, err := mgr.send(ctx, method, path, body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= http.StatusMultipleChoices {
+		return responseError(resp)
+	}
+	if out == nil {
+		return nil
+	}
+	return errors.Wrap(json.NewDecoder(resp.Body).Decode(out), "invalid response")
+}
+
+// stream starts a streaming operation, the returned stream applies the
+// result sent by the server to img before reporting EOF.
+func (mgr *Manager) stream(ctx context.Context, path string, body any, img *types.Image) (io.ReadCloser, error) {
+	resp, err := mgr.send(ctx, http.MethodPost, path, body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		return nil, responseError(resp)
+	}
+	return newResultStream(resp.Body, img), nil
+}
+
+func (mgr *Manager) send(ctx context.Context, method, path string, body any) (*http.Response, error) {
+	var reader io.Reader
+	if body != nil {
+		bs, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		reader = bytes.NewReader(bs)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, mgr.baseURL+path, reader)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if mgr.cfg.Remote.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+mgr.cfg.Remote.Token)
+	}
+	resp, err := mgr.httpClient.Do(req)
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		if utils.IsTransientNetError(err) {
+			return nil, types.NewError(types.ErrUnavailable, err)
+		}
+		return nil, err
+	}
+	return resp, nil
+}
+
+func responseError(resp *http.Response) error {
+	var errResp server.ErrorResponse
+	bs, _ := io.ReadAll(resp.Body)
+	if err := json.Unmarshal(bs, &errResp); err != nil || errResp.Error == "" {
+		errResp.Error = strings.TrimSpace(resp.Status + " " + string(bs))
+	}
+	if resp.StatusCode == http.StatusUnauthorized && errResp.Code == server.CodeUnauthenticated {
+		return server.ErrUnauthenticated
+	}
+	return server.ErrorFromStatus(resp.StatusCode, errResp.Error)
+}
+
+type resultStream struct {
+	*io.PipeReader
+	body io.ReadCloser
+}
+
+// newResultStream forwards the messages of body except for the server's
+// StreamResult, which is applied to img. An error message carrying a status
+// code fails the stream with the matching typed error once it has been
+// forwarded, so does the end of body before the StreamResult, the server
+// or the connection went away in the middle of the operation.
+func newResultStream(body io.ReadCloser, img *types.Image) io.ReadCloser {
+	pr, pw := io.Pipe()
+	go func() {
+		dec := json.NewDecoder(body)
+		done := false
+		for {
+			var raw json.RawMessage
+			if err := dec.Decode(&raw); err != nil {
+				if err == io.EOF {
+					err = nil
+					if !done {
+						err = errors.Wrap(io.ErrUnexpectedEOF, "stream ended without the server's result")
+					}
+				}
+				pw.CloseWithError(err)
+				return
+			}
+			var msg struct {
+				jsonmessage.JSONMessage
+				Aux *server.StreamResult `json:"aux,omitempty"`
+			}
+			if err := json.Unmarshal(raw, &msg); err == nil && msg.Aux != nil && msg.Aux.Image != nil {
+				*img = *msg.Aux.Image
+				done = true
+				continue
+			}
+			if _, err := pw.Write(append(raw, '\n')); err != nil {
+				return
+			}
+			if msg.Error != nil && msg.Error.Code != 0 {
+				pw.CloseWithError(server.ErrorFromStatus(msg.Error.Code, msg.Error.Message))
+				return
+			}
+		}
+	}()
+	return &resultStream{PipeReader: pr, body: body}
+}
+
+func (rs *resultStream) Close() error {
+	_ = rs.PipeReader.Close()
+	return rs.body.Close()
+}
@@ -0,0 +1,200 @@
+package remote
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/yuyang0/vmimage"
+	"github.com/yuyang0/vmimage/conformance"
+	"github.com/yuyang0/vmimage/fake"
+	"github.com/yuyang0/vmimage/lease"
+	"github.com/yuyang0/vmimage/mocks"
+	"github.com/yuyang0/vmimage/server"
+	"github.com/yuyang0/vmimage/types"
+	"github.com/yuyang0/vmimage/utils"
+)
+
+// newRemote returns a remote manager talking to a server of inner.
+func newRemote(t *testing.T, inner vmimage.Manager) *Manager {
+	s, err := server.New(inner, server.Options{Token: "secret", FileDirs: []string{os.TempDir()}})
+	assert.Nil(t, err)
+	srv := httptest.NewServer(s)
+	t.Cleanup(srv.Close)
+	mgr, err := NewManager(&types.Config{Type: "remote", Remote: types.RemoteConfig{Addr: srv.URL, Token: "secret"}})
+	assert.Nil(t, err)
+	return mgr
+}
+
+func newTestManager(t *testing.T) (*Manager, *mocks.Manager) {
+	inner := &mocks.Manager{}
+	mgr := newRemote(t, inner)
+	return mgr, inner
+}
+
+func TestLoadAndList(t *testing.T) {
+	mgr, inner := newTestManager(t)
+	img := &types.Image{Username: "user1", Name: "ubuntu", Tag: "latest", Digest: "abc"}
+	inner.On("LoadImage", mock.Anything, "user1/ubuntu").Return(img, nil)
+	inner.On("LoadImage", mock.Anything, "user1/centos").Return(nil, types.NewError(types.ErrImageNotFound, io.EOF))
+	inner.On("ListLocalImages", mock.Anything, "user 1").Return([]*types.Image{img}, nil)
+
+	got, err := mgr.LoadImage(context.Background(), "user1/ubuntu")
+	assert.Nil(t, err)
+	assert.Equal(t, img, got)
+
+	_, err = mgr.LoadImage(context.Background(), "user1/centos")
+	assert.ErrorIs(t, err, types.ErrImageNotFound)
+
+	images, err := mgr.ListLocalImages(context.Background(), "user 1")
+	assert.Nil(t, err)
+	assert.Equal(t, []*types.Image{img}, images)
+}
+
+func TestRemoveLocal(t *testing.T) {
+	mgr, inner := newTestManager(t)
+	inner.On("RemoveLocal", mock.Anything, mock.MatchedBy(func(img *types.Image) bool {
+		return img.Reference() == "harbor.io/user1/ubuntu:22.04"
+	})).Return(types.ErrConflict)
+
+	img, _ := types.NewImage("harbor.io/user1/ubuntu:22.04")
+	assert.ErrorIs(t, mgr.RemoveLocal(context.Background(), img), types.ErrConflict)
+}
+
+func TestUnauthenticated(t *testing.T) {
+	mgr, inner := newTestManager(t)
+	inner.On("LoadImage", mock.Anything, "private").Return(nil, types.ErrUnauthorized)
+	// the registry of the backend refused the image
+	_, err := mgr.LoadImage(context.Background(), "private")
+	assert.ErrorIs(t, err, types.ErrUnauthorized)
+	assert.NotErrorIs(t, err, server.ErrUnauthenticated)
+
+	// the server refused the token
+	mgr.cfg.Remote.Token = "wrong"
+	_, err = mgr.LoadImage(context.Background(), "private")
+	assert.ErrorIs(t, err, server.ErrUnauthenticated)
+	assert.NotErrorIs(t, err, types.ErrUnauthorized)
+	inner.AssertNumberOfCalls(t, "LoadImage", 1)
+}
+
+func TestPullStream(t *testing.T) {
+	mgr, inner := newTestManager(t)
+	inner.On("Pull", mock.Anything, mock.Anything, types.PullPolicy(types.PullPolicyAlways)).Return(
+		func(_ context.Context, img *types.Image, _ types.PullPolicy) io.ReadCloser {
+			img.Tag, img.Digest = "latest-arm64", "abc"
+			return io.NopCloser(strings.NewReader(`{"status":"Downloading"}`))
+		}, nil)
+
+	img, _ := types.NewImage("ubuntu")
+	rc, err := mgr.Pull(context.Background(), img, types.PullPolicyAlways)
+	assert.Nil(t, err)
+	bs, err := io.ReadAll(rc)
+	assert.Nil(t, err)
+	assert.Nil(t, rc.Close())
+	assert.Equal(t, "{\"status\":\"Downloading\"}\n", string(bs))
+	assert.Equal(t, "latest-arm64", img.Tag)
+	assert.Equal(t, "abc", img.Digest)
+}
+
+func TestStreamError(t *testing.T) {
+	mgr, inner := newTestManager(t)
+	inner.On("Push", mock.Anything, mock.Anything, false).Return(
+		io.NopCloser(&failingReader{err: types.NewError(types.ErrUnauthorized, io.ErrUnexpectedEOF)}), nil)
+
+	img, _ := types.NewImage("ubuntu")
+	rc, err := mgr.Push(context.Background(), img, false)
+	assert.Nil(t, err)
+	_, err = io.ReadAll(rc)
+	assert.ErrorIs(t, err, types.ErrUnauthorized)
+	rc.Close()
+}
+
+func TestStreamTruncated(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// the server dies before sending the result
+		_, _ = io.WriteString(w, `{"status":"Downloading"}`+"\n")
+	}))
+	defer srv.Close()
+	mgr, err := NewManager(&types.Config{Type: "remote", Remote: types.RemoteConfig{Addr: srv.URL}})
+	assert.Nil(t, err)
+
+	img, _ := types.NewImage("ubuntu")
+	rc, err := mgr.Pull(context.Background(), img, types.PullPolicyAlways)
+	assert.Nil(t, err)
+	bs, err := io.ReadAll(rc)
+	assert.ErrorIs(t, err, io.ErrUnexpectedEOF)
+	assert.Equal(t, "{\"status\":\"Downloading\"}\n", string(bs))
+	rc.Close()
+}
+
+func TestCheckHealth(t *testing.T) {
+	mgr, inner := newTestManager(t)
+	report := &types.HealthReport{Backend: "vmihub", Checks: []types.HealthCheck{{Name: types.HealthCheckStorage, Error: "no such dir"}}}
+	inner.On("CheckHealth", mock.Anything).Return(report, report.Err())
+
+	got, err := mgr.CheckHealth(context.Background())
+	assert.ErrorIs(t, err, types.ErrUnavailable)
+	assert.Equal(t, "no such dir", got.Check(types.HealthCheckStorage).Error)
+
+	mgr.baseURL = "http://127.0.0.1:1/v1"
+	_, err = mgr.CheckHealth(context.Background())
+	assert.ErrorIs(t, err, types.ErrUnavailable)
+}
+
+type failingReader struct {
+	err error
+}
+
+func (r *failingReader) Read([]byte) (int, error) {
+	return 0, r.err
+}
+
+func TestConformance(t *testing.T) {
+	conformance.Run(t, conformance.Config{
+		NewManager: func(t *testing.T) vmimage.Manager {
+			return newRemote(t, fake.NewManager(t.TempDir()))
+		},
+	})
+}
+
+func TestLeases(t *testing.T) {
+	ctx := context.Background()
+	inner := fake.NewManager(t.TempDir())
+	mgr := newRemote(t, lease.NewManager(inner, lease.NewStore(filepath.Join(t.TempDir(), "leases.json"))))
+	fname := filepath.Join(t.TempDir(), "disk.img")
+	assert.Nil(t, os.WriteFile(fname, []byte("disk"), 0600))
+	img, _ := types.NewImage("user1/ubuntu")
+	rc, err := mgr.PrepareContext(ctx, fname, img)
+	assert.Nil(t, err)
+	utils.EnsureReaderClosed(rc)
+
+	assert.Nil(t, mgr.AcquireLease(ctx, img, "vm1"))
+	assert.Error(t, mgr.AcquireLease(ctx, img, ""))
+	leases, err := mgr.Leases(ctx, img)
+	assert.Nil(t, err)
+	assert.Len(t, leases, 1)
+	assert.Equal(t, "vm1", leases[0].Owner)
+	assert.ErrorIs(t, mgr.RemoveLocal(ctx, img), types.ErrConflict)
+
+	assert.Nil(t, mgr.ReleaseLease(ctx, img, "vm1"))
+	leases, err = mgr.Leases(ctx, nil)
+	assert.Nil(t, err)
+	assert.Empty(t, leases)
+
+	assert.Nil(t, mgr.AcquireLease(ctx, img, "vm2"))
+	assert.Nil(t, mgr.ForceRemoveLocal(ctx, img))
+	images, err := mgr.ListLocalImages(ctx, "")
+	assert.Nil(t, err)
+	assert.Empty(t, images)
+
+	// a server without leases refuses them
+	mgr = newRemote(t, inner)
+	assert.ErrorContains(t, mgr.AcquireLease(ctx, img, "vm1"), "leases are not enabled")
+}
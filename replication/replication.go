@@ -0,0 +1,284 @@
+// Package replication keeps secondary backends in sync with the rules of
+// types.ReplicationConfig, copying images with package transfer.
+package replication
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/yuyang0/vmimage"
+	"github.com/yuyang0/vmimage/metrics"
+	"github.com/yuyang0/vmimage/transfer"
+	"github.com/yuyang0/vmimage/types"
+)
+
+// Status is the state of a rule after its last run.
+type Status struct {
+	Rule        string `json:"rule"`
+	Source      string `json:"source"`
+	Destination string `json:"destination"`
+	// Since is when the replicator started handling the rule
+	Since   time.Time `json:"since"`
+	Running bool      `json:"running"`
+	LastRun time.Time `json:"last_run"`
+	// SyncedAt is the start of the last run which left every image in sync,
+	// the destination had at least the images the source had then.
+	SyncedAt  time.Time `json:"synced_at"`
+	Copied    int       `json:"copied"`
+	Skipped   int       `json:"skipped"`
+	Failed    []string  `json:"failed,omitempty"`
+	LastError string    `json:"last_error,omitempty"`
+}
+
+// Lag returns how far behind the destination may be at now, it is counted
+// from Since when the rule never synced.
+func (st *Status) Lag(now time.Time) time.Duration {
+	if st.SyncedAt.IsZero() {
+		return now.Sub(st.Since)
+	}
+	return now.Sub(st.SyncedAt)
+}
+
+// Backends gives the replicator the config and managers currently in use,
+// *factory.Factory implements it.
+type Backends interface {
+	Config() *types.Config
+	GetManager(ty string) (vmimage.Manager, error)
+	GetRemoteLister(ty string) (vmimage.RemoteLister, error)
+}
+
+// reloadInterval is how often Run looks for changed rules.
+const reloadInterval = 10 * time.Second
+
+type Replicator struct {
+	backends       Backends
+	reloadInterval time.Duration
+
+	mu     sync.Mutex
+	status map[string]*Status
+}
+
+// New returns a replicator for the replication rules of the config of
+// backends, the rules are read again whenever they are used so that
+// reloading the config is honoured.
+func New(backends Backends) *Replicator {
+	return &Replicator{
+		backends:       backends,
+		reloadInterval: reloadInterval,
+		status:         map[string]*Status{},
+	}
+}
+
+func (r *Replicator) rules() []types.ReplicationRule {
+	return r.backends.Config().Replication.Rules
+}
+
+// ruleRun is a rule being run periodically by Run.
+type ruleRun struct {
+	rule   types.ReplicationRule
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// Run replicates every rule right away and then at the rule's interval,
+// until ctx is done. Rules added, changed or removed by a reload are picked
+// up within reloadInterval.
+func (r *Replicator) Run(ctx context.Context) error {
+	runs := map[string]*ruleRun{}
+	ticker := time.NewTicker(r.reloadInterval)
+	defer ticker.Stop()
+	for {
+		current := map[string]bool{}
+		for _, rule := range r.rules() {
+			current[rule.Name] = true
+			run, ok := runs[rule.Name]
+			if ok && reflect.DeepEqual(run.rule, rule) {
+				continue
+			}
+			if ok {
+				run.stop()
+			}
+			runs[rule.Name] = r.start(ctx, rule)
+		}
+		for name, run := range runs {
+			if !current[name] {
+				run.stop()
+				delete(runs, name)
+			}
+		}
+		select {
+		case <-ctx.Done():
+			for _, run := range runs {
+				run.stop()
+			}
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// start runs rule periodically until the returned run is stopped.
+func (r *Replicator) start(ctx context.Context, rule types.ReplicationRule) *ruleRun {
+	ctx, cancel := context.WithCancel(ctx)
+	run := &ruleRun{rule: rule, cancel: cancel, done: make(chan struct{})}
+	go func() {
+		defer close(run.done)
+		ticker := time.NewTicker(rule.Interval)
+		defer ticker.Stop()
+		for {
+			_ = r.replicate(ctx, &rule)
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+	return run
+}
+
+func (run *ruleRun) stop() {
+	run.cancel()
+	<-run.done
+}
+
+// RunRule replicates the rule called name once and returns its new status.
+func (r *Replicator) RunRule(ctx context.Context, name string) (*Status, error) {
+	for _, rule := range r.rules() {
+		if rule.Name == name {
+			err := r.replicate(ctx, &rule)
+			st := r.statusOf(&rule)
+			return &st, err
+		}
+	}
+	return nil, fmt.Errorf("unknown replication rule %s", name)
+}
+
+// Status returns the status of every rule, in the order of the config.
+func (r *Replicator) Status() []Status {
+	rules := r.rules()
+	ans := make([]Status, 0, len(rules))
+	for idx := range rules {
+		ans = append(ans, r.statusOf(&rules[idx]))
+	}
+	return ans
+}
+
+func (r *Replicator) statusOf(rule *types.ReplicationRule) Status {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	st := *r.ruleStatus(rule)
+	st.Failed = append([]string(nil), st.Failed...)
+	return st
+}
+
+// ruleStatus returns the status of rule, it is created the first time a
+// rule is seen. r.mu must be held.
+func (r *Replicator) ruleStatus(rule *types.ReplicationRule) *Status {
+	st, ok := r.status[rule.Name]
+	if !ok {
+		st = &Status{Rule: rule.Name, Since: time.Now()}
+		r.status[rule.Name] = st
+	}
+	st.Source, st.Destination = rule.Source, rule.Destination
+	return st
+}
+
+// replicate runs rule once, runs of the same rule don't overlap.
+func (r *Replicator) replicate(ctx context.Context, rule *types.ReplicationRule) error {
+	r.mu.Lock()
+	st := r.ruleStatus(rule)
+	if st.Running {
+		r.mu.Unlock()
+		return fmt.Errorf("replication rule %s is already running", rule.Name)
+	}
+	st.Running = true
+	r.mu.Unlock()
+
+	start := time.Now()
+	results, err := r.sync(ctx, rule)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	st.Running = false
+	st.LastRun = start
+	st.Copied, st.Skipped, st.Failed = 0, 0, nil
+	for _, res := range results {
+		switch {
+		case res.Err != nil:
+			st.Failed = append(st.Failed, res.Name)
+		case res.Skipped:
+			st.Skipped++
+		default:
+			st.Copied++
+		}
+	}
+	st.LastError = ""
+	if err != nil {
+		st.LastError = err.Error()
+	} else {
+		st.SyncedAt = start
+	}
+	metrics.ObserveReplication(rule.Name, st.SyncedAt, len(st.Failed))
+	return err
+}
+
+// sync copies the images of the source's registry matching rule which the
+// destination's registry doesn't have with the same digest. Both registries
+// are listed, so images in sync are skipped without pulling anything.
+func (r *Replicator) sync(ctx context.Context, rule *types.ReplicationRule) ([]*transfer.Result, error) {
+	srcImages, err := r.listRemote(ctx, rule.Source)
+	if err != nil {
+		return nil, err
+	}
+	dstImages, err := r.listRemote(ctx, rule.Destination)
+	if err != nil {
+		return nil, err
+	}
+	dstDigests := map[string]string{}
+	for _, img := range dstImages {
+		dstDigests[img.Fullname()] = transfer.NormalizeDigest(img.Digest)
+	}
+
+	var (
+		skipped []*transfer.Result
+		names   []string
+	)
+	for _, img := range srcImages {
+		if !rule.Match(img) {
+			continue
+		}
+		digest := transfer.NormalizeDigest(img.Digest)
+		if digest != "" && dstDigests[img.Fullname()] == digest {
+			skipped = append(skipped, &transfer.Result{Name: img.Fullname(), Digest: digest, Skipped: true})
+			continue
+		}
+		names = append(names, img.Fullname())
+	}
+	if len(names) == 0 {
+		return skipped, nil
+	}
+	src, err := r.backends.GetManager(rule.Source)
+	if err != nil {
+		return skipped, err
+	}
+	dst, err := r.backends.GetManager(rule.Destination)
+	if err != nil {
+		return skipped, err
+	}
+	// the destination is known to lack these images, Force avoids looking
+	// them up again, which pulls them with docker
+	results, err := transfer.Sync(ctx, src, dst, names, &transfer.Options{Force: true})
+	return append(skipped, results...), err
+}
+
+func (r *Replicator) listRemote(ctx context.Context, ty string) ([]*types.Image, error) {
+	lister, err := r.backends.GetRemoteLister(ty)
+	if err != nil {
+		return nil, err
+	}
+	return lister.ListRemoteImages(ctx, "")
+}
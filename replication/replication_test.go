@@ -0,0 +1,134 @@
+package replication
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/yuyang0/vmimage"
+	"github.com/yuyang0/vmimage/mocks"
+	"github.com/yuyang0/vmimage/types"
+)
+
+type listerFunc func(ctx context.Context, user string) ([]*types.Image, error)
+
+func (f listerFunc) ListRemoteImages(ctx context.Context, user string) ([]*types.Image, error) {
+	return f(ctx, user)
+}
+
+// testBackends serves a mock manager and the images of the registry of
+// each type, the config can be replaced like a factory reload does.
+type testBackends struct {
+	cfg     atomic.Pointer[types.Config]
+	mgrs    map[string]*mocks.Manager
+	remotes map[string][]*types.Image
+	listed  atomic.Int32
+}
+
+func newTestBackends(rules ...types.ReplicationRule) *testBackends {
+	b := &testBackends{
+		mgrs:    map[string]*mocks.Manager{"docker": {}, "vmihub": {}},
+		remotes: map[string][]*types.Image{},
+	}
+	b.setRules(rules...)
+	return b
+}
+
+func (b *testBackends) setRules(rules ...types.ReplicationRule) {
+	cfg := &types.Config{Replication: types.ReplicationConfig{Rules: rules}}
+	_ = cfg.Replication.CheckAndRefine()
+	b.cfg.Store(cfg)
+}
+
+func (b *testBackends) Config() *types.Config {
+	return b.cfg.Load()
+}
+
+func (b *testBackends) GetManager(ty string) (vmimage.Manager, error) {
+	if mgr, ok := b.mgrs[ty]; ok {
+		return mgr, nil
+	}
+	return nil, fmt.Errorf("unknown type %s", ty)
+}
+
+func (b *testBackends) GetRemoteLister(ty string) (vmimage.RemoteLister, error) {
+	if _, ok := b.mgrs[ty]; !ok {
+		return nil, fmt.Errorf("unknown type %s", ty)
+	}
+	return listerFunc(func(context.Context, string) ([]*types.Image, error) {
+		b.listed.Add(1)
+		return b.remotes[ty], nil
+	}), nil
+}
+
+func TestRunRule(t *testing.T) {
+	b := newTestBackends(types.ReplicationRule{Name: "dr", Source: "docker", Destination: "vmihub", Images: []string{"user1/*"}})
+	src, dst := b.mgrs["docker"], b.mgrs["vmihub"]
+	b.remotes["docker"] = []*types.Image{
+		{Username: "user1", Name: "ubuntu", Tag: "latest", Digest: "abc"},
+		{Username: "user1", Name: "centos", Tag: "7", Digest: "def"},
+		{Username: "user2", Name: "ubuntu", Tag: "latest", Digest: "abc"},
+	}
+	b.remotes["vmihub"] = []*types.Image{
+		{Username: "user1", Name: "ubuntu", Tag: "latest", Digest: "sha256:abc"},
+		{Username: "user1", Name: "centos", Tag: "7", Digest: "old"},
+	}
+	src.On("LoadImage", mock.Anything, "user1/centos:7").Return(&types.Image{Username: "user1", Name: "centos", Tag: "7", Digest: "def", LocalPath: "/tmp/c"}, nil)
+	dst.On("PrepareContext", mock.Anything, "/tmp/c", mock.Anything).Return(io.NopCloser(strings.NewReader("")), nil)
+	dst.On("Push", mock.Anything, mock.Anything, true).Return(nil, errors.New("hub is down")).Once()
+
+	r := New(b)
+	st, err := r.RunRule(context.Background(), "dr")
+	assert.ErrorContains(t, err, "hub is down")
+	assert.Equal(t, 1, st.Skipped)
+	assert.Equal(t, []string{"user1/centos:7"}, st.Failed)
+	assert.True(t, st.SyncedAt.IsZero())
+	assert.Greater(t, st.Lag(time.Now().Add(time.Minute)), time.Minute-time.Second)
+
+	dst.On("Push", mock.Anything, mock.Anything, true).Return(io.NopCloser(strings.NewReader("")), nil)
+	st, err = r.RunRule(context.Background(), "dr")
+	assert.Nil(t, err)
+	assert.Equal(t, 1, st.Copied)
+	assert.Equal(t, 1, st.Skipped)
+	assert.Empty(t, st.Failed)
+	assert.Equal(t, st.LastRun, st.SyncedAt)
+	assert.Equal(t, []Status{*st}, r.Status())
+	// the images in sync are neither pulled nor looked up in the destination
+	src.AssertNotCalled(t, "LoadImage", mock.Anything, "user1/ubuntu:latest")
+	src.AssertNotCalled(t, "ListLocalImages", mock.Anything, mock.Anything)
+	dst.AssertNotCalled(t, "LoadImage", mock.Anything, mock.Anything)
+
+	_, err = r.RunRule(context.Background(), "unknown")
+	assert.Error(t, err)
+}
+
+func TestRunFollowsReload(t *testing.T) {
+	b := newTestBackends(types.ReplicationRule{Name: "a", Source: "docker", Destination: "vmihub", Interval: time.Hour})
+	r := New(b)
+	r.reloadInterval = 10 * time.Millisecond
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- r.Run(ctx) }()
+	assert.Eventually(t, func() bool { return !r.Status()[0].SyncedAt.IsZero() }, time.Second, 5*time.Millisecond)
+
+	// the rules of the reloaded config replace the old ones
+	b.setRules(types.ReplicationRule{Name: "b", Source: "vmihub", Destination: "docker", Interval: time.Hour})
+	assert.Eventually(t, func() bool {
+		status := r.Status()
+		return len(status) == 1 && status[0].Rule == "b" && !status[0].SyncedAt.IsZero()
+	}, time.Second, 5*time.Millisecond)
+	_, err := r.RunRule(context.Background(), "a")
+	assert.Error(t, err)
+
+	cancel()
+	assert.ErrorIs(t, <-done, context.Canceled)
+	assert.GreaterOrEqual(t, b.listed.Load(), int32(4))
+}
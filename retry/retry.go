@@ -0,0 +1,121 @@
+package retry
+
+import (
+	"context"
+	"errors"
+	"io"
+	"time"
+
+	"github.com/yuyang0/vmimage"
+	"github.com/yuyang0/vmimage/types"
+)
+
+// Manager wraps another Manager and retries operations which fail with
+// transient errors, sleeping with exponential backoff between attempts.
+type Manager struct {
+	mgr vmimage.Manager
+	cfg *types.RetryConfig
+}
+
+func NewManager(mgr vmimage.Manager, cfg *types.RetryConfig) *Manager {
+	return &Manager{
+		mgr: mgr,
+		cfg: cfg,
+	}
+}
+
+func (m *Manager) ListLocalImages(ctx context.Context, user string) (ans []*types.Image, err error) {
+	err = m.do(ctx, func() error {
+		ans, err = m.mgr.ListLocalImages(ctx, user)
+		return err
+	})
+	return ans, err
+}
+
+func (m *Manager) LoadImage(ctx context.Context, imgName string) (img *types.Image, err error) {
+	err = m.do(ctx, func() error {
+		img, err = m.mgr.LoadImage(ctx, imgName)
+		return err
+	})
+	return img, err
+}
+
+// Prepare is PrepareContext without cancellation.
+func (m *Manager) Prepare(fname string, img *types.Image) (io.ReadCloser, error) {
+	return m.PrepareContext(context.Background(), fname, img)
+}
+
+func (m *Manager) PrepareContext(ctx context.Context, fname string, img *types.Image) (rc io.ReadCloser, err error) {
+	err = m.do(ctx, func() error {
+		rc, err = m.mgr.PrepareContext(ctx, fname, img)
+		return err
+	})
+	return rc, err
+}
+
+func (m *Manager) Pull(ctx context.Context, img *types.Image, policy types.PullPolicy) (rc io.ReadCloser, err error) {
+	err = m.do(ctx, func() error {
+		rc, err = m.mgr.Pull(ctx, img, policy)
+		return err
+	})
+	return rc, err
+}
+
+func (m *Manager) Push(ctx context.Context, img *types.Image, force bool) (rc io.ReadCloser, err error) {
+	err = m.do(ctx, func() error {
+		rc, err = m.mgr.Push(ctx, img, force)
+		return err
+	})
+	return rc, err
+}
+
+func (m *Manager) RemoveLocal(ctx context.Context, img *types.Image) error {
+	return m.do(ctx, func() error {
+		return m.mgr.RemoveLocal(ctx, img)
+	})
+}
+
+// CheckHealth isn't retried, a health check has to report the failures
+// retrying would hide, and promptly.
+func (m *Manager) CheckHealth(ctx context.Context) (*types.HealthReport, error) {
+	return m.mgr.CheckHealth(ctx)
+}
+
+func (m *Manager) do(ctx context.Context, fn func() error) (err error) {
+	interval := m.cfg.InitialInterval
+	for attempt := 1; ; attempt++ {
+		if err = fn(); err == nil || attempt >= m.cfg.MaxAttempts || !IsRetryable(m.cfg, err) {
+			return err
+		}
+		timer := time.NewTimer(interval)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return err
+		case <-timer.C:
+		}
+		interval = time.Duration(float64(interval) * m.cfg.Multiplier)
+		if interval > m.cfg.MaxInterval {
+			interval = m.cfg.MaxInterval
+		}
+	}
+}
+
+// IsRetryable reports whether err is retried with cfg. Cancellations never
+// are, otherwise cfg.Classifier decides or, when it isn't set, the kind of
+// err is looked up in cfg.RetryOn. Backends map transient failures onto
+// types.ErrUnavailable, so that is what RetryOn contains by default.
+func IsRetryable(cfg *types.RetryConfig, err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	if cfg.Classifier != nil {
+		return cfg.Classifier(err)
+	}
+	for _, name := range cfg.RetryOn {
+		if kind, ok := types.ErrorKinds[name]; ok && errors.Is(err, kind) {
+			return true
+		}
+	}
+	return false
+}
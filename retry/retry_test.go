@@ -0,0 +1,101 @@
+package retry
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/yuyang0/vmimage/mocks"
+	"github.com/yuyang0/vmimage/types"
+)
+
+func newTestManager(attempts int) (*Manager, *mocks.Manager) {
+	inner := &mocks.Manager{}
+	cfg := &types.RetryConfig{
+		MaxAttempts:     attempts,
+		InitialInterval: time.Millisecond,
+		MaxInterval:     2 * time.Millisecond,
+		Multiplier:      2,
+		RetryOn:         []string{"unavailable"},
+	}
+	return NewManager(inner, cfg), inner
+}
+
+func TestRetryTransientError(t *testing.T) {
+	m, inner := newTestManager(3)
+	img := &types.Image{Name: "ubuntu", Tag: "latest"}
+	inner.On("LoadImage", mock.Anything, "ubuntu").Return(nil, types.NewError(types.ErrUnavailable, fmt.Errorf("status: 502"))).Twice()
+	inner.On("LoadImage", mock.Anything, "ubuntu").Return(img, nil).Once()
+
+	got, err := m.LoadImage(context.Background(), "ubuntu")
+	assert.Nil(t, err)
+	assert.Equal(t, img, got)
+	inner.AssertNumberOfCalls(t, "LoadImage", 3)
+}
+
+func TestRetryGivesUp(t *testing.T) {
+	m, inner := newTestManager(2)
+	img := &types.Image{Name: "ubuntu", Tag: "latest"}
+	connErr := types.NewError(types.ErrUnavailable, syscall.ECONNREFUSED)
+	inner.On("RemoveLocal", mock.Anything, img).Return(connErr)
+
+	err := m.RemoveLocal(context.Background(), img)
+	assert.ErrorIs(t, err, syscall.ECONNREFUSED)
+	inner.AssertNumberOfCalls(t, "RemoveLocal", 2)
+}
+
+func TestNoRetryOnPermanentError(t *testing.T) {
+	m, inner := newTestManager(3)
+	img := &types.Image{Name: "ubuntu", Tag: "latest"}
+	inner.On("RemoveLocal", mock.Anything, img).Return(errors.New("image not found"))
+
+	err := m.RemoveLocal(context.Background(), img)
+	assert.EqualError(t, err, "image not found")
+	inner.AssertNumberOfCalls(t, "RemoveLocal", 1)
+}
+
+func TestCheckHealthNotRetried(t *testing.T) {
+	m, inner := newTestManager(3)
+	report := &types.HealthReport{Backend: "docker"}
+	connErr := types.NewError(types.ErrUnavailable, syscall.ECONNREFUSED)
+	inner.On("CheckHealth", mock.Anything).Return(report, connErr)
+
+	got, err := m.CheckHealth(context.Background())
+	assert.Same(t, report, got)
+	assert.ErrorIs(t, err, syscall.ECONNREFUSED)
+	inner.AssertNumberOfCalls(t, "CheckHealth", 1)
+}
+
+func TestIsRetryable(t *testing.T) {
+	cfg := &types.RetryConfig{}
+	assert.Nil(t, cfg.CheckAndRefine())
+	tests := []struct {
+		err      error
+		expected bool
+	}{
+		{nil, false},
+		{context.Canceled, false},
+		{fmt.Errorf("pull: %w", context.DeadlineExceeded), false},
+		// only the kind matters, not the text
+		{syscall.ECONNRESET, false},
+		{errors.New("http error: status: 503"), false},
+		{types.NewError(types.ErrUnavailable, errors.New("dial tcp: i/o timeout")), true},
+		{fmt.Errorf("pull: %w", types.NewError(types.ErrUnavailable, errors.New("EOF"))), true},
+		{types.NewError(types.ErrImageNotFound, errors.New("status: 502")), false},
+	}
+	for _, test := range tests {
+		assert.Equal(t, test.expected, IsRetryable(cfg, test.err), "%v", test.err)
+	}
+
+	cfg.RetryOn = []string{"unavailable", "conflict"}
+	assert.True(t, IsRetryable(cfg, types.NewError(types.ErrConflict, errors.New("locked"))))
+	cfg.Classifier = func(err error) bool { return errors.Is(err, syscall.ECONNRESET) }
+	assert.True(t, IsRetryable(cfg, syscall.ECONNRESET))
+	assert.False(t, IsRetryable(cfg, types.NewError(types.ErrUnavailable, errors.New("EOF"))))
+	assert.False(t, IsRetryable(cfg, context.Canceled))
+}
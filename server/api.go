@@ -0,0 +1,95 @@
+package server
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/yuyang0/vmimage/types"
+)
+
+// The request and response bodies of the API, they are shared with the
+// remote manager.
+
+type LoadRequest struct {
+	Name string `json:"name"`
+}
+
+type PrepareRequest struct {
+	// File is a path on the server's host or an URL
+	File  string       `json:"file"`
+	Image *types.Image `json:"image"`
+}
+
+type PullRequest struct {
+	Image  *types.Image     `json:"image"`
+	Policy types.PullPolicy `json:"policy"`
+}
+
+type PushRequest struct {
+	Image *types.Image `json:"image"`
+	Force bool         `json:"force"`
+}
+
+// LeaseRequest acquires the lease of Owner on the image Name, leases are
+// released with DELETE and the same fields as query parameters.
+type LeaseRequest struct {
+	Name  string `json:"name"`
+	Owner string `json:"owner"`
+}
+
+type ErrorResponse struct {
+	Error string `json:"error"`
+	// Code tells errors sharing a status apart, it is only set to
+	// CodeUnauthenticated for now
+	Code string `json:"code,omitempty"`
+}
+
+// CodeUnauthenticated is the code of the 401 response to a request which
+// failed the server's own authentication, a 401 without it comes from the
+// backend's registry.
+const CodeUnauthenticated = "unauthenticated"
+
+// ErrUnauthenticated is returned by the remote manager when the server
+// refused its token or client certificate.
+var ErrUnauthenticated = errors.New("vmimage server authentication failed")
+
+// StreamResult is sent as the aux field of the last message of the
+// prepare, pull and push streams, Image is the image as updated by the
+// operation.
+type StreamResult struct {
+	Image *types.Image `json:"image"`
+}
+
+var errorStatus = []struct {
+	kind   error
+	status int
+}{
+	{types.ErrInvalidImageName, http.StatusBadRequest},
+	{types.ErrUnauthorized, http.StatusUnauthorized},
+	{types.ErrImageNotFound, http.StatusNotFound},
+	{types.ErrConflict, http.StatusConflict},
+	{types.ErrDigestMismatch, http.StatusUnprocessableEntity},
+	{types.ErrUnavailable, http.StatusServiceUnavailable},
+}
+
+// StatusCode returns the HTTP status reporting err.
+func StatusCode(err error) int {
+	for _, es := range errorStatus {
+		if errors.Is(err, es.kind) {
+			return es.status
+		}
+	}
+	return http.StatusInternalServerError
+}
+
+// ErrorFromStatus turns an error response back into a typed error, it is
+// the reverse of StatusCode.
+func ErrorFromStatus(status int, msg string) error {
+	err := errors.New(msg)
+	for _, es := range errorStatus {
+		if es.status == status {
+			return types.NewError(es.kind, err)
+		}
+	}
+	return err
+}
@@ -0,0 +1,394 @@
+// Package server serves a vmimage.Manager over HTTP so that other hosts and
+// non-Go tools can manage the images of a node.
+//
+// Prepare, pull and push respond with the stream of the backend, a sequence
+// of docker JSON messages, followed by a message whose aux field holds a
+// StreamResult. Errors happening once the stream has started are sent as a
+// message with errorDetail, whose code is the status the error maps to.
+//
+// Removals may be forced with the force query parameter and the leases of
+// images are managed under /leases, when the manager holds leases, see
+// package lease.
+//
+// Every request has to be authenticated, with a bearer token or a client
+// certificate, see Options. A request which isn't gets a 401 whose
+// ErrorResponse has the code CodeUnauthenticated.
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strings"
+
+	"github.com/docker/docker/pkg/jsonmessage"
+	"github.com/pkg/errors"
+	"github.com/yuyang0/vmimage"
+	"github.com/yuyang0/vmimage/lease"
+	"github.com/yuyang0/vmimage/types"
+)
+
+const APIPrefix = "/v1"
+
+// Options configures how requests are authenticated, at least one of
+// Token and ClientCert is required, and the local files prepare may read.
+type Options struct {
+	// Token is the bearer token requests may authenticate with
+	Token string
+	// ClientCert accepts the requests made with a verified TLS client
+	// certificate, the http.Server has to be configured to verify them
+	ClientCert bool
+	// FileDirs lists the directories prepare may read local files from,
+	// local files are refused when it is empty. URLs are always accepted.
+	FileDirs []string
+}
+
+type Server struct {
+	mgr      vmimage.Manager
+	mux      *http.ServeMux
+	opts     Options
+	fileDirs []string
+}
+
+func New(mgr vmimage.Manager, opts Options) (*Server, error) {
+	if opts.Token == "" && !opts.ClientCert {
+		return nil, errors.New("the server requires a token or client certificates")
+	}
+	s := &Server{
+		mgr:  mgr,
+		mux:  http.NewServeMux(),
+		opts: opts,
+	}
+	for _, dir := range opts.FileDirs {
+		resolved, err := resolvePath(dir)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid file dir %s", dir)
+		}
+		s.fileDirs = append(s.fileDirs, resolved)
+	}
+	s.mux.HandleFunc("GET "+APIPrefix+"/images", s.listImages)
+	s.mux.HandleFunc("POST "+APIPrefix+"/images/load", s.loadImage)
+	s.mux.HandleFunc("POST "+APIPrefix+"/images/prepare", s.prepare)
+	s.mux.HandleFunc("POST "+APIPrefix+"/images/pull", s.pull)
+	s.mux.HandleFunc("POST "+APIPrefix+"/images/push", s.push)
+	s.mux.HandleFunc("DELETE "+APIPrefix+"/images/{name...}", s.removeLocal)
+	s.mux.HandleFunc("GET "+APIPrefix+"/health", s.checkHealth)
+	s.mux.HandleFunc("GET "+APIPrefix+"/leases", s.listLeases)
+	s.mux.HandleFunc("POST "+APIPrefix+"/leases", s.acquireLease)
+	s.mux.HandleFunc("DELETE "+APIPrefix+"/leases", s.releaseLease)
+	return s, nil
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !s.authenticated(r) {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		writeJSON(w, http.StatusUnauthorized, ErrorResponse{Error: ErrUnauthenticated.Error(), Code: CodeUnauthenticated})
+		return
+	}
+	s.mux.ServeHTTP(w, r)
+}
+
+func (s *Server) authenticated(r *http.Request) bool {
+	if s.opts.ClientCert && r.TLS != nil && len(r.TLS.VerifiedChains) > 0 {
+		return true
+	}
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return ok && s.opts.Token != "" && subtle.ConstantTimeCompare([]byte(token), []byte(s.opts.Token)) == 1
+}
+
+// checkFile refuses local files outside of the configured file dirs.
+func (s *Server) checkFile(fname string) error {
+	if u, err := url.Parse(fname); err == nil && u.Scheme != "" && u.Host != "" {
+		return nil
+	}
+	path, err := resolvePath(fname)
+	if err != nil {
+		return err
+	}
+	for _, dir := range s.fileDirs {
+		if rel, err := filepath.Rel(dir, path); err == nil && rel != ".." && !strings.HasPrefix(rel, "../") {
+			return nil
+		}
+	}
+	return errors.Errorf("file %s isn't in a directory the server reads from", fname)
+}
+
+// resolvePath returns the absolute path of fname without symlinks.
+func resolvePath(fname string) (string, error) {
+	path, err := filepath.Abs(fname)
+	if err != nil {
+		return "", err
+	}
+	return filepath.EvalSymlinks(path)
+}
+
+func (s *Server) listImages(w http.ResponseWriter, r *http.Request) {
+	images, err := s.mgr.ListLocalImages(r.Context(), r.URL.Query().Get("user"))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	if images == nil {
+		images = []*types.Image{}
+	}
+	writeJSON(w, http.StatusOK, images)
+}
+
+func (s *Server) loadImage(w http.ResponseWriter, r *http.Request) {
+	var req LoadRequest
+	if !readRequest(w, r, &req) {
+		return
+	}
+	img, err := s.mgr.LoadImage(r.Context(), req.Name)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, img)
+}
+
+func (s *Server) prepare(w http.ResponseWriter, r *http.Request) {
+	var req PrepareRequest
+	if !readRequest(w, r, &req) || !requireImage(w, req.Image) {
+		return
+	}
+	if err := s.checkFile(req.File); err != nil {
+		writeJSON(w, http.StatusForbidden, ErrorResponse{Error: err.Error()})
+		return
+	}
+	s.stream(r.Context(), w, req.Image, func(ctx context.Context) (io.ReadCloser, error) {
+		return s.mgr.PrepareContext(ctx, req.File, req.Image)
+	})
+}
+
+func (s *Server) pull(w http.ResponseWriter, r *http.Request) {
+	var req PullRequest
+	if !readRequest(w, r, &req) || !requireImage(w, req.Image) {
+		return
+	}
+	if req.Policy == "" {
+		req.Policy = types.PullPolicyAlways
+	}
+	s.stream(r.Context(), w, req.Image, func(ctx context.Context) (io.ReadCloser, error) {
+		return s.mgr.Pull(ctx, req.Image, req.Policy)
+	})
+}
+
+func (s *Server) push(w http.ResponseWriter, r *http.Request) {
+	var req PushRequest
+	if !readRequest(w, r, &req) || !requireImage(w, req.Image) {
+		return
+	}
+	s.stream(r.Context(), w, req.Image, func(ctx context.Context) (io.ReadCloser, error) {
+		return s.mgr.Push(ctx, req.Image, req.Force)
+	})
+}
+
+func (s *Server) removeLocal(w http.ResponseWriter, r *http.Request) {
+	img, err := types.NewImage(r.PathValue("name"))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	remove := s.mgr.RemoveLocal
+	if r.URL.Query().Get("force") == "true" {
+		// without leases there is nothing to force
+		if leaser, ok := s.mgr.(lease.Leaser); ok {
+			remove = leaser.ForceRemoveLocal
+		}
+	}
+	if err := remove(r.Context(), img); err != nil {
+		writeError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) listLeases(w http.ResponseWriter, r *http.Request) {
+	leaser, ok := s.leaser(w)
+	if !ok {
+		return
+	}
+	var img *types.Image
+	if name := r.URL.Query().Get("image"); name != "" {
+		var err error
+		if img, err = types.NewImage(name); err != nil {
+			writeError(w, err)
+			return
+		}
+	}
+	leases, err := leaser.Leases(r.Context(), img)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	if leases == nil {
+		leases = []lease.Lease{}
+	}
+	writeJSON(w, http.StatusOK, leases)
+}
+
+func (s *Server) acquireLease(w http.ResponseWriter, r *http.Request) {
+	var req LeaseRequest
+	if !readRequest(w, r, &req) {
+		return
+	}
+	s.updateLease(w, r, req, lease.Leaser.AcquireLease)
+}
+
+func (s *Server) releaseLease(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	s.updateLease(w, r, LeaseRequest{Name: query.Get("name"), Owner: query.Get("owner")}, lease.Leaser.ReleaseLease)
+}
+
+func (s *Server) updateLease(w http.ResponseWriter, r *http.Request, req LeaseRequest,
+	update func(lease.Leaser, context.Context, *types.Image, string) error) {
+	leaser, ok := s.leaser(w)
+	if !ok {
+		return
+	}
+	if req.Owner == "" {
+		writeJSON(w, http.StatusBadRequest, ErrorResponse{Error: "owner is required"})
+		return
+	}
+	img, err := types.NewImage(req.Name)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	if err := update(leaser, r.Context(), img, req.Owner); err != nil {
+		writeError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// leaser returns the manager as lease.Leaser, it answers 501 when the
+// manager doesn't hold leases.
+func (s *Server) leaser(w http.ResponseWriter) (lease.Leaser, bool) {
+	leaser, ok := s.mgr.(lease.Leaser)
+	if !ok {
+		writeJSON(w, http.StatusNotImplemented, ErrorResponse{Error: "leases are not enabled"})
+	}
+	return leaser, ok
+}
+
+// checkHealth answers with the report in both cases, with 503 when the
+// backend is unhealthy.
+func (s *Server) checkHealth(w http.ResponseWriter, r *http.Request) {
+	report, err := s.mgr.CheckHealth(r.Context())
+	if report == nil {
+		writeError(w, err)
+		return
+	}
+	status := http.StatusOK
+	if err != nil {
+		status = StatusCode(err)
+	}
+	writeJSON(w, status, report)
+}
+
+// stream starts a streaming operation, errors returned by start are
+// reported with a plain error response since nothing has been sent yet.
+func (s *Server) stream(ctx context.Context, w http.ResponseWriter, img *types.Image, start func(context.Context) (io.ReadCloser, error)) {
+	rc, err := start(ctx)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	defer rc.Close()
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	fw := &flushWriter{w: w, rc: http.NewResponseController(w)}
+	enc := json.NewEncoder(fw)
+	if err := forwardStream(fw, rc); err != nil {
+		_ = enc.Encode(errorMessage(err))
+		return
+	}
+	result, _ := json.Marshal(StreamResult{Image: img})
+	aux := json.RawMessage(result)
+	_ = enc.Encode(jsonmessage.JSONMessage{Aux: &aux})
+}
+
+// forwardStream copies the messages of rc to w, one per line. The error
+// reported by a message with errorDetail is returned instead of forwarding
+// the message, so that the client gets it with its status code.
+func forwardStream(w io.Writer, rc io.Reader) error {
+	br := bufio.NewReader(rc)
+	for {
+		line, err := br.ReadBytes('\n')
+		if len(bytes.TrimSpace(line)) > 0 {
+			var msg jsonmessage.JSONMessage
+			if json.Unmarshal(line, &msg) == nil && msg.Error != nil {
+				return msg.Error
+			}
+			// the backend stream doesn't always end with a newline
+			if line[len(line)-1] != '\n' {
+				line = append(line, '\n')
+			}
+			if _, werr := w.Write(line); werr != nil {
+				return werr
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func errorMessage(err error) jsonmessage.JSONMessage {
+	return jsonmessage.JSONMessage{
+		Error:        &jsonmessage.JSONError{Code: StatusCode(err), Message: err.Error()},
+		ErrorMessage: err.Error(),
+	}
+}
+
+// flushWriter sends the progress to the client as soon as it is written.
+type flushWriter struct {
+	w  io.Writer
+	rc *http.ResponseController
+}
+
+func (fw *flushWriter) Write(p []byte) (int, error) {
+	n, err := fw.w.Write(p)
+	if err == nil {
+		_ = fw.rc.Flush()
+	}
+	return n, err
+}
+
+func readRequest(w http.ResponseWriter, r *http.Request, v any) bool {
+	if err := json.NewDecoder(r.Body).Decode(v); err != nil {
+		writeJSON(w, http.StatusBadRequest, ErrorResponse{Error: errors.Wrap(err, "invalid request").Error()})
+		return false
+	}
+	return true
+}
+
+func requireImage(w http.ResponseWriter, img *types.Image) bool {
+	if img == nil || img.Name == "" {
+		writeJSON(w, http.StatusBadRequest, ErrorResponse{Error: "image is required"})
+		return false
+	}
+	return true
+}
+
+func writeError(w http.ResponseWriter, err error) {
+	writeJSON(w, StatusCode(err), ErrorResponse{Error: err.Error()})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,208 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/docker/docker/pkg/jsonmessage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/yuyang0/vmimage/mocks"
+	"github.com/yuyang0/vmimage/types"
+)
+
+const testToken = "secret"
+
+func newTestServer(t *testing.T, fileDirs ...string) (*httptest.Server, *mocks.Manager) {
+	mgr := &mocks.Manager{}
+	s, err := New(mgr, Options{Token: testToken, FileDirs: fileDirs})
+	assert.Nil(t, err)
+	srv := httptest.NewServer(s)
+	t.Cleanup(srv.Close)
+	return srv, mgr
+}
+
+func doRequest(t *testing.T, method, url string, body any) *http.Response {
+	var reader io.Reader
+	if body != nil {
+		bs, err := json.Marshal(body)
+		assert.Nil(t, err)
+		reader = bytes.NewReader(bs)
+	}
+	req, err := http.NewRequest(method, url, reader)
+	assert.Nil(t, err)
+	req.Header.Set("Authorization", "Bearer "+testToken)
+	resp, err := http.DefaultClient.Do(req)
+	assert.Nil(t, err)
+	t.Cleanup(func() { resp.Body.Close() })
+	return resp
+}
+
+func TestListImages(t *testing.T) {
+	srv, mgr := newTestServer(t)
+	mgr.On("ListLocalImages", mock.Anything, "user1").Return([]*types.Image{{Username: "user1", Name: "ubuntu", Tag: "latest"}}, nil)
+
+	resp := doRequest(t, http.MethodGet, srv.URL+"/v1/images?user=user1", nil)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	var images []*types.Image
+	assert.Nil(t, json.NewDecoder(resp.Body).Decode(&images))
+	assert.Len(t, images, 1)
+	assert.Equal(t, "user1/ubuntu:latest", images[0].Fullname())
+}
+
+func TestErrorStatus(t *testing.T) {
+	srv, mgr := newTestServer(t)
+	mgr.On("LoadImage", mock.Anything, "ubuntu").Return(nil, types.NewError(types.ErrImageNotFound, io.EOF))
+	mgr.On("LoadImage", mock.Anything, "private").Return(nil, types.ErrUnauthorized)
+	mgr.On("RemoveLocal", mock.Anything, mock.Anything).Return(types.ErrConflict)
+
+	tests := []struct {
+		method string
+		path   string
+		body   any
+		status int
+	}{
+		{http.MethodPost, "/v1/images/load", LoadRequest{Name: "ubuntu"}, http.StatusNotFound},
+		{http.MethodPost, "/v1/images/load", LoadRequest{Name: "private"}, http.StatusUnauthorized},
+		{http.MethodDelete, "/v1/images/user1/ubuntu:latest", nil, http.StatusConflict},
+		{http.MethodDelete, "/v1/images/bad__-name", nil, http.StatusBadRequest},
+		{http.MethodPost, "/v1/images/pull", PullRequest{}, http.StatusBadRequest},
+		{http.MethodGet, "/v1/images/pull", nil, http.StatusMethodNotAllowed},
+	}
+	for _, test := range tests {
+		resp := doRequest(t, test.method, srv.URL+test.path, test.body)
+		assert.Equal(t, test.status, resp.StatusCode, "%s %s", test.method, test.path)
+	}
+	err := ErrorFromStatus(http.StatusNotFound, "image not found: ubuntu")
+	assert.ErrorIs(t, err, types.ErrImageNotFound)
+}
+
+func TestPullStream(t *testing.T) {
+	srv, mgr := newTestServer(t)
+	progress := `{"status":"Pulling","id":"layer"}`
+	mgr.On("Pull", mock.Anything, mock.Anything, types.PullPolicy(types.PullPolicyIfNotPresent)).Return(
+		func(_ context.Context, img *types.Image, _ types.PullPolicy) io.ReadCloser {
+			img.Tag = "latest-amd64"
+			return io.NopCloser(strings.NewReader(progress))
+		}, nil)
+
+	img, _ := types.NewImage("ubuntu")
+	resp := doRequest(t, http.MethodPost, srv.URL+"/v1/images/pull", PullRequest{Image: img, Policy: types.PullPolicyIfNotPresent})
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	dec := json.NewDecoder(resp.Body)
+	var msgs []jsonmessage.JSONMessage
+	for {
+		var msg jsonmessage.JSONMessage
+		if err := dec.Decode(&msg); err != nil {
+			assert.ErrorIs(t, err, io.EOF)
+			break
+		}
+		msgs = append(msgs, msg)
+	}
+	assert.Len(t, msgs, 2)
+	assert.Equal(t, "Pulling", msgs[0].Status)
+	var result StreamResult
+	assert.Nil(t, json.Unmarshal(*msgs[1].Aux, &result))
+	assert.Equal(t, "latest-amd64", result.Image.Tag)
+}
+
+func TestHealth(t *testing.T) {
+	srv, mgr := newTestServer(t)
+	report := &types.HealthReport{Backend: "docker", Checks: []types.HealthCheck{{Name: types.HealthCheckDaemon, Error: "refused"}}}
+	mgr.On("CheckHealth", mock.Anything).Return(report, report.Err())
+
+	resp := doRequest(t, http.MethodGet, srv.URL+"/v1/health", nil)
+	assert.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+	got := &types.HealthReport{}
+	assert.Nil(t, json.NewDecoder(resp.Body).Decode(got))
+	assert.False(t, got.Healthy())
+}
+
+func TestAuth(t *testing.T) {
+	_, err := New(&mocks.Manager{}, Options{})
+	assert.NotNil(t, err)
+
+	srv, mgr := newTestServer(t)
+	mgr.On("ListLocalImages", mock.Anything, "").Return(nil, nil)
+	for _, auth := range []string{"", "Bearer wrong", "Basic " + testToken} {
+		req, err := http.NewRequest(http.MethodGet, srv.URL+"/v1/images", nil)
+		assert.Nil(t, err)
+		if auth != "" {
+			req.Header.Set("Authorization", auth)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		assert.Nil(t, err)
+		errResp := ErrorResponse{}
+		assert.Nil(t, json.NewDecoder(resp.Body).Decode(&errResp))
+		resp.Body.Close()
+		assert.Equal(t, http.StatusUnauthorized, resp.StatusCode, auth)
+		assert.Equal(t, CodeUnauthenticated, errResp.Code, auth)
+	}
+	mgr.AssertNotCalled(t, "ListLocalImages", mock.Anything, mock.Anything)
+	resp := doRequest(t, http.MethodGet, srv.URL+"/v1/images", nil)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+}
+
+func TestPrepareFileDirs(t *testing.T) {
+	allowed, other := t.TempDir(), t.TempDir()
+	srv, mgr := newTestServer(t, allowed)
+	mgr.On("PrepareContext", mock.Anything, mock.Anything, mock.Anything).Return(io.NopCloser(strings.NewReader("")), nil)
+
+	inside := filepath.Join(allowed, "disk.img")
+	outside := filepath.Join(other, "disk.img")
+	link := filepath.Join(allowed, "link.img")
+	for _, fname := range []string{inside, outside} {
+		assert.Nil(t, os.WriteFile(fname, []byte("disk"), 0600))
+	}
+	assert.Nil(t, os.Symlink(outside, link))
+
+	tests := []struct {
+		file   string
+		status int
+	}{
+		{inside, http.StatusOK},
+		{"https://example.com/disk.img", http.StatusOK},
+		{outside, http.StatusForbidden},
+		{link, http.StatusForbidden},
+		{allowed + "/../" + filepath.Base(other) + "/disk.img", http.StatusForbidden},
+		{"/etc/passwd", http.StatusForbidden},
+	}
+	img, _ := types.NewImage("ubuntu")
+	for _, test := range tests {
+		resp := doRequest(t, http.MethodPost, srv.URL+"/v1/images/prepare", PrepareRequest{File: test.file, Image: img})
+		assert.Equal(t, test.status, resp.StatusCode, test.file)
+	}
+	mgr.AssertNumberOfCalls(t, "PrepareContext", 2)
+}
+
+func TestStreamErrorDetail(t *testing.T) {
+	srv, mgr := newTestServer(t)
+	stream := `{"status":"Pulling","id":"layer"}` + "\n" + `{"errorDetail":{"message":"manifest unknown"},"error":"manifest unknown"}`
+	mgr.On("Pull", mock.Anything, mock.Anything, mock.Anything).Return(io.NopCloser(strings.NewReader(stream)), nil)
+
+	img, _ := types.NewImage("ubuntu")
+	resp := doRequest(t, http.MethodPost, srv.URL+"/v1/images/pull", PullRequest{Image: img})
+	dec := json.NewDecoder(resp.Body)
+	var msgs []jsonmessage.JSONMessage
+	for {
+		var msg jsonmessage.JSONMessage
+		if err := dec.Decode(&msg); err != nil {
+			break
+		}
+		msgs = append(msgs, msg)
+	}
+	// the error is sent with its status code and without a result
+	assert.Len(t, msgs, 2)
+	assert.Equal(t, http.StatusInternalServerError, msgs[1].Error.Code)
+	assert.Equal(t, "manifest unknown", msgs[1].Error.Message)
+	assert.Nil(t, msgs[1].Aux)
+}
@@ -0,0 +1,17 @@
+package tracing
+
+import (
+	"net/http"
+
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+)
+
+// Transport wraps rt so that every request gets a client span, child of the
+// span in the request's context, and carries the trace context to the
+// server. The global TracerProvider and propagator are used.
+func Transport(rt http.RoundTripper) http.RoundTripper {
+	if rt == nil {
+		rt = http.DefaultTransport
+	}
+	return otelhttp.NewTransport(rt)
+}
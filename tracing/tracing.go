@@ -0,0 +1,132 @@
+package tracing
+
+import (
+	"context"
+	"io"
+
+	"github.com/yuyang0/vmimage"
+	"github.com/yuyang0/vmimage/types"
+	"github.com/yuyang0/vmimage/utils"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const instrumentationName = "github.com/yuyang0/vmimage"
+
+// Manager wraps another Manager and records a span for each operation.
+// The span's context is handed down to the wrapped manager, the backends
+// send their HTTP requests through Transport so those requests become its
+// children.
+type Manager struct {
+	mgr     vmimage.Manager
+	backend string
+	tracer  trace.Tracer
+}
+
+// NewManager creates a tracing Manager, when tp is nil the global
+// TracerProvider is used.
+func NewManager(mgr vmimage.Manager, backend string, tp trace.TracerProvider) *Manager {
+	if tp == nil {
+		tp = otel.GetTracerProvider()
+	}
+	return &Manager{
+		mgr:     mgr,
+		backend: backend,
+		tracer:  tp.Tracer(instrumentationName),
+	}
+}
+
+func (m *Manager) ListLocalImages(ctx context.Context, user string) ([]*types.Image, error) {
+	ctx, span := m.start(ctx, "ListLocalImages", attribute.String("vmimage.user", user))
+	images, err := m.mgr.ListLocalImages(ctx, user)
+	if err == nil {
+		span.SetAttributes(attribute.Int("vmimage.image_count", len(images)))
+	}
+	end(span, nil, err)
+	return images, err
+}
+
+func (m *Manager) LoadImage(ctx context.Context, imgName string) (*types.Image, error) {
+	ctx, span := m.start(ctx, "LoadImage", attribute.String("vmimage.image", imgName))
+	img, err := m.mgr.LoadImage(ctx, imgName)
+	end(span, img, err)
+	return img, err
+}
+
+// Prepare is PrepareContext without cancellation.
+func (m *Manager) Prepare(fname string, img *types.Image) (io.ReadCloser, error) {
+	return m.PrepareContext(context.Background(), fname, img)
+}
+
+func (m *Manager) PrepareContext(ctx context.Context, fname string, img *types.Image) (io.ReadCloser, error) {
+	ctx, span := m.start(ctx, "Prepare", imageAttrs(img, attribute.String("vmimage.source", fname))...)
+	rc, err := m.mgr.PrepareContext(ctx, fname, img)
+	return traceStream(span, img, rc, err)
+}
+
+func (m *Manager) Pull(ctx context.Context, img *types.Image, policy types.PullPolicy) (io.ReadCloser, error) {
+	ctx, span := m.start(ctx, "Pull", imageAttrs(img, attribute.String("vmimage.pull_policy", string(policy)))...)
+	rc, err := m.mgr.Pull(ctx, img, policy)
+	return traceStream(span, img, rc, err)
+}
+
+func (m *Manager) Push(ctx context.Context, img *types.Image, force bool) (io.ReadCloser, error) {
+	ctx, span := m.start(ctx, "Push", imageAttrs(img, attribute.Bool("vmimage.force", force))...)
+	rc, err := m.mgr.Push(ctx, img, force)
+	return traceStream(span, img, rc, err)
+}
+
+func (m *Manager) RemoveLocal(ctx context.Context, img *types.Image) error {
+	ctx, span := m.start(ctx, "RemoveLocal", imageAttrs(img)...)
+	err := m.mgr.RemoveLocal(ctx, img)
+	end(span, nil, err)
+	return err
+}
+
+func (m *Manager) CheckHealth(ctx context.Context) (*types.HealthReport, error) {
+	ctx, span := m.start(ctx, "CheckHealth")
+	report, err := m.mgr.CheckHealth(ctx)
+	end(span, nil, err)
+	return report, err
+}
+
+func (m *Manager) start(ctx context.Context, op string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	attrs = append(attrs, attribute.String("vmimage.backend", m.backend))
+	return m.tracer.Start(ctx, "vmimage."+op, trace.WithAttributes(attrs...))
+}
+
+// traceStream keeps the span open until the returned stream is drained or
+// closed, since that's when streaming operations really finish.
+func traceStream(span trace.Span, img *types.Image, rc io.ReadCloser, err error) (io.ReadCloser, error) {
+	if err != nil {
+		end(span, nil, err)
+		return rc, err
+	}
+	return utils.NewNotifyReadCloser(rc, func(_ int64, err error) {
+		end(span, img, err)
+	}), nil
+}
+
+func end(span trace.Span, img *types.Image, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	} else if img != nil {
+		// the backend may have filled in fields such as digest and size
+		span.SetAttributes(imageAttrs(img)...)
+	}
+	span.End()
+}
+
+func imageAttrs(img *types.Image, extra ...attribute.KeyValue) []attribute.KeyValue {
+	attrs := []attribute.KeyValue{attribute.String("vmimage.image", img.Fullname())}
+	if img.Digest != "" {
+		attrs = append(attrs, attribute.String("vmimage.digest", img.Digest))
+	}
+	if img.Size > 0 {
+		attrs = append(attrs, attribute.Int64("vmimage.bytes", img.Size))
+	}
+	return append(attrs, extra...)
+}
@@ -0,0 +1,81 @@
+package tracing
+
+import (
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/yuyang0/vmimage/mocks"
+	"github.com/yuyang0/vmimage/types"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+func newTestManager() (*Manager, *mocks.Manager, *tracetest.InMemoryExporter) {
+	exporter := tracetest.NewInMemoryExporter()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
+	inner := &mocks.Manager{}
+	return NewManager(inner, "docker", tp), inner, exporter
+}
+
+func attrValue(attrs []attribute.KeyValue, key string) (attribute.Value, bool) {
+	for _, kv := range attrs {
+		if string(kv.Key) == key {
+			return kv.Value, true
+		}
+	}
+	return attribute.Value{}, false
+}
+
+func TestPullSpan(t *testing.T) {
+	m, inner, exporter := newTestManager()
+	img := &types.Image{Username: "user", Name: "ubuntu", Tag: "22.04"}
+	inner.On("Pull", mock.Anything, img, types.PullPolicy(types.PullPolicyIfNotPresent)).
+		Run(func(args mock.Arguments) {
+			// the span must be propagated to the backend
+			ctx := args.Get(0).(context.Context)
+			assert.True(t, trace.SpanContextFromContext(ctx).IsValid())
+			img.Digest = "abcd"
+			img.Size = 4096
+		}).
+		Return(io.NopCloser(strings.NewReader("progress")), nil)
+
+	rc, err := m.Pull(context.Background(), img, types.PullPolicyIfNotPresent)
+	assert.Nil(t, err)
+	assert.Len(t, exporter.GetSpans(), 0)
+	_, _ = io.ReadAll(rc)
+	_ = rc.Close()
+
+	spans := exporter.GetSpans()
+	assert.Len(t, spans, 1)
+	assert.Equal(t, "vmimage.Pull", spans[0].Name)
+	v, _ := attrValue(spans[0].Attributes, "vmimage.image")
+	assert.Equal(t, "user/ubuntu:22.04", v.AsString())
+	v, _ = attrValue(spans[0].Attributes, "vmimage.backend")
+	assert.Equal(t, "docker", v.AsString())
+	v, _ = attrValue(spans[0].Attributes, "vmimage.digest")
+	assert.Equal(t, "abcd", v.AsString())
+	v, _ = attrValue(spans[0].Attributes, "vmimage.bytes")
+	assert.Equal(t, int64(4096), v.AsInt64())
+}
+
+func TestErrorSpan(t *testing.T) {
+	m, inner, exporter := newTestManager()
+	inner.On("LoadImage", mock.Anything, "ubuntu").Return(nil, errors.New("unauthorized"))
+
+	_, err := m.LoadImage(context.Background(), "ubuntu")
+	assert.NotNil(t, err)
+
+	spans := exporter.GetSpans()
+	assert.Len(t, spans, 1)
+	assert.Equal(t, "vmimage.LoadImage", spans[0].Name)
+	assert.Equal(t, codes.Error, spans[0].Status.Code)
+	assert.Equal(t, "unauthorized", spans[0].Status.Description)
+}
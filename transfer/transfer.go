@@ -0,0 +1,162 @@
+// Package transfer copies images between managers, e.g. from the docker
+// backend to vmihub.
+package transfer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/docker/docker/pkg/jsonmessage"
+	"github.com/yuyang0/vmimage"
+	"github.com/yuyang0/vmimage/types"
+)
+
+type Options struct {
+	// Force copies images even when the destination has the same digest
+	Force bool
+	// RemoveLocal removes the local copies made on both sides once the
+	// image is pushed, so that large syncs don't fill the disk
+	RemoveLocal bool
+}
+
+// Result describes the copy of one image.
+type Result struct {
+	Name   string `json:"name"`
+	Digest string `json:"digest"`
+	// Skipped is set when the destination already had the image
+	Skipped bool  `json:"skipped"`
+	Err     error `json:"-"`
+}
+
+// Copy transfers the image called name from src to dst: it is pulled into
+// src's local store, prepared in dst from the local file with the same
+// metadata and pushed. Nothing is copied when dst already has an image with
+// the same digest. Note that looking the image up in dst pulls it when dst
+// is a docker manager.
+func Copy(ctx context.Context, src, dst vmimage.Manager, name string, opts *Options) (*Result, error) {
+	if opts == nil {
+		opts = &Options{}
+	}
+	res := &Result{Name: name}
+	img, err := localImage(ctx, src, name)
+	if err != nil {
+		return res, err
+	}
+	res.Name, res.Digest = img.Fullname(), NormalizeDigest(img.GetDigest())
+	if res.Digest == "" {
+		return res, fmt.Errorf("failed to get the digest of %s", res.Name)
+	}
+
+	if !opts.Force {
+		existing, err := dst.LoadImage(ctx, res.Name)
+		switch {
+		case err == nil && NormalizeDigest(existing.Digest) == res.Digest:
+			res.Skipped = true
+			return res, nil
+		case err != nil && !errors.Is(err, types.ErrImageNotFound):
+			return res, err
+		}
+	}
+
+	dstImg := &types.Image{
+		Username: img.Username,
+		Name:     img.Name,
+		Tag:      img.Tag,
+		Private:  img.Private,
+		OS:       img.OS,
+		Size:     img.Size,
+		Digest:   res.Digest,
+	}
+	if err := drain(dst.PrepareContext(ctx, img.LocalPath, dstImg)); err != nil {
+		return res, fmt.Errorf("failed to prepare %s: %w", res.Name, err)
+	}
+	if err := drain(dst.Push(ctx, dstImg, true)); err != nil {
+		return res, fmt.Errorf("failed to push %s: %w", res.Name, err)
+	}
+	if opts.RemoveLocal {
+		err = errors.Join(src.RemoveLocal(ctx, img), dst.RemoveLocal(ctx, dstImg))
+	}
+	return res, err
+}
+
+// Sync copies the images called names from src to dst, all the local images
+// of src when names is empty. It keeps going when an image fails and
+// returns the failures joined.
+func Sync(ctx context.Context, src, dst vmimage.Manager, names []string, opts *Options) ([]*Result, error) {
+	if len(names) == 0 {
+		images, err := src.ListLocalImages(ctx, "")
+		if err != nil {
+			return nil, err
+		}
+		for _, img := range images {
+			names = append(names, img.Fullname())
+		}
+	}
+	results := make([]*Result, 0, len(names))
+	var errs []error
+	for _, name := range names {
+		if err := ctx.Err(); err != nil {
+			return results, err
+		}
+		res, err := Copy(ctx, src, dst, name, opts)
+		if err != nil {
+			res.Err = err
+			errs = append(errs, fmt.Errorf("%s: %w", name, err))
+		}
+		results = append(results, res)
+	}
+	return results, errors.Join(errs...)
+}
+
+// localImage makes sure the image is in mgr's local store and returns it
+// with its local path.
+func localImage(ctx context.Context, mgr vmimage.Manager, name string) (*types.Image, error) {
+	img, err := mgr.LoadImage(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	if img.LocalPath != "" {
+		return img, nil
+	}
+	if err := drain(mgr.Pull(ctx, img, types.PullPolicyIfNotPresent)); err != nil {
+		return nil, err
+	}
+	if img.LocalPath != "" {
+		return img, nil
+	}
+	// not every backend reports the local path when pulling
+	images, err := mgr.ListLocalImages(ctx, img.Username)
+	if err != nil {
+		return nil, err
+	}
+	for _, local := range images {
+		if local.Fullname() == img.Fullname() && local.LocalPath != "" {
+			img.LocalPath = local.LocalPath
+			return img, nil
+		}
+	}
+	return nil, types.NewError(types.ErrImageNotFound, fmt.Errorf("no local file for %s", img.Fullname()))
+}
+
+// drain reads a stream returned by Prepare, Pull or Push until it ends and
+// reports the errors sent in it.
+func drain(rc io.ReadCloser, err error) error {
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	return jsonmessage.DisplayJSONMessagesStream(rc, io.Discard, 0, false, nil)
+}
+
+// NormalizeDigest maps the digest formats of the backends, "algo:hex",
+// bare hex or sha256sum output, onto the bare lowercase sha256 hex.
+func NormalizeDigest(digest string) string {
+	fields := strings.Fields(digest)
+	if len(fields) == 0 {
+		return ""
+	}
+	return strings.ToLower(strings.TrimPrefix(fields[0], "sha256:"))
+}
@@ -0,0 +1,78 @@
+package transfer
+
+import (
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/yuyang0/vmimage/mocks"
+	"github.com/yuyang0/vmimage/types"
+)
+
+func emptyStream() io.ReadCloser {
+	return io.NopCloser(strings.NewReader(""))
+}
+
+func TestCopy(t *testing.T) {
+	src, dst := &mocks.Manager{}, &mocks.Manager{}
+	img := &types.Image{Username: "user1", Name: "ubuntu", Tag: "latest", Digest: "ABC", LocalPath: "/tmp/vm.img", OS: types.OSInfo{Arch: "arm64"}}
+	src.On("LoadImage", mock.Anything, "user1/ubuntu").Return(img, nil)
+	dst.On("LoadImage", mock.Anything, "user1/ubuntu:latest").Return(nil, types.ErrImageNotFound)
+	dst.On("PrepareContext", mock.Anything, "/tmp/vm.img", mock.MatchedBy(func(img *types.Image) bool {
+		return img.Fullname() == "user1/ubuntu:latest" && img.OS.Arch == "arm64" && img.Digest == "abc"
+	})).Return(emptyStream(), nil)
+	dst.On("Push", mock.Anything, mock.Anything, true).Return(emptyStream(), nil)
+
+	res, err := Copy(context.Background(), src, dst, "user1/ubuntu", nil)
+	assert.Nil(t, err)
+	assert.False(t, res.Skipped)
+	assert.Equal(t, "abc", res.Digest)
+	dst.AssertExpectations(t)
+}
+
+func TestCopySkipsSameDigest(t *testing.T) {
+	src, dst := &mocks.Manager{}, &mocks.Manager{}
+	img := &types.Image{Name: "ubuntu", Tag: "latest", Digest: "abc", LocalPath: "/tmp/vm.img"}
+	src.On("LoadImage", mock.Anything, "ubuntu").Return(img, nil)
+	dst.On("LoadImage", mock.Anything, "ubuntu:latest").Return(&types.Image{Name: "ubuntu", Tag: "latest", Digest: "sha256:abc"}, nil)
+
+	res, err := Copy(context.Background(), src, dst, "ubuntu", nil)
+	assert.Nil(t, err)
+	assert.True(t, res.Skipped)
+	dst.AssertNotCalled(t, "PrepareContext", mock.Anything, mock.Anything, mock.Anything)
+}
+
+func TestCopyFindsLocalPath(t *testing.T) {
+	src, dst := &mocks.Manager{}, &mocks.Manager{}
+	src.On("LoadImage", mock.Anything, "ubuntu").Return(&types.Image{Name: "ubuntu", Tag: "latest", Digest: "abc"}, nil)
+	src.On("Pull", mock.Anything, mock.Anything, types.PullPolicy(types.PullPolicyIfNotPresent)).Return(emptyStream(), nil)
+	src.On("ListLocalImages", mock.Anything, "").Return([]*types.Image{{Name: "ubuntu", Tag: "latest", LocalPath: "/data/ubuntu"}}, nil)
+	dst.On("LoadImage", mock.Anything, "ubuntu:latest").Return(nil, types.ErrImageNotFound)
+	dst.On("PrepareContext", mock.Anything, "/data/ubuntu", mock.Anything).Return(emptyStream(), nil)
+	dst.On("Push", mock.Anything, mock.Anything, true).Return(
+		io.NopCloser(strings.NewReader(`{"errorDetail":{"message":"denied"},"error":"denied"}`)), nil)
+
+	_, err := Copy(context.Background(), src, dst, "ubuntu", nil)
+	assert.ErrorContains(t, err, "failed to push ubuntu:latest: denied")
+}
+
+func TestSync(t *testing.T) {
+	src, dst := &mocks.Manager{}, &mocks.Manager{}
+	src.On("ListLocalImages", mock.Anything, "").Return([]*types.Image{
+		{Name: "ubuntu", Tag: "latest"},
+		{Name: "centos", Tag: "7"},
+	}, nil)
+	src.On("LoadImage", mock.Anything, "ubuntu:latest").Return(&types.Image{Name: "ubuntu", Tag: "latest", Digest: "abc", LocalPath: "/tmp/u"}, nil)
+	src.On("LoadImage", mock.Anything, "centos:7").Return(nil, errors.New("boom"))
+	dst.On("LoadImage", mock.Anything, "ubuntu:latest").Return(&types.Image{Digest: "abc"}, nil)
+
+	results, err := Sync(context.Background(), src, dst, nil, nil)
+	assert.ErrorContains(t, err, "centos:7: boom")
+	assert.Len(t, results, 2)
+	assert.True(t, results[0].Skipped)
+	assert.EqualError(t, results[1].Err, "boom")
+}
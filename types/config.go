@@ -1,9 +1,8 @@
 package types
 
 import (
-	"encoding/base64"
-	"encoding/json"
 	"net/url"
+	"time"
 
 	"github.com/pkg/errors"
 )
@@ -14,6 +13,22 @@ type DockerConfig struct {
 	Prefix   string `toml:"prefix"`
 	Username string `toml:"username"`
 	Password string `toml:"password"`
+	// IdentityToken is used instead of username and password when set
+	IdentityToken string `toml:"identity_token"`
+	// ConfigFile is the docker cli config used when no credential is given
+	// above, it defaults to ~/.docker/config.json
+	ConfigFile string `toml:"config_file"`
+	// TLS is used to talk to the daemon on a tcp endpoint and for the other
+	// HTTP requests of the docker manager
+	TLS TLSConfig `toml:"tls"`
+	// StoreDir receives the image files copied out of the daemon when they
+	// can't be used in place, i.e. with storage drivers other than overlay2
+	// or a remote daemon
+	StoreDir string `toml:"store_dir" default:"/var/lib/vmimage/docker"`
+	// Materialize always puts the image files in StoreDir, overlay2 files
+	// are hardlinked, reflinked or copied there, so that pruning docker
+	// images doesn't remove the disks of running VMs
+	Materialize bool `toml:"materialize"`
 }
 
 type VMIHubConfig struct {
@@ -21,27 +36,102 @@ type VMIHubConfig struct {
 	Addr     string `toml:"addr"`
 	Username string `toml:"username"`
 	Password string `toml:"password"`
+	// TLS isn't supported, setting it is an error: the vmihub client sends
+	// its requests with http.DefaultClient, so the hub's certificate has to
+	// be trusted by the host
+	TLS TLSConfig `toml:"tls"`
+}
+
+// RemoteConfig points the remote manager at a vmimage server.
+type RemoteConfig struct {
+	Addr string `toml:"addr"`
+	// Token is sent as bearer token, the server may use client certificates
+	// given in TLS instead
+	Token string    `toml:"token"`
+	TLS   TLSConfig `toml:"tls"`
+}
+
+// RetryConfig controls how failed backend operations are retried.
+// MaxAttempts includes the first call, so 1 disables retrying.
+type RetryConfig struct {
+	MaxAttempts     int           `toml:"max_attempts" default:"3"`
+	InitialInterval time.Duration `toml:"initial_interval" default:"500ms"`
+	MaxInterval     time.Duration `toml:"max_interval" default:"10s"`
+	Multiplier      float64       `toml:"multiplier" default:"2"`
+	// RetryOn lists the kinds of errors which are retried, see ErrorKinds
+	RetryOn []string `toml:"retry_on" default:"unavailable"`
+	// Classifier, when set, decides which errors are retried instead of RetryOn
+	Classifier func(error) bool `toml:"-"`
 }
 
 type Config struct {
 	Type   string       `toml:"type" default:"docker"`
 	Docker DockerConfig `toml:"docker"`
 	VMIHub VMIHubConfig `toml:"vmihub"`
+	Remote RemoteConfig `toml:"remote"`
+	Retry  RetryConfig  `toml:"retry"`
+	// Metrics enables the prometheus instrumentation of managers built by the factory
+	Metrics bool `toml:"metrics"`
+	// Tracing enables opentelemetry spans, they are sent to the global TracerProvider
+	Tracing bool `toml:"tracing"`
+	// Replication keeps other backends in sync, see package replication
+	Replication ReplicationConfig `toml:"replication"`
+	// LeaseFile enables leases, leased images can't be removed without
+	// forcing, see package lease
+	LeaseFile string `toml:"lease_file"`
 }
 
 func (cfg *Config) CheckAndRefine() error {
-	switch cfg.Type {
+	if err := cfg.Retry.CheckAndRefine(); err != nil {
+		return err
+	}
+	if err := cfg.Replication.CheckAndRefine(); err != nil {
+		return err
+	}
+	// the backends replicated from or to are checked like the main one
+	checked := map[string]bool{}
+	for _, ty := range append([]string{cfg.Type}, cfg.Replication.Backends()...) {
+		if checked[ty] {
+			continue
+		}
+		checked[ty] = true
+		if err := cfg.checkBackend(ty); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (cfg *Config) checkBackend(ty string) error {
+	switch ty {
 	case "docker":
-		if cfg.Docker.Username == "" || cfg.Docker.Password == "" {
-			return errors.New("docker's username or password should not be empty")
+		// configs built in code get the defaults of ReadConfig
+		if err := ApplyMissingDefaults(&cfg.Docker); err != nil {
+			return err
+		}
+		if err := cfg.Docker.TLS.CheckAndRefine(); err != nil {
+			return err
+		}
+		registry := RegistryHost(cfg.Docker.Prefix)
+		cred := &DockerCredential{
+			Username:      cfg.Docker.Username,
+			Password:      cfg.Docker.Password,
+			IdentityToken: cfg.Docker.IdentityToken,
+		}
+		if cred.empty() {
+			var err error
+			if cred, err = LoadDockerCredential(cfg.Docker.ConfigFile, registry); err != nil {
+				return errors.Wrap(err, "failed to load docker credential")
+			}
 		}
-		auth := map[string]string{
-			"username": cfg.Docker.Username,
-			"password": cfg.Docker.Password,
+		if cred == nil {
+			return errors.New("docker's username and password or identity token should not be empty")
 		}
-		authBytes, _ := json.Marshal(auth)
-		cfg.Docker.Auth = base64.StdEncoding.EncodeToString(authBytes)
+		cfg.Docker.Auth = encodeDockerAuth(cred, registry)
 	case "vmihub":
+		if cfg.VMIHub.TLS.Enabled() {
+			return errors.New("vmihub doesn't support tls settings, the hub's certificate has to be trusted by the host")
+		}
 		if cfg.VMIHub.Username == "" || cfg.VMIHub.Password == "" {
 			return errors.New("ImageHub's username or password should not be empty")
 		}
@@ -55,10 +145,39 @@ func (cfg *Config) CheckAndRefine() error {
 		if u.Scheme == "" || u.Host == "" {
 			return errors.New("invalid image hub addr")
 		}
-	case "mock":
+	case "remote":
+		if err := cfg.Remote.TLS.CheckAndRefine(); err != nil {
+			return err
+		}
+		u, err := url.Parse(cfg.Remote.Addr)
+		if err != nil {
+			return errors.Wrapf(err, "failed to parse %s", cfg.Remote.Addr)
+		}
+		if u.Scheme == "" || u.Host == "" {
+			return errors.New("invalid remote server addr")
+		}
+	case "mock", "fake":
 		return nil
 	default:
 		return errors.New("unknown image hub type")
 	}
 	return nil
 }
+
+func (cfg *RetryConfig) CheckAndRefine() error {
+	if cfg.MaxAttempts < 0 || cfg.InitialInterval < 0 || cfg.MaxInterval < 0 || cfg.Multiplier < 0 {
+		return errors.New("retry settings should not be negative")
+	}
+	if err := ApplyMissingDefaults(cfg); err != nil {
+		return err
+	}
+	if cfg.Multiplier < 1 {
+		return errors.New("retry multiplier should not be less than 1")
+	}
+	for _, kind := range cfg.RetryOn {
+		if _, ok := ErrorKinds[kind]; !ok {
+			return errors.Errorf("unknown error kind %q in retry_on", kind)
+		}
+	}
+	return nil
+}
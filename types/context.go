@@ -0,0 +1,20 @@
+package types
+
+import (
+	"context"
+)
+
+type keepFilesKey struct{}
+
+// WithKeepFiles asks RemoveLocal to keep the file of the removed image when
+// the backend stores it apart from the image, like docker's store dir. The
+// lease manager sets it when a leased image is removed by force.
+func WithKeepFiles(ctx context.Context) context.Context {
+	return context.WithValue(ctx, keepFilesKey{}, true)
+}
+
+// KeepFiles reports whether ctx comes from WithKeepFiles.
+func KeepFiles(ctx context.Context) bool {
+	keep, _ := ctx.Value(keepFilesKey{}).(bool)
+	return keep
+}
@@ -0,0 +1,198 @@
+package types
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	dockerHubRegistry = "docker.io"
+	dockerHubAuthKey  = "https://index.docker.io/v1/"
+	// credential helpers return this username when the secret is an identity token
+	tokenUsername = "<token>"
+)
+
+// DockerCredential is what is needed to authenticate against a registry,
+// either a username and password or an identity token.
+type DockerCredential struct {
+	Username      string
+	Password      string
+	IdentityToken string
+}
+
+func (cred *DockerCredential) empty() bool {
+	return cred.IdentityToken == "" && (cred.Username == "" || cred.Password == "")
+}
+
+type dockerAuthEntry struct {
+	Auth          string `json:"auth"`
+	Username      string `json:"username"`
+	Password      string `json:"password"`
+	IdentityToken string `json:"identitytoken"`
+}
+
+type dockerConfigFile struct {
+	Auths       map[string]dockerAuthEntry `json:"auths"`
+	CredsStore  string                     `json:"credsStore"`
+	CredHelpers map[string]string          `json:"credHelpers"`
+}
+
+// DefaultDockerConfigFile returns $DOCKER_CONFIG/config.json or ~/.docker/config.json.
+func DefaultDockerConfigFile() string {
+	if dir := os.Getenv("DOCKER_CONFIG"); dir != "" {
+		return filepath.Join(dir, "config.json")
+	}
+	home, _ := os.UserHomeDir()
+	return filepath.Join(home, ".docker", "config.json")
+}
+
+// RegistryHost returns the registry host of an image prefix such as
+// "harbor.example.com/yavirt", prefixes without a host refer to docker hub.
+func RegistryHost(prefix string) string {
+	first, _, found := strings.Cut(prefix, "/")
+	if found && (strings.ContainsAny(first, ".:") || first == "localhost") {
+		return first
+	}
+	return dockerHubRegistry
+}
+
+// LoadDockerCredential looks up the credential of registry the same way the
+// docker cli does: the registry's credential helper, then the global
+// credential store, then the auths section of the config file.
+// It returns nil without error when nothing is found.
+func LoadDockerCredential(configFile, registry string) (*DockerCredential, error) {
+	if configFile == "" {
+		configFile = DefaultDockerConfigFile()
+	}
+	bs, err := os.ReadFile(configFile)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var dcf dockerConfigFile
+	if err := json.Unmarshal(bs, &dcf); err != nil {
+		return nil, errors.Wrapf(err, "failed to parse %s", configFile)
+	}
+
+	keys := authKeys(registry)
+	helper := dcf.CredsStore
+	if h, ok := dcf.CredHelpers[registry]; ok {
+		helper = h
+	} else if h, ok := dcf.CredHelpers[keys[1]]; ok && registry == dockerHubRegistry {
+		helper = h
+	}
+	if helper != "" {
+		// helpers are keyed by the server address the docker cli logs in
+		// to, which is the v1 index url for docker hub
+		cred, err := credentialFromHelper(helper, keys[0])
+		if err != nil {
+			return nil, err
+		}
+		if cred != nil {
+			return cred, nil
+		}
+	}
+	for _, key := range keys {
+		if entry, ok := dcf.Auths[key]; ok {
+			return credentialFromEntry(&entry)
+		}
+	}
+	return nil, nil
+}
+
+func authKeys(registry string) []string {
+	if registry == dockerHubRegistry || registry == "index.docker.io" {
+		return []string{dockerHubAuthKey, "index.docker.io", dockerHubRegistry}
+	}
+	return []string{registry, "https://" + registry, "http://" + registry, "https://" + registry + "/v1/"}
+}
+
+func credentialFromEntry(entry *dockerAuthEntry) (*DockerCredential, error) {
+	cred := &DockerCredential{
+		Username:      entry.Username,
+		Password:      entry.Password,
+		IdentityToken: entry.IdentityToken,
+	}
+	if entry.Auth != "" {
+		decoded, err := base64.StdEncoding.DecodeString(entry.Auth)
+		if err != nil {
+			return nil, errors.Wrap(err, "invalid auth in docker config")
+		}
+		user, password, ok := strings.Cut(string(decoded), ":")
+		if !ok {
+			return nil, errors.New("invalid auth in docker config")
+		}
+		cred.Username, cred.Password = user, password
+	}
+	if cred.empty() {
+		return nil, nil
+	}
+	return cred, nil
+}
+
+// credentialFromHelper runs `docker-credential-<helper> get`, it returns nil
+// without error when the helper has no credential for registry.
+func credentialFromHelper(helper, registry string) (*DockerCredential, error) {
+	cmd := exec.Command("docker-credential-"+helper, "get") //nolint:gosec
+	cmd.Stdin = strings.NewReader(registry)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	if err := cmd.Run(); err != nil {
+		msg := strings.TrimSpace(stdout.String() + stderr.String())
+		if strings.Contains(msg, "credentials not found") {
+			return nil, nil
+		}
+		return nil, errors.Wrapf(err, "credential helper %s failed: %s", helper, msg)
+	}
+	var resp struct {
+		Username string `json:"Username"`
+		Secret   string `json:"Secret"`
+	}
+	if err := json.Unmarshal(stdout.Bytes(), &resp); err != nil {
+		return nil, errors.Wrapf(err, "invalid output of credential helper %s", helper)
+	}
+	if resp.Username == tokenUsername {
+		return &DockerCredential{IdentityToken: resp.Secret}, nil
+	}
+	return &DockerCredential{Username: resp.Username, Password: resp.Secret}, nil
+}
+
+// RegistryAuth returns the X-Registry-Auth value for the images of registry,
+// empty meaning the registry of Prefix whose credential is Auth. The
+// credentials of other registries are looked up in ConfigFile, "" is
+// returned when there is none so that the daemon pulls anonymously.
+func (cfg *DockerConfig) RegistryAuth(registry string) (string, error) {
+	if registry == "" || registry == RegistryHost(cfg.Prefix) {
+		return cfg.Auth, nil
+	}
+	cred, err := LoadDockerCredential(cfg.ConfigFile, registry)
+	if err != nil {
+		return "", errors.Wrapf(err, "failed to load docker credential of %s", registry)
+	}
+	if cred == nil {
+		return "", nil
+	}
+	return encodeDockerAuth(cred, registry), nil
+}
+
+// encodeDockerAuth builds the base64 X-Registry-Auth value understood by the docker daemon.
+func encodeDockerAuth(cred *DockerCredential, registry string) string {
+	auth := map[string]string{"serveraddress": registry}
+	if cred.IdentityToken != "" {
+		auth["identitytoken"] = cred.IdentityToken
+	} else {
+		auth["username"] = cred.Username
+		auth["password"] = cred.Password
+	}
+	authBytes, _ := json.Marshal(auth)
+	return base64.StdEncoding.EncodeToString(authBytes)
+}
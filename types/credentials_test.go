@@ -0,0 +1,134 @@
+package types
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func writeDockerConfig(t *testing.T, dcf map[string]any) string {
+	fname := filepath.Join(t.TempDir(), "config.json")
+	bs, _ := json.Marshal(dcf)
+	assert.Nil(t, os.WriteFile(fname, bs, 0600))
+	return fname
+}
+
+func decodeAuth(t *testing.T, auth string) map[string]string {
+	bs, err := base64.StdEncoding.DecodeString(auth)
+	assert.Nil(t, err)
+	ans := map[string]string{}
+	assert.Nil(t, json.Unmarshal(bs, &ans))
+	return ans
+}
+
+func TestRegistryHost(t *testing.T) {
+	assert.Equal(t, "harbor.example.com", RegistryHost("harbor.example.com/yavirt"))
+	assert.Equal(t, "localhost:5000", RegistryHost("localhost:5000/yavirt"))
+	assert.Equal(t, "docker.io", RegistryHost("yavirt"))
+	assert.Equal(t, "docker.io", RegistryHost(""))
+}
+
+func TestCredentialFromConfigFile(t *testing.T) {
+	fname := writeDockerConfig(t, map[string]any{
+		"auths": map[string]any{
+			"https://harbor.example.com": map[string]string{
+				"auth": base64.StdEncoding.EncodeToString([]byte("bob:secret")),
+			},
+			"token.example.com": map[string]string{"identitytoken": "tkn"},
+		},
+	})
+	cfg := &Config{
+		Type: "docker",
+		Docker: DockerConfig{
+			Prefix:     "harbor.example.com/yavirt",
+			ConfigFile: fname,
+		},
+	}
+	assert.Nil(t, cfg.CheckAndRefine())
+	// a config built in code gets the defaults too
+	assert.Equal(t, "/var/lib/vmimage/docker", cfg.Docker.StoreDir)
+	auth := decodeAuth(t, cfg.Docker.Auth)
+	assert.Equal(t, "bob", auth["username"])
+	assert.Equal(t, "secret", auth["password"])
+	assert.Equal(t, "harbor.example.com", auth["serveraddress"])
+
+	cfg.Docker.Prefix = "token.example.com/yavirt"
+	assert.Nil(t, cfg.CheckAndRefine())
+	auth = decodeAuth(t, cfg.Docker.Auth)
+	assert.Equal(t, "tkn", auth["identitytoken"])
+	assert.Empty(t, auth["password"])
+
+	cfg.Docker.Prefix = "other.example.com/yavirt"
+	assert.NotNil(t, cfg.CheckAndRefine())
+}
+
+func TestCredentialHelper(t *testing.T) {
+	binDir := t.TempDir()
+	script := `#!/bin/sh
+read server
+case "$server" in
+  harbor.example.com) echo '{"ServerURL":"harbor.example.com","Username":"alice","Secret":"pw"}' ;;
+  https://index.docker.io/v1/) echo '{"ServerURL":"https://index.docker.io/v1/","Username":"dave","Secret":"hub"}' ;;
+  token.example.com) echo '{"ServerURL":"token.example.com","Username":"<token>","Secret":"tkn"}' ;;
+  *) echo "credentials not found in native keychain"; exit 1 ;;
+esac
+`
+	assert.Nil(t, os.WriteFile(filepath.Join(binDir, "docker-credential-fake"), []byte(script), 0700)) //nolint:gosec
+	t.Setenv("PATH", binDir+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	fname := writeDockerConfig(t, map[string]any{
+		"credsStore": "fake",
+		"auths": map[string]any{
+			"fallback.example.com": map[string]string{"username": "carol", "password": "pw2"},
+		},
+	})
+	cred, err := LoadDockerCredential(fname, "harbor.example.com")
+	assert.Nil(t, err)
+	assert.Equal(t, &DockerCredential{Username: "alice", Password: "pw"}, cred)
+
+	cred, err = LoadDockerCredential(fname, "token.example.com")
+	assert.Nil(t, err)
+	assert.Equal(t, &DockerCredential{IdentityToken: "tkn"}, cred)
+
+	cred, err = LoadDockerCredential(fname, "docker.io")
+	assert.Nil(t, err)
+	assert.Equal(t, &DockerCredential{Username: "dave", Password: "hub"}, cred)
+
+	// the helper has nothing, so the auths section is used
+	cred, err = LoadDockerCredential(fname, "fallback.example.com")
+	assert.Nil(t, err)
+	assert.Equal(t, &DockerCredential{Username: "carol", Password: "pw2"}, cred)
+
+	cred, err = LoadDockerCredential(filepath.Join(t.TempDir(), "missing.json"), "harbor.example.com")
+	assert.Nil(t, err)
+	assert.Nil(t, cred)
+}
+
+func TestRegistryAuth(t *testing.T) {
+	fname := writeDockerConfig(t, map[string]any{
+		"auths": map[string]any{
+			"other.example.com": map[string]string{"username": "erin", "password": "pw3"},
+		},
+	})
+	cfg := &DockerConfig{Prefix: "harbor.example.com/yavirt", Auth: "configured", ConfigFile: fname}
+	for _, registry := range []string{"", "harbor.example.com"} {
+		auth, err := cfg.RegistryAuth(registry)
+		assert.Nil(t, err)
+		assert.Equal(t, "configured", auth)
+	}
+
+	auth, err := cfg.RegistryAuth("other.example.com")
+	assert.Nil(t, err)
+	decoded := decodeAuth(t, auth)
+	assert.Equal(t, "erin", decoded["username"])
+	assert.Equal(t, "other.example.com", decoded["serveraddress"])
+
+	// no credential, pulled anonymously
+	auth, err = cfg.RegistryAuth("public.example.com")
+	assert.Nil(t, err)
+	assert.Empty(t, auth)
+}
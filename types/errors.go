@@ -0,0 +1,58 @@
+package types
+
+import (
+	"errors"
+	"strings"
+)
+
+// Errors returned by every Manager implementation, the backend specific
+// error is kept in the chain so both can be inspected with errors.Is/As.
+var (
+	ErrInvalidImageName = errors.New("invalid image name")
+	ErrImageNotFound    = errors.New("image not found")
+	ErrUnauthorized     = errors.New("unauthorized")
+	ErrConflict         = errors.New("conflict")
+	ErrDigestMismatch   = errors.New("digest mismatch")
+	ErrUnavailable      = errors.New("image hub unavailable")
+)
+
+// ErrorKinds names the errors above in configs.
+var ErrorKinds = map[string]error{
+	"invalid_image_name": ErrInvalidImageName,
+	"not_found":          ErrImageNotFound,
+	"unauthorized":       ErrUnauthorized,
+	"conflict":           ErrConflict,
+	"digest_mismatch":    ErrDigestMismatch,
+	"unavailable":        ErrUnavailable,
+}
+
+// Error attaches one of the sentinel errors above to a backend error.
+type Error struct {
+	Kind error
+	Err  error
+}
+
+// NewError wraps err with kind, it returns nil when err is nil and keeps err
+// untouched when it already carries a kind.
+func NewError(kind, err error) error {
+	if err == nil {
+		return nil
+	}
+	var e *Error
+	if errors.As(err, &e) {
+		return err
+	}
+	return &Error{Kind: kind, Err: err}
+}
+
+func (e *Error) Error() string {
+	msg := e.Err.Error()
+	if strings.HasPrefix(msg, e.Kind.Error()) {
+		return msg
+	}
+	return e.Kind.Error() + ": " + msg
+}
+
+func (e *Error) Unwrap() []error {
+	return []error{e.Kind, e.Err}
+}
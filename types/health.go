@@ -0,0 +1,82 @@
+package types
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Names of the checks found in a HealthReport.
+const (
+	HealthCheckDaemon   = "daemon"
+	HealthCheckRegistry = "registry"
+	HealthCheckAuth     = "auth"
+	HealthCheckStorage  = "storage"
+)
+
+// HealthCheck is the result of one probe.
+type HealthCheck struct {
+	Name    string        `json:"name"`
+	OK      bool          `json:"ok"`
+	Latency time.Duration `json:"latency"`
+	Error   string        `json:"error,omitempty"`
+}
+
+// HealthReport is what CheckHealth found out about a backend.
+type HealthReport struct {
+	Backend string        `json:"backend"`
+	Checks  []HealthCheck `json:"checks"`
+	// StorageFree is the free space, in bytes, of the local image store
+	StorageFree uint64 `json:"storage_free"`
+}
+
+// Probe runs fn, records its result and latency as the check name and
+// returns fn's error.
+func (r *HealthReport) Probe(ctx context.Context, name string, fn func(context.Context) error) error {
+	start := time.Now()
+	err := fn(ctx)
+	check := HealthCheck{
+		Name:    name,
+		OK:      err == nil,
+		Latency: time.Since(start),
+	}
+	if err != nil {
+		check.Error = err.Error()
+	}
+	r.Checks = append(r.Checks, check)
+	return err
+}
+
+// Check returns the check called name, or nil if it wasn't run.
+func (r *HealthReport) Check(name string) *HealthCheck {
+	for idx := range r.Checks {
+		if r.Checks[idx].Name == name {
+			return &r.Checks[idx]
+		}
+	}
+	return nil
+}
+
+func (r *HealthReport) Healthy() bool {
+	for _, check := range r.Checks {
+		if !check.OK {
+			return false
+		}
+	}
+	return true
+}
+
+// Err summarizes the failed checks, it returns nil for a healthy report.
+func (r *HealthReport) Err() error {
+	var failed []string
+	for _, check := range r.Checks {
+		if !check.OK {
+			failed = append(failed, fmt.Sprintf("%s: %s", check.Name, check.Error))
+		}
+	}
+	if len(failed) == 0 {
+		return nil
+	}
+	return NewError(ErrUnavailable, fmt.Errorf("%s is unhealthy: %s", r.Backend, strings.Join(failed, "; ")))
+}
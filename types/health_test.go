@@ -0,0 +1,29 @@
+package types
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHealthReport(t *testing.T) {
+	report := &HealthReport{Backend: "docker"}
+	assert.Nil(t, report.Probe(context.Background(), HealthCheckDaemon, func(context.Context) error { return nil }))
+	assert.True(t, report.Healthy())
+	assert.Nil(t, report.Err())
+
+	err := report.Probe(context.Background(), HealthCheckRegistry, func(context.Context) error {
+		return errors.New("connection refused")
+	})
+	assert.EqualError(t, err, "connection refused")
+	assert.False(t, report.Healthy())
+	assert.True(t, report.Check(HealthCheckDaemon).OK)
+	assert.Equal(t, "connection refused", report.Check(HealthCheckRegistry).Error)
+	assert.Nil(t, report.Check(HealthCheckAuth))
+
+	err = report.Err()
+	assert.ErrorIs(t, err, ErrUnavailable)
+	assert.Contains(t, err.Error(), "docker is unhealthy: registry: connection refused")
+}
@@ -25,6 +25,7 @@ type OSInfo struct {
 }
 
 type Image struct {
+	Registry string `json:"registry,omitempty" description:"registry host, empty means the configured one"`
 	Username string `json:"username"`
 	Name     string `json:"name"`
 	Tag      string `json:"tag" description:"image tag, default:latest"`
@@ -33,6 +34,16 @@ type Image struct {
 	Size     int64  `json:"size"`
 	Digest   string `json:"digest" description:"image digest"`
 	Snapshot string `json:"snapshot" description:"image rbd snapshot"`
+	// PinnedDigest is the "algo:hex" digest given after '@' in the image name.
+	// Whatever the backend it is the sha256 of the image file, like Digest,
+	// never a registry manifest digest, so a reference resolves the same on
+	// every backend. The image is still looked up by its tag, backends refuse
+	// to use it when its file doesn't match the pinned digest.
+	PinnedDigest string `json:"pinned_digest,omitempty" description:"digest the image name is pinned to"`
+	// Platform ("os/arch") is the platform Pull asks for, the host's when it
+	// is empty. It never changes Tag, and Prepare refuses it because
+	// multi-arch images aren't supported.
+	Platform string `json:"platform,omitempty" description:"platform of the image variant"`
 
 	ActualSize  int64
 	VirtualSize int64
@@ -40,14 +51,16 @@ type Image struct {
 }
 
 func NewImage(fullname string) (*Image, error) {
-	user, name, tag, err := utils.NormalizeImageName(fullname)
+	ref, err := utils.ParseReference(fullname)
 	if err != nil {
-		return nil, err
+		return nil, NewError(ErrInvalidImageName, err)
 	}
 	return &Image{
-		Username: user,
-		Name:     name,
-		Tag:      tag,
+		Registry:     ref.Registry,
+		Username:     ref.Namespace,
+		Name:         ref.Name,
+		Tag:          ref.Tag,
+		PinnedDigest: ref.Digest,
 	}, nil
 }
 
@@ -59,6 +72,33 @@ func (img *Image) Fullname() string {
 	}
 }
 
+// Reference returns the full image name including registry and pinned digest.
+func (img *Image) Reference() string {
+	ref := utils.Reference{
+		Registry:  img.Registry,
+		Namespace: img.Username,
+		Name:      img.Name,
+		Tag:       img.Tag,
+		Digest:    img.PinnedDigest,
+	}
+	return ref.String()
+}
+
+// MatchPinnedDigest checks digest, a hex sha256 or an "algo:hex" string,
+// against the pinned digest. It always succeeds for images that aren't pinned.
+func (img *Image) MatchPinnedDigest(digest string) error {
+	if img.PinnedDigest == "" {
+		return nil
+	}
+	if !strings.Contains(digest, ":") {
+		digest = "sha256:" + digest
+	}
+	if digest != img.PinnedDigest {
+		return NewError(ErrDigestMismatch, fmt.Errorf("image %s has digest %s", img.Reference(), digest))
+	}
+	return nil
+}
+
 func (img *Image) RBDName() string {
 	name := strings.ReplaceAll(img.Fullname(), "/", ".")
 	return strings.ReplaceAll(name, ":", "-")
@@ -0,0 +1,26 @@
+package types
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewImageWithReference(t *testing.T) {
+	hex := strings.Repeat("ab", 32)
+	img, err := NewImage("hub.example.com/team/user/ubuntu:22.04@sha256:" + hex)
+	assert.Nil(t, err)
+	assert.Equal(t, "hub.example.com", img.Registry)
+	assert.Equal(t, "team/user", img.Username)
+	assert.Equal(t, "team/user/ubuntu:22.04", img.Fullname())
+	assert.Equal(t, "hub.example.com/team/user/ubuntu:22.04@sha256:"+hex, img.Reference())
+
+	assert.Nil(t, img.MatchPinnedDigest(hex))
+	assert.Nil(t, img.MatchPinnedDigest("sha256:"+hex))
+	assert.ErrorIs(t, img.MatchPinnedDigest(strings.Repeat("cd", 32)), ErrDigestMismatch)
+
+	_, err = NewImage("bad//name")
+	assert.ErrorIs(t, err, ErrInvalidImageName)
+	assert.EqualError(t, err, "invalid image name: bad//name")
+}
@@ -0,0 +1,168 @@
+package types
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/pkg/errors"
+)
+
+// EnvPrefix prefixes the environment variables which override the config,
+// a field's variable is made of its toml keys, e.g. VMIMAGE_DOCKER_ENDPOINT.
+const EnvPrefix = "VMIMAGE"
+
+// LoadConfig builds a Config from the declared defaults, the TOML file at
+// fname (skipped when fname is empty) and the environment, in that order,
+// and then checks it with CheckAndRefine.
+func LoadConfig(fname string) (*Config, error) {
+	cfg, err := ReadConfig(fname)
+	if err != nil {
+		return nil, err
+	}
+	if err := cfg.CheckAndRefine(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// ReadConfig is LoadConfig without the check, for callers which change the
+// config before checking it.
+func ReadConfig(fname string) (*Config, error) {
+	cfg := &Config{}
+	if err := ApplyDefaults(cfg); err != nil {
+		return nil, err
+	}
+	if fname != "" {
+		if _, err := toml.DecodeFile(fname, cfg); err != nil {
+			return nil, errors.Wrapf(err, "failed to load config file %s", fname)
+		}
+	}
+	if err := ApplyEnv(cfg, EnvPrefix); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// ApplyDefaults sets every field of the struct pointed to by v which has a
+// `default` tag to that value.
+func ApplyDefaults(v any) error {
+	return walkFields(reflect.ValueOf(v).Elem(), "", func(field reflect.Value, sf reflect.StructField, _ string) error {
+		def, ok := sf.Tag.Lookup("default")
+		if !ok {
+			return nil
+		}
+		return errors.Wrapf(setField(field, def), "invalid default of %s", sf.Name)
+	})
+}
+
+// ApplyEnv overrides the fields of the struct pointed to by v with the
+// environment variables named after their toml keys.
+func ApplyEnv(v any, prefix string) error {
+	return walkFields(reflect.ValueOf(v).Elem(), prefix, func(field reflect.Value, _ reflect.StructField, key string) error {
+		val, ok := os.LookupEnv(key)
+		if !ok {
+			return nil
+		}
+		return errors.Wrapf(setField(field, val), "invalid value of %s", key)
+	})
+}
+
+// ApplyMissingDefaults is ApplyDefaults for the fields which are still zero,
+// it completes configs built in code.
+func ApplyMissingDefaults(v any) error {
+	return walkFields(reflect.ValueOf(v).Elem(), "", func(field reflect.Value, sf reflect.StructField, _ string) error {
+		def, ok := sf.Tag.Lookup("default")
+		if !ok || !field.IsZero() {
+			return nil
+		}
+		return errors.Wrapf(setField(field, def), "invalid default of %s", sf.Name)
+	})
+}
+
+func walkFields(v reflect.Value, prefix string, fn func(reflect.Value, reflect.StructField, string) error) error {
+	t := v.Type()
+	for idx := 0; idx < t.NumField(); idx++ {
+		sf := t.Field(idx)
+		if !sf.IsExported() {
+			continue
+		}
+		name, _, _ := strings.Cut(sf.Tag.Get("toml"), ",")
+		if name == "-" {
+			continue
+		}
+		if name == "" {
+			name = sf.Name
+		}
+		key := strings.ToUpper(name)
+		if prefix != "" {
+			key = prefix + "_" + key
+		}
+		field := v.Field(idx)
+		if field.Kind() == reflect.Struct {
+			if err := walkFields(field, key, fn); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := fn(field, sf, key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func setField(field reflect.Value, val string) error {
+	if field.Type() == reflect.TypeOf(time.Duration(0)) {
+		d, err := time.ParseDuration(val)
+		if err != nil {
+			return err
+		}
+		field.SetInt(int64(d))
+		return nil
+	}
+	switch field.Kind() { //nolint:exhaustive
+	case reflect.String:
+		field.SetString(val)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(val)
+		if err != nil {
+			return err
+		}
+		field.SetBool(b)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n, err := strconv.ParseInt(val, 10, 64)
+		if err != nil {
+			return err
+		}
+		field.SetInt(n)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		n, err := strconv.ParseUint(val, 10, 64)
+		if err != nil {
+			return err
+		}
+		field.SetUint(n)
+	case reflect.Float32, reflect.Float64:
+		f, err := strconv.ParseFloat(val, 64)
+		if err != nil {
+			return err
+		}
+		field.SetFloat(f)
+	case reflect.Slice:
+		if field.Type().Elem().Kind() != reflect.String {
+			return fmt.Errorf("unsupported type %s", field.Type())
+		}
+		parts := strings.Split(val, ",")
+		for idx := range parts {
+			parts[idx] = strings.TrimSpace(parts[idx])
+		}
+		field.Set(reflect.ValueOf(parts))
+	default:
+		return fmt.Errorf("unsupported type %s", field.Type())
+	}
+	return nil
+}
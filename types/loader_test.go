@@ -0,0 +1,65 @@
+package types
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLoadConfig(t *testing.T) {
+	fname := filepath.Join(t.TempDir(), "vmimage.toml")
+	content := `
+type = "docker"
+
+[docker]
+prefix = "harbor.example.com/yavirt"
+username = "admin"
+password = "file-password"
+
+[retry]
+max_attempts = 5
+initial_interval = "1s"
+`
+	assert.Nil(t, os.WriteFile(fname, []byte(content), 0600))
+	t.Setenv("VMIMAGE_DOCKER_PASSWORD", "env-password")
+	t.Setenv("VMIMAGE_RETRY_MULTIPLIER", "1.5")
+
+	cfg, err := LoadConfig(fname)
+	assert.Nil(t, err)
+	// defaults
+	assert.Equal(t, "unix:///var/run/docker.sock", cfg.Docker.Endpoint)
+	assert.Equal(t, 10*time.Second, cfg.Retry.MaxInterval)
+	// file
+	assert.Equal(t, "harbor.example.com/yavirt", cfg.Docker.Prefix)
+	assert.Equal(t, 5, cfg.Retry.MaxAttempts)
+	assert.Equal(t, time.Second, cfg.Retry.InitialInterval)
+	// environment
+	assert.Equal(t, "env-password", cfg.Docker.Password)
+	assert.Equal(t, 1.5, cfg.Retry.Multiplier)
+	// CheckAndRefine
+	assert.NotEmpty(t, cfg.Docker.Auth)
+}
+
+func TestLoadConfigErrors(t *testing.T) {
+	_, err := LoadConfig(filepath.Join(t.TempDir(), "missing.toml"))
+	assert.NotNil(t, err)
+
+	t.Setenv("VMIMAGE_TYPE", "mock")
+	t.Setenv("VMIMAGE_RETRY_MAX_ATTEMPTS", "many")
+	_, err = LoadConfig("")
+	assert.ErrorContains(t, err, "VMIMAGE_RETRY_MAX_ATTEMPTS")
+}
+
+func TestRetryConfigDefaults(t *testing.T) {
+	cfg := &RetryConfig{MaxAttempts: 5}
+	assert.Nil(t, cfg.CheckAndRefine())
+	assert.Equal(t, 5, cfg.MaxAttempts)
+	assert.Equal(t, 500*time.Millisecond, cfg.InitialInterval)
+	assert.Equal(t, []string{"unavailable"}, cfg.RetryOn)
+
+	cfg.RetryOn = []string{"timeout"}
+	assert.ErrorContains(t, cfg.CheckAndRefine(), "timeout")
+}
@@ -0,0 +1,83 @@
+package types
+
+import (
+	"fmt"
+	"runtime"
+	"strings"
+)
+
+// Multi-arch images aren't supported, a tag holds a single image. Pull
+// with Image.Platform set lets the docker daemon select the variant of a
+// manifest list built by other tools, the other backends only refuse a tag
+// built for another architecture.
+
+// ParsePlatform parses "os/arch[/variant]" or a bare "arch".
+func ParsePlatform(platform string) (os, arch string, err error) {
+	parts := strings.Split(strings.ToLower(platform), "/")
+	switch len(parts) {
+	case 1:
+		os, arch = "linux", parts[0]
+	case 2, 3:
+		os, arch = parts[0], parts[1]
+	default:
+		return "", "", fmt.Errorf("invalid platform: %s", platform)
+	}
+	if os == "" || arch == "" {
+		return "", "", fmt.Errorf("invalid platform: %s", platform)
+	}
+	return os, NormalizeArch(arch), nil
+}
+
+// NormalizeArch maps the usual aliases onto GOARCH style names.
+func NormalizeArch(arch string) string {
+	switch strings.ToLower(arch) {
+	case "x86_64", "x86-64":
+		return "amd64"
+	case "aarch64":
+		return "arm64"
+	default:
+		return strings.ToLower(arch)
+	}
+}
+
+// HostPlatform returns the platform of the running host.
+func HostPlatform() string {
+	return "linux/" + runtime.GOARCH
+}
+
+// TargetArch returns the architecture of the explicit platform, or the host's.
+func (img *Image) TargetArch() (string, error) {
+	platform := img.Platform
+	if platform == "" {
+		platform = HostPlatform()
+	}
+	_, arch, err := ParsePlatform(platform)
+	return arch, err
+}
+
+// CheckPlatform fails with ErrImageNotFound when the explicit platform of
+// img asks for another architecture than arch, the architecture of the
+// image found under img's tag. An empty arch matches every platform.
+func (img *Image) CheckPlatform(arch string) error {
+	if img.Platform == "" || arch == "" {
+		return nil
+	}
+	target, err := img.TargetArch()
+	if err != nil {
+		return err
+	}
+	if NormalizeArch(arch) != target {
+		return NewError(ErrImageNotFound, fmt.Errorf("image %s is built for %s, not %s", img.Fullname(), arch, img.Platform))
+	}
+	return nil
+}
+
+// RejectPlatform fails when img has an explicit platform. Prepare can't
+// add a variant to a tag, it would replace the image of the other
+// architecture, the architecture of a prepared image goes in OS.Arch.
+func (img *Image) RejectPlatform() error {
+	if img.Platform == "" {
+		return nil
+	}
+	return fmt.Errorf("can't prepare %s for platform %s, multi-arch images aren't supported", img.Fullname(), img.Platform)
+}
@@ -0,0 +1,54 @@
+package types
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParsePlatform(t *testing.T) {
+	tests := []struct {
+		platform string
+		os       string
+		arch     string
+		hasErr   bool
+	}{
+		{"linux/amd64", "linux", "amd64", false},
+		{"linux/arm64/v8", "linux", "arm64", false},
+		{"aarch64", "linux", "arm64", false},
+		{"Linux/X86_64", "linux", "amd64", false},
+		{"linux/", "", "", true},
+		{"a/b/c/d", "", "", true},
+	}
+	for _, test := range tests {
+		os, arch, err := ParsePlatform(test.platform)
+		if test.hasErr {
+			assert.NotNil(t, err, test.platform)
+			continue
+		}
+		assert.Nil(t, err, test.platform)
+		assert.Equal(t, test.os, os)
+		assert.Equal(t, test.arch, arch)
+	}
+}
+
+func TestCheckPlatform(t *testing.T) {
+	img := &Image{Name: "ubuntu", Tag: "22.04"}
+	assert.Nil(t, img.CheckPlatform("riscv64"))
+
+	img.Platform = "linux/arm64"
+	assert.Nil(t, img.CheckPlatform("aarch64"))
+	assert.Nil(t, img.CheckPlatform(""))
+	assert.ErrorIs(t, img.CheckPlatform("amd64"), ErrImageNotFound)
+
+	img.Platform = "a/b/c/d"
+	assert.NotNil(t, img.CheckPlatform("amd64"))
+}
+
+func TestRejectPlatform(t *testing.T) {
+	img := &Image{Name: "ubuntu", Tag: "22.04"}
+	assert.Nil(t, img.RejectPlatform())
+
+	img.Platform = "linux/arm64"
+	assert.EqualError(t, img.RejectPlatform(), "can't prepare ubuntu:22.04 for platform linux/arm64, multi-arch images aren't supported")
+}
@@ -0,0 +1,92 @@
+package types
+
+import (
+	"fmt"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const defaultReplicationInterval = time.Hour
+
+type ReplicationConfig struct {
+	Rules []ReplicationRule `toml:"rules"`
+}
+
+// ReplicationRule keeps the images of Source's registry matching Images
+// copied to Destination's, both are manager types such as "docker" or
+// "vmihub" whose managers implement vmimage.RemoteLister.
+type ReplicationRule struct {
+	Name        string `toml:"name"`
+	Source      string `toml:"source"`
+	Destination string `toml:"destination"`
+	// Images are path.Match patterns of image names, e.g. "user1/*" or
+	// "*:22.04". A pattern without a tag matches every tag. Empty means
+	// all the images of Source.
+	Images   []string      `toml:"images"`
+	Interval time.Duration `toml:"interval"`
+}
+
+func (cfg *ReplicationConfig) CheckAndRefine() error {
+	names := map[string]bool{}
+	for idx := range cfg.Rules {
+		rule := &cfg.Rules[idx]
+		if rule.Source == "" || rule.Destination == "" {
+			return errors.Errorf("replication rule %d: source and destination should not be empty", idx)
+		}
+		if rule.Source == rule.Destination {
+			return errors.Errorf("replication rule %d: source and destination are both %s", idx, rule.Source)
+		}
+		if rule.Name == "" {
+			rule.Name = fmt.Sprintf("%s-to-%s-%d", rule.Source, rule.Destination, idx)
+		}
+		if names[rule.Name] {
+			return errors.Errorf("duplicated replication rule %s", rule.Name)
+		}
+		names[rule.Name] = true
+		if rule.Interval < 0 {
+			return errors.Errorf("replication rule %s: interval should not be negative", rule.Name)
+		}
+		if rule.Interval == 0 {
+			rule.Interval = defaultReplicationInterval
+		}
+		for _, pattern := range rule.Images {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return errors.Wrapf(err, "replication rule %s: invalid pattern %s", rule.Name, pattern)
+			}
+		}
+	}
+	return nil
+}
+
+// Backends returns the manager types used by the rules.
+func (cfg *ReplicationConfig) Backends() []string {
+	var ans []string
+	for _, rule := range cfg.Rules {
+		ans = append(ans, rule.Source, rule.Destination)
+	}
+	return ans
+}
+
+// Match reports whether img is selected by the rule.
+func (rule *ReplicationRule) Match(img *Image) bool {
+	if len(rule.Images) == 0 {
+		return true
+	}
+	fullname := img.Fullname()
+	untagged := strings.TrimSuffix(fullname, ":"+img.Tag)
+	for _, pattern := range rule.Images {
+		if ok, _ := path.Match(pattern, fullname); ok {
+			return true
+		}
+		if strings.Contains(pattern, ":") {
+			continue
+		}
+		if ok, _ := path.Match(pattern, untagged); ok {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,59 @@
+package types
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReplicationCheckAndRefine(t *testing.T) {
+	cfg := &ReplicationConfig{Rules: []ReplicationRule{
+		{Source: "docker", Destination: "vmihub"},
+		{Name: "dr", Source: "vmihub", Destination: "remote", Interval: time.Minute},
+	}}
+	assert.Nil(t, cfg.CheckAndRefine())
+	assert.Equal(t, "docker-to-vmihub-0", cfg.Rules[0].Name)
+	assert.Equal(t, time.Hour, cfg.Rules[0].Interval)
+	assert.Equal(t, time.Minute, cfg.Rules[1].Interval)
+	assert.Equal(t, []string{"docker", "vmihub", "vmihub", "remote"}, cfg.Backends())
+
+	tests := []ReplicationRule{
+		{Source: "docker"},
+		{Source: "docker", Destination: "docker"},
+		{Source: "docker", Destination: "vmihub", Interval: -time.Second},
+		{Source: "docker", Destination: "vmihub", Images: []string{"[a-"}},
+	}
+	for _, rule := range tests {
+		cfg := &ReplicationConfig{Rules: []ReplicationRule{rule}}
+		assert.Error(t, cfg.CheckAndRefine(), "%+v", rule)
+	}
+	dup := &ReplicationConfig{Rules: []ReplicationRule{
+		{Name: "a", Source: "docker", Destination: "vmihub"},
+		{Name: "a", Source: "vmihub", Destination: "docker"},
+	}}
+	assert.ErrorContains(t, dup.CheckAndRefine(), "duplicated")
+}
+
+func TestReplicationRuleMatch(t *testing.T) {
+	tests := []struct {
+		patterns []string
+		image    string
+		expected bool
+	}{
+		{nil, "user1/ubuntu:22.04", true},
+		{[]string{"user1/*"}, "user1/ubuntu:22.04", true},
+		{[]string{"user1/*"}, "user2/ubuntu:22.04", false},
+		{[]string{"*"}, "user1/ubuntu:22.04", false},
+		{[]string{"*"}, "ubuntu:22.04", true},
+		{[]string{"*:22.04"}, "ubuntu:22.04", true},
+		{[]string{"*:22.04"}, "ubuntu:20.04", false},
+		{[]string{"centos", "ubuntu"}, "ubuntu:latest", true},
+	}
+	for _, test := range tests {
+		img, err := NewImage(test.image)
+		assert.Nil(t, err)
+		rule := &ReplicationRule{Images: test.patterns}
+		assert.Equal(t, test.expected, rule.Match(img), "%v %s", test.patterns, test.image)
+	}
+}
@@ -0,0 +1,80 @@
+package types
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net/http"
+	"os"
+
+	"github.com/pkg/errors"
+)
+
+type TLSConfig struct {
+	// CAFile is a PEM bundle trusted in addition to the system roots
+	CAFile   string `toml:"ca_file"`
+	CertFile string `toml:"cert_file"`
+	KeyFile  string `toml:"key_file"`
+	// InsecureSkipVerify disables the verification of server certificates
+	InsecureSkipVerify bool `toml:"insecure_skip_verify"`
+}
+
+// Enabled reports whether any TLS setting is given.
+func (cfg *TLSConfig) Enabled() bool {
+	return cfg.CAFile != "" || cfg.CertFile != "" || cfg.KeyFile != "" || cfg.InsecureSkipVerify
+}
+
+func (cfg *TLSConfig) CheckAndRefine() error {
+	if (cfg.CertFile == "") != (cfg.KeyFile == "") {
+		return errors.New("tls cert_file and key_file should be given together")
+	}
+	_, err := cfg.ClientConfig()
+	return err
+}
+
+// ClientConfig builds a tls.Config from the settings, it returns nil when
+// TLS isn't enabled so that callers fall back to their defaults.
+func (cfg *TLSConfig) ClientConfig() (*tls.Config, error) {
+	if !cfg.Enabled() {
+		return nil, nil
+	}
+	tlsCfg := &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		InsecureSkipVerify: cfg.InsecureSkipVerify, //nolint:gosec
+	}
+	if cfg.CAFile != "" {
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		pem, err := os.ReadFile(cfg.CAFile)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to read ca file %s", cfg.CAFile)
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, errors.Errorf("no certificate found in %s", cfg.CAFile)
+		}
+		tlsCfg.RootCAs = pool
+	}
+	if cfg.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(cfg.CertFile, cfg.KeyFile)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to load client certificate")
+		}
+		tlsCfg.Certificates = []tls.Certificate{cert}
+	}
+	return tlsCfg, nil
+}
+
+// HTTPClient returns an http client using the TLS settings, every call
+// returns a client with its own transport.
+func (cfg *TLSConfig) HTTPClient() (*http.Client, error) {
+	tlsCfg, err := cfg.ClientConfig()
+	if err != nil {
+		return nil, err
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if tlsCfg != nil {
+		transport.TLSClientConfig = tlsCfg
+	}
+	return &http.Client{Transport: transport}, nil
+}
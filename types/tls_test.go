@@ -0,0 +1,62 @@
+package types
+
+import (
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTLSHTTPClient(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer srv.Close()
+
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	caPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw})
+	assert.Nil(t, os.WriteFile(caFile, caPEM, 0600))
+
+	tests := []struct {
+		cfg TLSConfig
+		ok  bool
+	}{
+		{TLSConfig{}, false},
+		{TLSConfig{CAFile: caFile}, true},
+		{TLSConfig{InsecureSkipVerify: true}, true},
+	}
+	for _, test := range tests {
+		client, err := test.cfg.HTTPClient()
+		assert.Nil(t, err)
+		resp, err := client.Get(srv.URL)
+		if test.ok {
+			assert.Nil(t, err, "%+v", test.cfg)
+			resp.Body.Close()
+		} else {
+			assert.NotNil(t, err, "%+v", test.cfg)
+		}
+	}
+}
+
+func TestTLSCheckAndRefine(t *testing.T) {
+	cfg := &TLSConfig{CertFile: "cert.pem"}
+	assert.NotNil(t, cfg.CheckAndRefine())
+
+	cfg = &TLSConfig{CAFile: filepath.Join(t.TempDir(), "missing.pem")}
+	assert.NotNil(t, cfg.CheckAndRefine())
+
+	cfg = &TLSConfig{}
+	assert.Nil(t, cfg.CheckAndRefine())
+	assert.False(t, cfg.Enabled())
+}
+
+func TestVMIHubTLSRejected(t *testing.T) {
+	cfg := &Config{Type: "vmihub", VMIHub: VMIHubConfig{Addr: "https://hub.example.com", Username: "admin", Password: "pw"}}
+	assert.Nil(t, cfg.CheckAndRefine())
+	cfg.VMIHub.TLS.InsecureSkipVerify = true
+	assert.ErrorContains(t, cfg.CheckAndRefine(), "doesn't support tls")
+}
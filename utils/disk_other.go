@@ -0,0 +1,12 @@
+//go:build !unix
+
+package utils
+
+import (
+	"errors"
+)
+
+// DiskFree isn't implemented on this platform.
+func DiskFree(string) (uint64, error) {
+	return 0, errors.New("disk free space is only reported on unix")
+}
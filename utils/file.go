@@ -0,0 +1,59 @@
+package utils
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// CloneMethod tells how CloneFile made the copy.
+type CloneMethod string
+
+const (
+	CloneHardlink CloneMethod = "hardlink"
+	CloneReflink  CloneMethod = "reflink"
+	CloneCopy     CloneMethod = "copy"
+)
+
+// CloneFile makes dest hold the content of src, as cheaply as possible: a
+// hardlink, then a reflink on filesystems supporting them, then a plain
+// copy. dest is created atomically and its directory is created if needed.
+// Note that a hardlinked dest shares its inode with src, so neither should
+// be modified in place.
+func CloneFile(src, dest string) (CloneMethod, error) {
+	dir := filepath.Dir(dest)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", err
+	}
+	if err := os.Link(src, dest); err == nil {
+		return CloneHardlink, nil
+	}
+
+	in, err := os.Open(src)
+	if err != nil {
+		return "", err
+	}
+	defer in.Close()
+	tmp, err := os.CreateTemp(dir, ".clone-")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(tmp.Name())
+
+	method := CloneReflink
+	if err := reflink(tmp, in); err != nil {
+		method = CloneCopy
+		if _, err := io.Copy(tmp, in); err != nil {
+			tmp.Close()
+			return "", err
+		}
+	}
+	if err := tmp.Chmod(0644); err != nil {
+		tmp.Close()
+		return "", err
+	}
+	if err := tmp.Close(); err != nil {
+		return "", err
+	}
+	return method, os.Rename(tmp.Name(), dest)
+}
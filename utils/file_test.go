@@ -0,0 +1,34 @@
+package utils
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCloneFile(t *testing.T) {
+	src := filepath.Join(t.TempDir(), "src.img")
+	assert.Nil(t, os.WriteFile(src, []byte("disk"), 0600))
+
+	// same filesystem, the file is hardlinked
+	dest := filepath.Join(filepath.Dir(src), "store", "dest.img")
+	method, err := CloneFile(src, dest)
+	assert.Nil(t, err)
+	assert.Equal(t, CloneHardlink, method)
+	srcInfo, _ := os.Stat(src)
+	destInfo, _ := os.Stat(dest)
+	assert.True(t, os.SameFile(srcInfo, destInfo))
+
+	// the link fails since dest exists, so the content is copied over it
+	method, err = CloneFile(src, dest)
+	assert.Nil(t, err)
+	assert.NotEqual(t, CloneHardlink, method)
+	bs, err := os.ReadFile(dest)
+	assert.Nil(t, err)
+	assert.Equal(t, "disk", string(bs))
+
+	_, err = CloneFile(filepath.Join(t.TempDir(), "missing"), dest)
+	assert.Error(t, err)
+}
@@ -8,37 +8,18 @@ import (
 	"io"
 	"os"
 	"os/exec"
-	"strings"
 
 	"github.com/pkg/errors"
 )
 
+// NormalizeImageName splits fullname into user, name and tag, a registry
+// host and a digest are validated but not returned, use ParseReference for them.
 func NormalizeImageName(fullname string) (user, name, tag string, err error) {
-	parts := strings.Split(fullname, "/")
-	var nameTag string
-	switch len(parts) {
-	case 1:
-		nameTag = parts[0]
-	case 2:
-		user, nameTag = parts[0], parts[1]
-	default:
-		err = fmt.Errorf("invalid image name: %s", fullname)
-		return
-	}
-	if user == "" {
-		user = ""
-	}
-	parts = strings.Split(nameTag, ":")
-	switch len(parts) {
-	case 1:
-		name, tag = parts[0], "latest"
-	case 2:
-		name, tag = parts[0], parts[1]
-	default:
-		err = fmt.Errorf("invalid image name: %s", fullname)
-		return
+	ref, err := ParseReference(fullname)
+	if err != nil {
+		return "", "", "", err
 	}
-	return
+	return ref.Namespace, ref.Name, ref.Tag, nil
 }
 
 func CalcDigestOfFile(fname string) (string, error) {
@@ -71,7 +52,7 @@ func EnsureReaderClosed(stream io.ReadCloser) {
 
 func ImageSize(ctx context.Context, fname string) (int64, int64, error) {
 	cmds := []string{"qemu-img", "info", "--output=json", fname}
-	cmd := exec.Command(cmds[0], cmds[1:]...)
+	cmd := exec.CommandContext(ctx, cmds[0], cmds[1:]...)
 	output, err := cmd.Output()
 	if err != nil {
 		return 0, 0, errors.Wrap(err, "failed to run qemu-img info")
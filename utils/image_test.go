@@ -18,7 +18,10 @@ func TestNormalizeImageName(t *testing.T) {
 		{"myuser/myimage:1.0", "myuser", "myimage", "1.0", ""},
 		{"myimage:2.0", "", "myimage", "2.0", ""},
 		{"invalid/image/name:tag:extra", "", "", "", "invalid image name: invalid/image/name:tag:extra"},
-		{"invalid/image/name:tag", "", "", "", "invalid image name: invalid/image/name:tag"},
+		{"nested/image/name:tag", "nested/image", "name", "tag", ""},
+		{"harbor.example.com:8443/myuser/myimage:1.0", "myuser", "myimage", "1.0", ""},
+		{"_/myimage:1.0", "", "myimage", "1.0", ""},
+		{"MyUser/myimage", "MyUser", "myimage", "latest", ""},
 		{"image/name:tag:extra", "", "", "", "invalid image name: image/name:tag:extra"},
 	}
 
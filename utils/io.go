@@ -0,0 +1,171 @@
+package utils
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"sync"
+
+	"github.com/docker/docker/pkg/jsonmessage"
+)
+
+type ctxReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+// NewContextReader returns a reader which fails with the context's error
+// once ctx is done, so long copies can be interrupted between reads.
+func NewContextReader(ctx context.Context, r io.Reader) io.Reader {
+	return &ctxReader{ctx: ctx, r: r}
+}
+
+func (cr *ctxReader) Read(p []byte) (int, error) {
+	if err := cr.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return cr.r.Read(p)
+}
+
+type checkedReadCloser struct {
+	io.ReadCloser
+	check func() error
+	err   error
+	done  bool
+}
+
+// NewCheckedReadCloser wraps rc and calls check once rc hits EOF, when check
+// fails its error is returned by Read instead of io.EOF.
+func NewCheckedReadCloser(rc io.ReadCloser, check func() error) io.ReadCloser {
+	return &checkedReadCloser{ReadCloser: rc, check: check}
+}
+
+func (crc *checkedReadCloser) Read(p []byte) (int, error) {
+	if crc.done {
+		return 0, crc.err
+	}
+	n, err := crc.ReadCloser.Read(p)
+	if err == io.EOF {
+		crc.done, crc.err = true, io.EOF
+		if checkErr := crc.check(); checkErr != nil {
+			crc.err = checkErr
+		}
+		return n, crc.err
+	}
+	return n, err
+}
+
+// ErrStreamAborted is reported by NewNotifyReadCloser when the stream is
+// closed before its end.
+var ErrStreamAborted = errors.New("stream closed before its end")
+
+// maxMessageSize bounds the partial line kept while parsing a stream, longer
+// lines aren't jsonmessages and are skipped.
+const maxMessageSize = 1 << 20
+
+type notifyReadCloser struct {
+	io.ReadCloser
+	once sync.Once
+	done func(transferred int64, err error)
+	// line holds the partial jsonmessage read so far, msgErr the error of
+	// the last errorDetail message
+	line   []byte
+	skip   bool
+	msgErr error
+	// layers holds the progress of every layer mentioned in the stream
+	layers map[string]int64
+}
+
+// NewNotifyReadCloser wraps rc, a stream of docker jsonmessages, and calls
+// done exactly once with the outcome of the operation: nil when the stream
+// hits EOF, the error of the last errorDetail message when it carried one,
+// the read error, or ErrStreamAborted when it is closed before EOF.
+// transferred is the number of bytes downloaded or pushed according to the
+// progress messages, or -1 when the stream has no layer messages at all.
+func NewNotifyReadCloser(rc io.ReadCloser, done func(transferred int64, err error)) io.ReadCloser {
+	return &notifyReadCloser{ReadCloser: rc, done: done}
+}
+
+func (nrc *notifyReadCloser) Read(p []byte) (int, error) {
+	n, err := nrc.ReadCloser.Read(p)
+	nrc.parse(p[:n])
+	if err != nil {
+		if err == io.EOF {
+			nrc.parseLine(nrc.line)
+			nrc.finish(nrc.msgErr)
+		} else {
+			nrc.finish(err)
+		}
+	}
+	return n, err
+}
+
+func (nrc *notifyReadCloser) Close() error {
+	err := nrc.ReadCloser.Close()
+	if err != nil {
+		nrc.finish(err)
+	} else {
+		nrc.finish(ErrStreamAborted)
+	}
+	return err
+}
+
+func (nrc *notifyReadCloser) parse(p []byte) {
+	for len(p) > 0 {
+		idx := bytes.IndexByte(p, '\n')
+		if idx < 0 {
+			nrc.buffer(p)
+			return
+		}
+		nrc.buffer(p[:idx])
+		if !nrc.skip {
+			nrc.parseLine(nrc.line)
+		}
+		nrc.line, nrc.skip = nrc.line[:0], false
+		p = p[idx+1:]
+	}
+}
+
+func (nrc *notifyReadCloser) buffer(p []byte) {
+	if nrc.skip || len(nrc.line)+len(p) > maxMessageSize {
+		nrc.line, nrc.skip = nrc.line[:0], true
+		return
+	}
+	nrc.line = append(nrc.line, p...)
+}
+
+func (nrc *notifyReadCloser) parseLine(line []byte) {
+	var msg jsonmessage.JSONMessage
+	if len(bytes.TrimSpace(line)) == 0 || json.Unmarshal(line, &msg) != nil {
+		return
+	}
+	if msg.Error != nil {
+		nrc.msgErr = msg.Error
+	}
+	if msg.ID == "" {
+		return
+	}
+	if nrc.layers == nil {
+		nrc.layers = map[string]int64{}
+	}
+	current := nrc.layers[msg.ID]
+	if (msg.Status == "Downloading" || msg.Status == "Pushing") && msg.Progress != nil && msg.Progress.Current > current {
+		current = msg.Progress.Current
+	}
+	nrc.layers[msg.ID] = current
+}
+
+func (nrc *notifyReadCloser) finish(err error) {
+	nrc.once.Do(func() {
+		transferred := int64(-1)
+		if nrc.layers != nil {
+			transferred = 0
+			for _, n := range nrc.layers {
+				transferred += n
+			}
+		}
+		nrc.done(transferred, err)
+	})
+}
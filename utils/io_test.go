@@ -0,0 +1,64 @@
+package utils
+
+import (
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/docker/docker/pkg/jsonmessage"
+	"github.com/stretchr/testify/assert"
+)
+
+func notifyResult(t *testing.T, stream string, readAll bool) error {
+	var (
+		result error
+		calls  int
+	)
+	rc := NewNotifyReadCloser(io.NopCloser(strings.NewReader(stream)), func(_ int64, err error) {
+		result = err
+		calls++
+	})
+	if readAll {
+		_, err := io.ReadAll(rc)
+		assert.Nil(t, err)
+	}
+	assert.Nil(t, rc.Close())
+	assert.Equal(t, 1, calls)
+	return result
+}
+
+func TestNotifyReadCloser(t *testing.T) {
+	ok := "{\"status\":\"Pulling fs layer\",\"id\":\"abc\"}\r\n{\"status\":\"Digest: sha256:abc\"}\r\n"
+	assert.Nil(t, notifyResult(t, ok, true))
+	assert.Nil(t, notifyResult(t, "", true))
+
+	failed := ok + "{\"errorDetail\":{\"code\":404,\"message\":\"manifest unknown\"},\"error\":\"manifest unknown\"}"
+	err := notifyResult(t, failed, true)
+	assert.EqualError(t, err, "manifest unknown")
+	assert.IsType(t, &jsonmessage.JSONError{}, err)
+
+	// a line longer than a message is skipped, not buffered
+	long := "{\"status\":\"" + strings.Repeat("x", maxMessageSize) + "\"}\n" + failed
+	assert.EqualError(t, notifyResult(t, long, true), "manifest unknown")
+
+	assert.ErrorIs(t, notifyResult(t, ok, false), ErrStreamAborted)
+}
+
+func TestNotifyReadCloserTransferred(t *testing.T) {
+	transferred := func(stream string) (ans int64) {
+		rc := NewNotifyReadCloser(io.NopCloser(strings.NewReader(stream)), func(n int64, _ error) { ans = n })
+		_, err := io.ReadAll(rc)
+		assert.Nil(t, err)
+		return ans
+	}
+	pull := `{"status":"Pulling fs layer","id":"a"}
+{"status":"Downloading","progressDetail":{"current":100,"total":300},"id":"a"}
+{"status":"Downloading","progressDetail":{"current":300,"total":300},"id":"a"}
+{"status":"Extracting","progressDetail":{"current":900,"total":900},"id":"a"}
+{"status":"Already exists","id":"b"}
+{"status":"Pushing","progressDetail":{"current":50,"total":50},"id":"c"}
+`
+	assert.Equal(t, int64(350), transferred(pull))
+	assert.Equal(t, int64(0), transferred(`{"status":"Layer already exists","id":"a"}`))
+	assert.Equal(t, int64(-1), transferred(`{"status":"pulled"}`))
+}
@@ -0,0 +1,19 @@
+package utils
+
+import (
+	"errors"
+	"net"
+	"syscall"
+)
+
+// IsTransientNetError reports whether err is a network failure which may go
+// away by itself: a timeout, or a connection refused or reset by the peer.
+// Other failures such as DNS or TLS errors usually come from a
+// misconfiguration and aren't.
+func IsTransientNetError(err error) bool {
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return true
+	}
+	return errors.Is(err, syscall.ECONNREFUSED) || errors.Is(err, syscall.ECONNRESET)
+}
@@ -0,0 +1,34 @@
+package utils
+
+import (
+	"crypto/x509"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIsTransientNetError(t *testing.T) {
+	opErr := func(err error) error {
+		return &url.Error{Op: "Get", URL: "https://hub", Err: &net.OpError{Op: "dial", Net: "tcp", Err: err}}
+	}
+	tests := []struct {
+		err      error
+		expected bool
+	}{
+		{opErr(os.NewSyscallError("connect", syscall.ECONNREFUSED)), true},
+		{opErr(os.NewSyscallError("read", syscall.ECONNRESET)), true},
+		{opErr(&net.DNSError{Err: "i/o timeout", Name: "hub", IsTimeout: true}), true},
+		{fmt.Errorf("ping: %w", os.ErrDeadlineExceeded), true},
+		{opErr(&net.DNSError{Err: "no such host", Name: "hub", IsNotFound: true}), false},
+		{&url.Error{Op: "Get", URL: "https://hub", Err: x509.UnknownAuthorityError{}}, false},
+		{fmt.Errorf("disk full"), false},
+	}
+	for _, test := range tests {
+		assert.Equal(t, test.expected, IsTransientNetError(test.err), "%v", test.err)
+	}
+}
@@ -0,0 +1,113 @@
+package utils
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+const (
+	defaultTag    = "latest"
+	maxNameLength = 255
+)
+
+var (
+	// a path component: alphanumerics separated by '.', '_', '__' or runs of '-',
+	// matched after lowercasing because vmihub usernames may contain capitals
+	componentRe = regexp.MustCompile(`^[a-z0-9]+(?:(?:[._]|__|-+)[a-z0-9]+)*$`)
+	tagRe       = regexp.MustCompile(`^\w[\w.-]{0,127}$`)
+	digestRe    = regexp.MustCompile(`^[a-z0-9]+(?:[.+_-][a-z0-9]+)*:[a-zA-Z0-9=_-]{32,}$`)
+	sha256Re    = regexp.MustCompile(`^[a-f0-9]{64}$`)
+	hostRe      = regexp.MustCompile(`^(?:[a-zA-Z0-9](?:[a-zA-Z0-9-]*[a-zA-Z0-9])?)(?:\.[a-zA-Z0-9](?:[a-zA-Z0-9-]*[a-zA-Z0-9])?)*(?::[0-9]+)?$`)
+)
+
+// Reference is a parsed image reference of the form
+// [registry/][namespace/]name[:tag][@digest], namespace may contain slashes.
+type Reference struct {
+	Registry  string
+	Namespace string
+	Name      string
+	Tag       string
+	Digest    string
+}
+
+// ParseReference parses and validates an image reference, the tag defaults to latest.
+func ParseReference(s string) (ref *Reference, err error) {
+	ref = &Reference{}
+	remainder := s
+	if idx := strings.Index(remainder, "@"); idx >= 0 {
+		remainder, ref.Digest = remainder[:idx], remainder[idx+1:]
+		if !validDigest(ref.Digest) {
+			return nil, invalidName(s)
+		}
+	}
+	if idx := strings.LastIndex(remainder, ":"); idx > strings.LastIndex(remainder, "/") {
+		remainder, ref.Tag = remainder[:idx], remainder[idx+1:]
+		if !tagRe.MatchString(ref.Tag) {
+			return nil, invalidName(s)
+		}
+	}
+	if ref.Tag == "" {
+		ref.Tag = defaultTag
+	}
+
+	parts := strings.Split(remainder, "/")
+	if len(parts) > 1 && isRegistry(parts[0]) {
+		ref.Registry, parts = parts[0], parts[1:]
+		if !hostRe.MatchString(ref.Registry) {
+			return nil, invalidName(s)
+		}
+	}
+	// vmihub stores images without a user under "_"
+	if len(parts) == 2 && parts[0] == "_" {
+		parts = parts[1:]
+	}
+	for _, part := range parts {
+		if !componentRe.MatchString(strings.ToLower(part)) {
+			return nil, invalidName(s)
+		}
+	}
+	if len(strings.Join(parts, "/")) > maxNameLength {
+		return nil, fmt.Errorf("invalid image name: %s, name is longer than %d characters", s, maxNameLength)
+	}
+	ref.Name = parts[len(parts)-1]
+	ref.Namespace = strings.Join(parts[:len(parts)-1], "/")
+	return ref, nil
+}
+
+// String returns the canonical form of the reference.
+func (ref *Reference) String() string {
+	var sb strings.Builder
+	if ref.Registry != "" {
+		sb.WriteString(ref.Registry + "/")
+	}
+	if ref.Namespace != "" {
+		sb.WriteString(ref.Namespace + "/")
+	}
+	sb.WriteString(ref.Name + ":" + ref.Tag)
+	if ref.Digest != "" {
+		sb.WriteString("@" + ref.Digest)
+	}
+	return sb.String()
+}
+
+// isRegistry follows docker's rule: the first component is a registry host
+// when it contains a '.' or a ':' or is localhost.
+func isRegistry(part string) bool {
+	return strings.ContainsAny(part, ".:") || part == "localhost"
+}
+
+func invalidName(s string) error {
+	return fmt.Errorf("invalid image name: %s", s)
+}
+
+func validDigest(d string) bool {
+	if !digestRe.MatchString(d) {
+		return false
+	}
+	algo, encoded, _ := strings.Cut(d, ":")
+	if algo == "sha256" {
+		return sha256Re.MatchString(encoded)
+	}
+	return true
+}
@@ -0,0 +1,62 @@
+package utils
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseReference(t *testing.T) {
+	digest := "sha256:" + strings.Repeat("ab", 32)
+	tests := []struct {
+		input    string
+		expected *Reference
+	}{
+		{"ubuntu", &Reference{Name: "ubuntu", Tag: "latest"}},
+		{"user/ubuntu:22.04", &Reference{Namespace: "user", Name: "ubuntu", Tag: "22.04"}},
+		{"MyUser/Ubuntu", &Reference{Namespace: "MyUser", Name: "Ubuntu", Tag: "latest"}},
+		{"localhost/ubuntu", &Reference{Registry: "localhost", Name: "ubuntu", Tag: "latest"}},
+		{"localhost:5000/ubuntu", &Reference{Registry: "localhost:5000", Name: "ubuntu", Tag: "latest"}},
+		{"hub.example.com/a/b/ubuntu:v1", &Reference{Registry: "hub.example.com", Namespace: "a/b", Name: "ubuntu", Tag: "v1"}},
+		{"user/ubuntu@" + digest, &Reference{Namespace: "user", Name: "ubuntu", Tag: "latest", Digest: digest}},
+		{"hub.io:443/user/my_img-x.y:1.0@" + digest, &Reference{Registry: "hub.io:443", Namespace: "user", Name: "my_img-x.y", Tag: "1.0", Digest: digest}},
+	}
+	for _, test := range tests {
+		ref, err := ParseReference(test.input)
+		assert.Nil(t, err, test.input)
+		assert.Equal(t, test.expected, ref, test.input)
+	}
+}
+
+func TestParseReferenceInvalid(t *testing.T) {
+	inputs := []string{
+		"",
+		"user//ubuntu",
+		"user/ubuntu:",
+		"user/ubuntu:-bad",
+		"user/ubuntu:" + strings.Repeat("t", 129),
+		"user/ubuntu@sha256:1234",
+		"user/ubuntu@" + strings.Repeat("a", 64),
+		"user/ubuntu__-x",
+		"bad_host.com/ubuntu",
+		strings.Repeat("a", 256),
+	}
+	for _, input := range inputs {
+		_, err := ParseReference(input)
+		assert.NotNil(t, err, input)
+	}
+}
+
+func TestReferenceString(t *testing.T) {
+	digest := "sha256:" + strings.Repeat("0f", 32)
+	for _, input := range []string{
+		"ubuntu:latest",
+		"user/ubuntu:22.04",
+		"localhost:5000/a/b/ubuntu:v1@" + digest,
+	} {
+		ref, err := ParseReference(input)
+		assert.Nil(t, err)
+		assert.Equal(t, input, ref.String())
+	}
+}
@@ -0,0 +1,13 @@
+package utils
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// reflink makes dest share the extents of src (FICLONE), it fails on
+// filesystems without copy-on-write support such as ext4.
+func reflink(dest, src *os.File) error {
+	return unix.IoctlFileClone(int(dest.Fd()), int(src.Fd()))
+}
@@ -7,6 +7,11 @@ import (
 	probing "github.com/prometheus-community/pro-bing"
 )
 
+// IPReachable pings ip twice and fails when no reply comes back in timeout.
+//
+// Deprecated: nothing in this module pings registries anymore, the docker
+// backend probes them over HTTP. IPReachable will be removed in a future
+// release.
 func IPReachable(ip string, timeout time.Duration) error {
 	pinger, err := probing.NewPinger(ip)
 	if err != nil {
@@ -0,0 +1,60 @@
+package vmihub
+
+import (
+	"context"
+	"errors"
+	"regexp"
+	"strconv"
+
+	"github.com/projecteru2/vmihub/client/terrors"
+	"github.com/yuyang0/vmimage/types"
+	"github.com/yuyang0/vmimage/utils"
+)
+
+var statusRe = regexp.MustCompile(`status(?: code)?: (\d{3})`)
+
+// convertError maps errors of the vmihub client onto the errors defined in
+// the types package. The client reports most HTTP failures only as text,
+// so the status code is recovered from the message.
+func convertError(err error) error {
+	if err == nil || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return err
+	}
+	switch {
+	case errors.Is(err, terrors.ErrImageNotFound):
+		return types.NewError(types.ErrImageNotFound, err)
+	case errors.Is(err, terrors.ErrInvalidImageName):
+		return types.NewError(types.ErrInvalidImageName, err)
+	case errors.Is(err, terrors.ErrInvalidDigest):
+		return types.NewError(types.ErrDigestMismatch, err)
+	case errors.Is(err, terrors.ErrNetworkError), utils.IsTransientNetError(err):
+		return types.NewError(types.ErrUnavailable, err)
+	}
+	if kind := statusKind(err.Error()); kind != nil {
+		return types.NewError(kind, err)
+	}
+	return err
+}
+
+func statusKind(msg string) error {
+	m := statusRe.FindStringSubmatch(msg)
+	if m == nil {
+		return nil
+	}
+	code, _ := strconv.Atoi(m[1])
+	return codeKind(code)
+}
+
+func codeKind(code int) error {
+	switch {
+	case code == 401 || code == 403:
+		return types.ErrUnauthorized
+	case code == 404:
+		return types.ErrImageNotFound
+	case code == 409:
+		return types.ErrConflict
+	case code >= 500:
+		return types.ErrUnavailable
+	}
+	return nil
+}
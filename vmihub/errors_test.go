@@ -0,0 +1,42 @@
+package vmihub
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"syscall"
+	"testing"
+
+	cerrors "github.com/cockroachdb/errors"
+	"github.com/projecteru2/vmihub/client/terrors"
+	"github.com/stretchr/testify/assert"
+	"github.com/yuyang0/vmimage/types"
+)
+
+func TestConvertError(t *testing.T) {
+	tests := []struct {
+		err  error
+		kind error
+	}{
+		{terrors.ErrImageNotFound, types.ErrImageNotFound},
+		{cerrors.Wrapf(terrors.ErrHTTPError, "status: %d, error: %v", 401, "bad token"), types.ErrUnauthorized},
+		{cerrors.Wrapf(terrors.ErrHTTPError, "status: %d", 404), types.ErrImageNotFound},
+		{cerrors.Newf("failed to pull image, status code: %d, body: %s", 502, ""), types.ErrUnavailable},
+		{fmt.Errorf("wrap: %w", terrors.ErrInvalidDigest), types.ErrDigestMismatch},
+	}
+	for _, test := range tests {
+		err := convertError(test.err)
+		assert.ErrorIs(t, err, test.kind, "%v", test.err)
+		assert.ErrorIs(t, err, test.err)
+	}
+
+	assert.Nil(t, convertError(nil))
+	plain := errors.New("disk full")
+	assert.Equal(t, plain, convertError(plain))
+	// misconfigurations aren't outages
+	dnsErr := &net.DNSError{Err: "no such host", Name: "hub", IsNotFound: true}
+	assert.NotErrorIs(t, convertError(dnsErr), types.ErrUnavailable)
+	refused := &net.OpError{Op: "dial", Net: "tcp", Err: os.NewSyscallError("connect", syscall.ECONNREFUSED)}
+	assert.ErrorIs(t, convertError(refused), types.ErrUnavailable)
+}
@@ -0,0 +1,50 @@
+package vmihub
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+
+	"github.com/pkg/errors"
+	"github.com/projecteru2/vmihub/client/auth"
+	"github.com/yuyang0/vmimage/types"
+	"github.com/yuyang0/vmimage/utils"
+)
+
+// CheckHealth probes the hub's healthz endpoint, the configured credential
+// and the free space under the base dir.
+func (mgr *Manager) CheckHealth(ctx context.Context) (*types.HealthReport, error) {
+	report := &types.HealthReport{Backend: "vmihub"}
+	hubErr := report.Probe(ctx, types.HealthCheckRegistry, mgr.probeHealthz)
+	if hubErr == nil && mgr.cfg.VMIHub.Username != "" {
+		_ = report.Probe(ctx, types.HealthCheckAuth, func(ctx context.Context) error {
+			_, _, err := auth.GetToken(ctx, mgr.cfg.VMIHub.Addr, mgr.cfg.VMIHub.Username, mgr.cfg.VMIHub.Password)
+			return err
+		})
+	}
+	_ = report.Probe(ctx, types.HealthCheckStorage, func(context.Context) (err error) {
+		report.StorageFree, err = utils.DiskFree(mgr.cfg.VMIHub.BaseDir)
+		return err
+	})
+	return report, report.Err()
+}
+
+func (mgr *Manager) probeHealthz(ctx context.Context) error {
+	healthzURL, err := url.JoinPath(mgr.cfg.VMIHub.Addr, "healthz")
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, healthzURL, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := mgr.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return errors.New(resp.Status)
+	}
+	return nil
+}
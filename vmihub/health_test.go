@@ -0,0 +1,35 @@
+package vmihub
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/yuyang0/vmimage/types"
+)
+
+func TestCheckHealth(t *testing.T) {
+	status := http.StatusOK
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+	}))
+	defer srv.Close()
+
+	mgr := &Manager{
+		cfg:        &types.Config{VMIHub: types.VMIHubConfig{Addr: srv.URL, BaseDir: t.TempDir()}},
+		httpClient: http.DefaultClient,
+	}
+	report, err := mgr.CheckHealth(context.Background())
+	assert.Nil(t, err)
+	assert.True(t, report.Check(types.HealthCheckRegistry).OK)
+	assert.True(t, report.Check(types.HealthCheckStorage).OK)
+	assert.Nil(t, report.Check(types.HealthCheckAuth))
+	assert.NotZero(t, report.StorageFree)
+
+	status = http.StatusServiceUnavailable
+	report, err = mgr.CheckHealth(context.Background())
+	assert.ErrorIs(t, err, types.ErrUnavailable)
+	assert.False(t, report.Check(types.HealthCheckRegistry).OK)
+}
@@ -1,3 +1,9 @@
+// Package vmihub implements vmimage.Manager with a vmihub image hub.
+//
+// The vmihub client library sends its requests with http.DefaultClient,
+// which this package leaves alone: those requests aren't traced at the HTTP
+// level and trust the host's CAs, TLS settings aren't supported. Only the
+// health probe is sent by the manager itself.
 package vmihub
 
 import (
@@ -5,16 +11,20 @@ import (
 	"io"
 	"net/http"
 	"net/url"
+	"os"
 
 	"github.com/pkg/errors"
 	imageAPI "github.com/projecteru2/vmihub/client/image"
 	apitypes "github.com/projecteru2/vmihub/client/types"
+	"github.com/yuyang0/vmimage/tracing"
 	"github.com/yuyang0/vmimage/types"
+	"github.com/yuyang0/vmimage/utils"
 )
 
 type Manager struct {
-	api imageAPI.API
-	cfg *types.Config
+	api        imageAPI.API
+	cfg        *types.Config
+	httpClient *http.Client
 }
 
 func NewManager(cfg *types.Config) (*Manager, error) {
@@ -27,15 +37,60 @@ func NewManager(cfg *types.Config) (*Manager, error) {
 		return nil, err
 	}
 	return &Manager{
-		api: api,
-		cfg: cfg,
+		api:        api,
+		cfg:        cfg,
+		httpClient: newHTTPClient(),
 	}, nil
 }
 
+// Reload returns a manager using the address and credential of cfg. It
+// shares the metadata db opened by mgr, which can't be opened twice, so the
+// base dir can't change. mgr is left untouched and keeps serving the
+// requests in flight.
+func (mgr *Manager) Reload(cfg *types.Config) (*Manager, error) {
+	if cfg.VMIHub.BaseDir != mgr.cfg.VMIHub.BaseDir {
+		return nil, errors.Errorf("can't change vmihub base dir from %s to %s without restarting", mgr.cfg.VMIHub.BaseDir, cfg.VMIHub.BaseDir)
+	}
+	impl, ok := mgr.api.(*imageAPI.APIImpl)
+	if !ok {
+		return nil, errors.New("vmihub client doesn't support reloading")
+	}
+	// the copy shares the metadata db handle of impl
+	newImpl := *impl
+	newImpl.ServerURL = cfg.VMIHub.Addr
+	newImpl.Cred = &apitypes.Credential{
+		Username: cfg.VMIHub.Username,
+		Password: cfg.VMIHub.Password,
+	}
+	return &Manager{
+		api:        &newImpl,
+		cfg:        cfg,
+		httpClient: newHTTPClient(),
+	}, nil
+}
+
+// newHTTPClient returns the client of the requests sent by the manager
+// itself.
+func newHTTPClient() *http.Client {
+	return &http.Client{Transport: tracing.Transport(http.DefaultTransport.(*http.Transport).Clone())}
+}
+
+// checkRegistry refuses images of another registry, the hub is the only
+// registry this manager talks to.
+func (mgr *Manager) checkRegistry(img *types.Image) error {
+	if img.Registry == "" {
+		return nil
+	}
+	if u, err := url.Parse(mgr.cfg.VMIHub.Addr); err == nil && u.Host == img.Registry {
+		return nil
+	}
+	return types.NewError(types.ErrInvalidImageName, errors.Errorf("image %s isn't in the hub %s", img.Reference(), mgr.cfg.VMIHub.Addr))
+}
+
 func (mgr *Manager) ListLocalImages(ctx context.Context, user string) ([]*types.Image, error) {
 	apiImages, err := mgr.api.ListLocalImages()
 	if err != nil {
-		return nil, err
+		return nil, convertError(err)
 	}
 	ans := make([]*types.Image, 0, len(apiImages))
 	for _, img := range apiImages {
@@ -52,12 +107,47 @@ func (mgr *Manager) ListLocalImages(ctx context.Context, user string) ([]*types.
 	return ans, nil
 }
 
+// ListRemoteImages returns the images of the hub visible with the
+// configured credential, of user only when it isn't empty.
+func (mgr *Manager) ListRemoteImages(ctx context.Context, user string) ([]*types.Image, error) {
+	const pageSize = 100
+	var ans []*types.Image
+	for page := 1; ; page++ {
+		apiImages, total, err := mgr.api.ListImages(ctx, user, page, pageSize)
+		if err != nil {
+			return nil, convertError(err)
+		}
+		for _, apiImage := range apiImages {
+			ans = append(ans, fromAPIImage(apiImage))
+		}
+		if len(apiImages) < pageSize || len(ans) >= total {
+			return ans, nil
+		}
+	}
+}
+
 func (mgr *Manager) LoadImage(ctx context.Context, imgName string) (*types.Image, error) {
-	apiImage, err := mgr.api.GetInfo(ctx, imgName)
+	ref, err := types.NewImage(imgName)
 	if err != nil {
 		return nil, err
 	}
-	img := &types.Image{
+	if err := mgr.checkRegistry(ref); err != nil {
+		return nil, err
+	}
+	apiImage, err := mgr.api.GetInfo(ctx, ref.Fullname())
+	if err != nil {
+		return nil, convertError(err)
+	}
+	if err := ref.MatchPinnedDigest(apiImage.Digest); err != nil {
+		return nil, err
+	}
+	img := fromAPIImage(apiImage)
+	img.PinnedDigest = ref.PinnedDigest
+	return img, nil
+}
+
+func fromAPIImage(apiImage *apitypes.Image) *types.Image {
+	return &types.Image{
 		Username: apiImage.Username,
 		Name:     apiImage.Name,
 		Tag:      apiImage.Tag,
@@ -72,25 +162,69 @@ func (mgr *Manager) LoadImage(ctx context.Context, imgName string) (*types.Image
 		},
 		Snapshot: apiImage.Snapshot,
 	}
-	return img, nil
 }
 
+// Prepare is PrepareContext without cancellation.
 func (mgr *Manager) Prepare(fname string, img *types.Image) (io.ReadCloser, error) {
+	return mgr.PrepareContext(context.Background(), fname, img)
+}
+
+func (mgr *Manager) PrepareContext(ctx context.Context, fname string, img *types.Image) (io.ReadCloser, error) {
+	if err := mgr.checkRegistry(img); err != nil {
+		return nil, err
+	}
+	if err := img.RejectPlatform(); err != nil {
+		return nil, err
+	}
 	apiImage, err := mgr.api.NewImage(img.Fullname())
+	if err != nil {
+		return nil, convertError(err)
+	}
+	if fname == apiImage.Filepath() {
+		return &nullReadCloser{}, nil
+	}
+	f, err := os.Open(fname)
 	if err != nil {
 		return nil, err
 	}
-	err = apiImage.CopyFrom(fname)
-	return &nullReadCloser{}, err
+	defer f.Close()
+	if err = apiImage.MDB.CopyFile(apiImage, utils.NewContextReader(ctx, f)); err != nil {
+		// don't leave a truncated image behind when the copy is cancelled
+		_ = os.Remove(apiImage.Filepath())
+		return nil, err
+	}
+	return &nullReadCloser{}, nil
 }
 
+// Pull pulls img, the hub keeps one architecture per tag so an image built
+// for another architecture than img's explicit platform isn't pulled.
 func (mgr *Manager) Pull(ctx context.Context, img *types.Image, policy types.PullPolicy) (io.ReadCloser, error) {
-	newImg, err := mgr.api.Pull(ctx, img.Fullname(), imageAPI.PullPolicy(policy))
+	if err := mgr.checkRegistry(img); err != nil {
+		return nil, err
+	}
+	if img.Platform != "" && policy != types.PullPolicyNever {
+		info, err := mgr.api.GetInfo(ctx, img.Fullname())
+		if err != nil {
+			return nil, convertError(err)
+		}
+		if err := img.CheckPlatform(info.OS.Arch); err != nil {
+			return nil, err
+		}
+	}
+	newImg, err := mgr.pull(ctx, img, policy)
 	if err != nil {
 		return nil, err
 	}
-	img.Tag = newImg.Tag
+	if err := img.CheckPlatform(newImg.OS.Arch); err != nil {
+		return nil, err
+	}
+	if err := img.MatchPinnedDigest(newImg.Digest); err != nil {
+		return nil, err
+	}
 	img.Snapshot = newImg.Snapshot
+	img.Digest = newImg.Digest
+	img.Size = newImg.Size
+	img.LocalPath = newImg.Filepath()
 	img.OS = types.OSInfo{
 		Type:    newImg.OS.Type,
 		Distrib: newImg.OS.Distrib,
@@ -101,29 +235,45 @@ func (mgr *Manager) Pull(ctx context.Context, img *types.Image, policy types.Pul
 	return &nullReadCloser{}, nil
 }
 
+func (mgr *Manager) pull(ctx context.Context, img *types.Image, policy types.PullPolicy) (*apitypes.Image, error) {
+	newImg, err := mgr.api.Pull(ctx, img.Fullname(), imageAPI.PullPolicy(policy))
+	if err != nil {
+		return nil, convertError(err)
+	}
+	if newImg == nil {
+		// the client doesn't look at the local store when the policy is Never
+		return mgr.localImage(img)
+	}
+	return newImg, nil
+}
+
 func (mgr *Manager) Push(ctx context.Context, img *types.Image, force bool) (io.ReadCloser, error) {
+	if err := mgr.checkRegistry(img); err != nil {
+		return nil, err
+	}
 	apiImage := toAPIImage(img)
-	err := mgr.api.Push(ctx, apiImage, force)
-	return &nullReadCloser{}, err
+	if err := mgr.api.Push(ctx, apiImage, force); err != nil {
+		return nil, convertError(err)
+	}
+	return &nullReadCloser{}, nil
 }
 
 func (mgr *Manager) RemoveLocal(ctx context.Context, img *types.Image) error {
-	return mgr.api.RemoveLocalImage(ctx, toAPIImage(img))
-}
-
-func (mgr *Manager) CheckHealth(ctx context.Context) error {
-	healthzURL, err := url.JoinPath(mgr.cfg.VMIHub.Addr, "healthz")
-	if err != nil {
+	if err := mgr.checkRegistry(img); err != nil {
 		return err
 	}
-	resp, err := http.Get(healthzURL)
+	return convertError(mgr.api.RemoveLocalImage(ctx, toAPIImage(img)))
+}
+
+func (mgr *Manager) localImage(img *types.Image) (*apitypes.Image, error) {
+	apiImage, err := mgr.api.NewImage(img.Fullname())
 	if err != nil {
-		return err
+		return nil, convertError(err)
 	}
-	if resp.StatusCode != http.StatusOK {
-		return errors.New(resp.Status)
+	if _, err := os.Stat(apiImage.Filepath()); err != nil {
+		return nil, types.NewError(types.ErrImageNotFound, err)
 	}
-	return nil
+	return apiImage, nil
 }
 
 func toAPIImage(img *types.Image) *apitypes.Image {
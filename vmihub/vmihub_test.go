@@ -0,0 +1,177 @@
+package vmihub
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/yuyang0/vmimage"
+	"github.com/yuyang0/vmimage/conformance"
+	"github.com/yuyang0/vmimage/types"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+func TestPrepareCancelled(t *testing.T) {
+	mgr, err := NewManager(&types.Config{VMIHub: types.VMIHubConfig{
+		Addr:    "http://127.0.0.1:1",
+		BaseDir: t.TempDir(),
+	}})
+	assert.Nil(t, err)
+	fname := filepath.Join(t.TempDir(), "disk.img")
+	assert.Nil(t, os.WriteFile(fname, make([]byte, 1<<20), 0600))
+	img, err := types.NewImage("ubuntu:latest")
+	assert.Nil(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = mgr.PrepareContext(ctx, fname, img)
+	assert.ErrorIs(t, err, context.Canceled)
+	// the truncated copy is removed
+	apiImage, err := mgr.api.NewImage(img.Fullname())
+	assert.Nil(t, err)
+	assert.NoFileExists(t, apiImage.Filepath())
+}
+
+func TestTracePropagation(t *testing.T) {
+	prev := otel.GetTextMapPropagator()
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	defer otel.SetTextMapPropagator(prev)
+
+	traceparent := make(chan string, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/healthz", r.URL.Path)
+		traceparent <- r.Header.Get("Traceparent")
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer srv.Close()
+	mgr, err := NewManager(&types.Config{VMIHub: types.VMIHubConfig{Addr: srv.URL, BaseDir: t.TempDir()}})
+	assert.Nil(t, err)
+
+	traceID := trace.TraceID{1, 2, 3}
+	ctx := trace.ContextWithSpanContext(context.Background(), trace.NewSpanContext(trace.SpanContextConfig{
+		TraceID:    traceID,
+		SpanID:     trace.SpanID{4, 5, 6},
+		TraceFlags: trace.FlagsSampled,
+	}))
+	// the health probe is sent by the manager, unlike the requests of the
+	// vmihub library
+	_, err = mgr.CheckHealth(ctx)
+	assert.NotNil(t, err)
+	assert.Contains(t, <-traceparent, traceID.String())
+}
+
+func TestOtherRegistryRejected(t *testing.T) {
+	mgr, err := NewManager(&types.Config{VMIHub: types.VMIHubConfig{
+		Addr:    "http://hub.example.com:8080",
+		BaseDir: t.TempDir(),
+	}})
+	assert.Nil(t, err)
+	_, err = mgr.LoadImage(context.Background(), "docker.example.com/user/ubuntu:latest")
+	assert.ErrorIs(t, err, types.ErrInvalidImageName)
+	img, err := types.NewImage("docker.example.com/user/ubuntu:latest")
+	assert.Nil(t, err)
+	_, err = mgr.Pull(context.Background(), img, types.PullPolicyNever)
+	assert.ErrorIs(t, err, types.ErrInvalidImageName)
+	assert.ErrorIs(t, mgr.RemoveLocal(context.Background(), img), types.ErrInvalidImageName)
+
+	// the hub's own host is accepted
+	img, err = types.NewImage("hub.example.com:8080/user/ubuntu:latest")
+	assert.Nil(t, err)
+	_, err = mgr.Pull(context.Background(), img, types.PullPolicyNever)
+	assert.ErrorIs(t, err, types.ErrImageNotFound)
+}
+
+func TestReloadWhilePulling(t *testing.T) {
+	started, release := make(chan struct{}, 1), make(chan struct{})
+	oldHub := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case started <- struct{}{}:
+		default:
+		}
+		<-release
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer oldHub.Close()
+	newHits := make(chan string, 1)
+	newHub := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		newHits <- r.URL.Path
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer newHub.Close()
+
+	baseDir := t.TempDir()
+	mgr, err := NewManager(&types.Config{VMIHub: types.VMIHubConfig{Addr: oldHub.URL, BaseDir: baseDir}})
+	assert.Nil(t, err)
+	pulled := make(chan error, 1)
+	go func() {
+		img, _ := types.NewImage("ubuntu:latest")
+		_, err := mgr.Pull(context.Background(), img, types.PullPolicyAlways)
+		pulled <- err
+	}()
+	<-started
+
+	reloaded, err := mgr.Reload(&types.Config{VMIHub: types.VMIHubConfig{
+		Addr: newHub.URL, BaseDir: baseDir, Username: "admin", Password: "pw",
+	}})
+	assert.Nil(t, err)
+	_, err = reloaded.LoadImage(context.Background(), "ubuntu:latest")
+	assert.ErrorIs(t, err, types.ErrImageNotFound)
+	assert.NotEmpty(t, <-newHits)
+	// both managers use the metadata db opened once
+	_, err = reloaded.ListLocalImages(context.Background(), "")
+	assert.Nil(t, err)
+
+	// the pull in flight finishes with the old settings
+	close(release)
+	assert.ErrorIs(t, <-pulled, types.ErrImageNotFound)
+	assert.Equal(t, oldHub.URL, mgr.cfg.VMIHub.Addr)
+
+	_, err = mgr.Reload(&types.Config{VMIHub: types.VMIHubConfig{Addr: newHub.URL, BaseDir: t.TempDir()}})
+	assert.NotNil(t, err)
+}
+
+func TestListRemoteImages(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/api/v1/images", r.URL.Path)
+		assert.Equal(t, "user1", r.URL.Query().Get("username"))
+		data := []map[string]any{}
+		if r.URL.Query().Get("page") == "1" {
+			data = append(data, map[string]any{"username": "user1", "name": "ubuntu", "tag": "22.04", "digest": "abc", "os": map[string]string{"arch": "arm64"}})
+		}
+		_ = json.NewEncoder(w).Encode(map[string]any{"data": data, "total": 1})
+	}))
+	defer srv.Close()
+	mgr, err := NewManager(&types.Config{VMIHub: types.VMIHubConfig{Addr: srv.URL, BaseDir: t.TempDir()}})
+	assert.Nil(t, err)
+
+	images, err := mgr.ListRemoteImages(context.Background(), "user1")
+	assert.Nil(t, err)
+	assert.Len(t, images, 1)
+	assert.Equal(t, "user1/ubuntu:22.04", images[0].Fullname())
+	assert.Equal(t, "abc", images[0].Digest)
+	assert.Equal(t, "arm64", images[0].OS.Arch)
+}
+
+// TestConformance runs against the hub of the config given by
+// VMIMAGE_CONFORMANCE_VMIHUB. The metadata db can't be opened twice, so a
+// single manager serves every test.
+func TestConformance(t *testing.T) {
+	cfg := conformance.LoadConfig(t, "vmihub")
+	if cfg.VMIHub.BaseDir == "" {
+		cfg.VMIHub.BaseDir = t.TempDir()
+	}
+	mgr, err := NewManager(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conformance.Run(t, conformance.Config{
+		NewManager: func(*testing.T) vmimage.Manager { return mgr },
+	})
+}